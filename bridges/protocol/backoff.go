@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Backoff computes jittered exponential reconnect delays. A wait in progress
+// can be cut short with RetryNow, which backs the connection.retry_now command.
+type Backoff struct {
+	min, max time.Duration
+
+	mu      sync.Mutex
+	attempt int
+	retry   chan struct{}
+}
+
+// NewBackoff creates a Backoff whose delays grow from min up to max.
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{
+		min:   min,
+		max:   max,
+		retry: make(chan struct{}, 1),
+	}
+}
+
+// Next counts a new attempt and returns it with the delay to wait before it:
+// min doubled per previous attempt, capped at max, with the upper half
+// randomized so that clients do not reconnect in lockstep.
+func (b *Backoff) Next() (attempt int, delay time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt++
+	d := b.min
+	for i := 1; i < b.attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	d = d/2 + rand.N(d/2+1)
+	return b.attempt, d
+}
+
+// Attempt returns the number of attempts since the last Reset.
+func (b *Backoff) Attempt() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.attempt
+}
+
+// Reset starts over after a successful connection.
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	b.attempt = 0
+	b.mu.Unlock()
+}
+
+// Wait sleeps for d, returning early on RetryNow or when ctx is done.
+func (b *Backoff) Wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-b.retry:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// RetryNow ends the current or next Wait immediately.
+func (b *Backoff) RetryNow() {
+	select {
+	case b.retry <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,77 @@
+package protocol
+
+// ForwardRequest is received as message.forward. Within one service the
+// messages are forwarded natively and the bridge answers message.forward
+// with a ForwardResponse. When ToService names another bridge, the source
+// bridge emits forward.copy instead and the host has the target re-send them.
+type ForwardRequest struct {
+	ChatID     string   `json:"chat_id"`
+	MessageIDs []string `json:"message_ids"`
+	ToService  string   `json:"to_service,omitempty"` // empty for the same service
+	ToChatID   string   `json:"to_chat_id"`
+}
+
+// ForwardResponse lists the messages created by a forward. For a
+// cross-service forward the host sets Error when only some of the messages
+// could be sent to the target.
+type ForwardResponse struct {
+	ChatID     string   `json:"chat_id"`
+	MessageIDs []string `json:"message_ids"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// ForwardCopy is emitted as forward.copy for a cross-service forward. The
+// host sends each of Messages to the ToService bridge as message.copy, with
+// the ID of the original message.forward request.
+type ForwardCopy struct {
+	ToService string               `json:"to_service"`
+	Messages  []CopyMessageRequest `json:"messages"`
+}
+
+// CopyMessageRequest is received as message.copy: a message from another
+// service to re-send with an attribution header such as "Forwarded from
+// Alice (Telegram)". Markdown, when set, is the formatted form of Text.
+type CopyMessageRequest struct {
+	ChatID      string `json:"chat_id"`
+	Text        string `json:"text"`
+	Markdown    string `json:"markdown,omitempty"`
+	ImagePath   string `json:"image_path,omitempty"`
+	Attribution string `json:"attribution"`
+}
+
+// CopyText returns the text of a copied message and its formatting spans,
+// headed by the attribution in italics on its own line.
+func CopyText(req CopyMessageRequest) (string, []Span) {
+	body, spans := req.Text, []Span(nil)
+	if req.Markdown != "" {
+		body, spans = ParseMarkdown(req.Markdown)
+	}
+	if req.Attribution == "" {
+		return body, spans
+	}
+
+	header := []rune(req.Attribution)
+	shift := len(header)
+	text := req.Attribution
+	if body != "" {
+		text += "\n" + body
+		shift++
+	}
+	out := make([]Span, 0, len(spans)+1)
+	out = append(out, Span{Start: 0, End: len(header), Style: StyleItalic})
+	for _, s := range spans {
+		s.Start += shift
+		s.End += shift
+		out = append(out, s)
+	}
+	return text, out
+}
+
+// ForwardAttribution returns the attribution header for a message by from on
+// service, e.g. "Forwarded from Alice (WhatsApp)".
+func ForwardAttribution(from, service string) string {
+	if from == "" {
+		return "Forwarded from " + service
+	}
+	return "Forwarded from " + from + " (" + service + ")"
+}
@@ -1,3 +1,7 @@
 module github.com/aigustalabs/switchboard/bridges/protocol
 
-go 1.23
+go 1.24.0
+
+require golang.org/x/crypto v0.43.0
+
+require golang.org/x/sys v0.37.0 // indirect
@@ -0,0 +1,778 @@
+package protocol
+
+import (
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Switchboard's Markdown dialect, used for formatted text in Message.Markdown
+// and for requests sent with Format "markdown":
+//
+//	**bold**  _italic_  __underline__  ~~strike~~  ||spoiler||
+//	`code`  ```lang\npre\n```  [text](url)  > quote (per line)
+//
+// A backslash escapes the next character, in link URLs too. Markers that are
+// never closed are kept as literal text. "_" and "__" only count at word
+// boundaries, so snake_case stays as is. An empty link separates markers
+// that would otherwise run together: _[]()__italic underline__[]()_.
+//
+// Code is closed by a backtick run as long as the one opening it, so code
+// holding backticks is fenced with a longer run (never three, which opens
+// pre) and padded with a space that is stripped again: `` `x` ``. Pre fences
+// longer than three need a newline in the block.
+
+// Span styles.
+const (
+	StyleBold      = "bold"
+	StyleItalic    = "italic"
+	StyleUnderline = "underline"
+	StyleStrike    = "strike"
+	StyleSpoiler   = "spoiler"
+	StyleCode      = "code"
+	StylePre       = "pre"
+	StyleLink      = "link"
+	StyleQuote     = "quote"
+)
+
+// Span is a formatted range of a plain text, in rune (code point) offsets:
+// it covers runes [Start, End). Services convert these to their own units.
+type Span struct {
+	Start    int
+	End      int
+	Style    string
+	URL      string // StyleLink
+	Language string // StylePre
+}
+
+// markdownPairs maps each paired inline marker to its style, longest first.
+var markdownPairs = []struct {
+	marker string
+	style  string
+}{
+	{"**", StyleBold},
+	{"__", StyleUnderline},
+	{"~~", StyleStrike},
+	{"||", StyleSpoiler},
+	{"_", StyleItalic},
+}
+
+// mdToken is a lexical unit of Markdown source.
+type mdToken struct {
+	kind  mdKind
+	raw   string // source text, emitted as is if the token stays unmatched
+	text  string // content of text, code and pre tokens
+	style string // marker style
+	url   string // linkClose target
+	lang  string // pre language
+	open  bool   // marker can open a span
+	close bool   // marker can close a span
+}
+
+type mdKind int
+
+const (
+	mdText mdKind = iota
+	mdNewline
+	mdMarker
+	mdCode
+	mdPre
+	mdLinkOpen
+	mdLinkClose
+	mdQuote
+)
+
+// ParseMarkdown converts Markdown to plain text plus formatting spans.
+func ParseMarkdown(s string) (string, []Span) {
+	tokens := lexMarkdown([]rune(s))
+	pairs := matchMarkdown(tokens)
+
+	var out []rune
+	var spans []Span
+	opened := make(map[int]int) // opener token index → out position
+	quoteStart := -1
+	closeQuote := func() {
+		if quoteStart >= 0 && len(out) > quoteStart {
+			spans = append(spans, Span{Start: quoteStart, End: len(out), Style: StyleQuote})
+		}
+		quoteStart = -1
+	}
+
+	for i, t := range tokens {
+		switch t.kind {
+		case mdText:
+			out = append(out, []rune(t.text)...)
+		case mdNewline:
+			if quoteStart >= 0 && (i+1 >= len(tokens) || tokens[i+1].kind != mdQuote) {
+				closeQuote()
+			}
+			out = append(out, '\n')
+		case mdQuote:
+			if quoteStart < 0 {
+				quoteStart = len(out)
+			}
+		case mdCode, mdPre:
+			start := len(out)
+			out = append(out, []rune(t.text)...)
+			if len(out) > start {
+				style := StyleCode
+				if t.kind == mdPre {
+					style = StylePre
+				}
+				spans = append(spans, Span{Start: start, End: len(out), Style: style, Language: t.lang})
+			}
+		case mdMarker, mdLinkOpen, mdLinkClose:
+			j, ok := pairs[i]
+			switch {
+			case !ok:
+				out = append(out, []rune(t.raw)...)
+			case j > i:
+				opened[i] = len(out)
+			default:
+				start := opened[j]
+				if len(out) > start {
+					spans = append(spans, Span{Start: start, End: len(out), Style: tokens[j].style, URL: t.url})
+				}
+			}
+		}
+	}
+	closeQuote()
+
+	sortSpans(spans)
+	return string(out), spans
+}
+
+// lexMarkdown splits src into tokens.
+func lexMarkdown(src []rune) []mdToken {
+	var tokens []mdToken
+	var text []rune
+	flush := func() {
+		if len(text) > 0 {
+			tokens = append(tokens, mdToken{kind: mdText, text: string(text), raw: string(text)})
+			text = nil
+		}
+	}
+	has := func(i int, s string) bool {
+		return strings.HasPrefix(string(src[i:min(len(src), i+len(s))]), s)
+	}
+
+	for i := 0; i < len(src); {
+		r := src[i]
+		lineStart := i == 0 || src[i-1] == '\n'
+
+		switch {
+		case lineStart && has(i, "> "):
+			flush()
+			tokens = append(tokens, mdToken{kind: mdQuote, raw: "> "})
+			i += 2
+			continue
+
+		case r == '\n':
+			flush()
+			tokens = append(tokens, mdToken{kind: mdNewline, raw: "\n"})
+			i++
+			continue
+
+		case r == '\\' && i+1 < len(src) && isMarkdownPunct(src[i+1]):
+			text = append(text, src[i+1])
+			i += 2
+			continue
+
+		case r == '`':
+			n := runLength(src, i)
+			end := closingFence(src, i+n, n)
+			if end < 0 {
+				// An unclosed run is literal as a whole.
+				text = append(text, src[i:i+n]...)
+				i += n
+				continue
+			}
+			flush()
+			body := string(src[i+n : end])
+			raw := string(src[i : end+n])
+			if n == 3 || n > 3 && strings.Contains(body, "\n") {
+				lang := ""
+				if nl := strings.IndexByte(body, '\n'); nl >= 0 && !strings.ContainsAny(body[:nl], " \t") {
+					lang, body = body[:nl], body[nl+1:]
+				}
+				body = strings.TrimSuffix(body, "\n")
+				tokens = append(tokens, mdToken{kind: mdPre, text: body, lang: lang, raw: raw})
+			} else {
+				if n > 1 && len(body) >= 2 && body[0] == ' ' && body[len(body)-1] == ' ' {
+					body = body[1 : len(body)-1]
+				}
+				tokens = append(tokens, mdToken{kind: mdCode, text: body, raw: raw})
+			}
+			i = end + n
+			continue
+
+		case r == '[':
+			flush()
+			tokens = append(tokens, mdToken{kind: mdLinkOpen, raw: "[", style: StyleLink})
+			i++
+			continue
+
+		case r == ']' && has(i, "]("):
+			if end := closingParen(src, i+2); end >= 0 {
+				flush()
+				tokens = append(tokens, mdToken{kind: mdLinkClose, raw: string(src[i : end+1]), url: unescapeMarkdown(src[i+2 : end])})
+				i = end + 1
+				continue
+			}
+		}
+
+		if t, ok := lexMarker(src, i); ok {
+			flush()
+			tokens = append(tokens, t)
+			i += len([]rune(t.raw))
+			continue
+		}
+		text = append(text, r)
+		i++
+	}
+	flush()
+	return tokens
+}
+
+// lexMarker reads a paired inline marker at src[i], deciding whether it may
+// open or close a span from the characters around it.
+func lexMarker(src []rune, i int) (mdToken, bool) {
+	for _, p := range markdownPairs {
+		m := []rune(p.marker)
+		if i+len(m) > len(src) || string(src[i:i+len(m)]) != p.marker {
+			continue
+		}
+		var before, after rune = ' ', ' '
+		if i > 0 {
+			before = src[i-1]
+		}
+		if i+len(m) < len(src) {
+			after = src[i+len(m)]
+		}
+		t := mdToken{
+			kind:  mdMarker,
+			raw:   p.marker,
+			style: p.style,
+			open:  !unicode.IsSpace(after),
+			close: !unicode.IsSpace(before),
+		}
+		if m[0] == '_' {
+			// Underscores inside words are literal.
+			t.open = t.open && !isWordRune(before)
+			t.close = t.close && !isWordRune(after)
+		}
+		if !t.open && !t.close {
+			return mdToken{}, false
+		}
+		return t, true
+	}
+	return mdToken{}, false
+}
+
+// matchMarkdown pairs openers with closers and returns both directions of
+// each pair. Markers left open when an outer span closes stay unmatched.
+func matchMarkdown(tokens []mdToken) map[int]int {
+	pairs := make(map[int]int)
+	var stack []int
+	for i, t := range tokens {
+		switch t.kind {
+		case mdMarker:
+			if t.close {
+				if k := findOpener(tokens, stack, func(o mdToken) bool { return o.kind == mdMarker && o.style == t.style }); k >= 0 {
+					pairs[stack[k]], pairs[i] = i, stack[k]
+					stack = stack[:k]
+					continue
+				}
+			}
+			if t.open {
+				stack = append(stack, i)
+			}
+		case mdLinkOpen:
+			stack = append(stack, i)
+		case mdLinkClose:
+			if k := findOpener(tokens, stack, func(o mdToken) bool { return o.kind == mdLinkOpen }); k >= 0 {
+				pairs[stack[k]], pairs[i] = i, stack[k]
+				stack = stack[:k]
+			}
+		}
+	}
+	return pairs
+}
+
+// findOpener returns the stack position of the innermost opener matching fn.
+func findOpener(tokens []mdToken, stack []int, fn func(mdToken) bool) int {
+	for k := len(stack) - 1; k >= 0; k-- {
+		if fn(tokens[stack[k]]) {
+			return k
+		}
+	}
+	return -1
+}
+
+// RenderMarkdown renders text with its formatting spans as Markdown, so that
+// ParseMarkdown returns the same text, formatted the same way. Spans that
+// overlap without nesting are split. Unknown styles are ignored, and spans
+// the dialect cannot express are narrowed or dropped, see fitSpans; the text
+// always survives.
+func RenderMarkdown(text string, spans []Span) string {
+	runes := []rune(text)
+	spans = fitSpans(runes, validSpans(spans, len(runes)))
+	var b strings.Builder
+	var open []Span
+	verbatim := 0 // > 0 inside code or pre
+
+	// Quotes are written as a prefix of each of their lines, ahead of the
+	// markers of other spans, so they are kept apart.
+	var quotes []Span
+	spans = slices.DeleteFunc(spans, func(s Span) bool {
+		if s.Style == StyleQuote {
+			quotes = append(quotes, s)
+			return true
+		}
+		return false
+	})
+	quoted := func(pos int) bool {
+		return slices.ContainsFunc(quotes, func(q Span) bool { return q.Start <= pos && pos < q.End })
+	}
+
+	// Markers running into each other would read as different ones, like
+	// "_" and "__" as "___", so an empty link separates them.
+	last := "" // marker written last, if nothing followed it
+	mark := func(m string) {
+		if last != "" && last[len(last)-1] == m[0] && strings.IndexByte("*_~|`", m[0]) >= 0 {
+			b.WriteString("[]()")
+		}
+		b.WriteString(m)
+		last = m
+	}
+	// Marker characters next to a span edge are escaped, so they do not run
+	// into its marker.
+	edges := make(map[int]bool, 2*len(spans))
+	for _, s := range spans {
+		edges[s.Start], edges[s.End] = true, true
+	}
+
+	closeSpan := func(s Span) {
+		switch s.Style {
+		case StyleLink:
+			mark("](" + escapeURL(s.URL) + ")")
+		case StyleCode:
+			if fence := codeFence(runes[s.Start:s.End]); len(fence) > 1 {
+				mark(" " + fence)
+			} else {
+				mark(fence)
+			}
+			verbatim--
+		case StylePre:
+			mark("\n" + preFence(runes[s.Start:s.End]))
+			verbatim--
+		default:
+			mark(markerFor(s.Style))
+		}
+	}
+	openSpan := func(s Span) {
+		switch s.Style {
+		case StyleLink:
+			mark("[")
+		case StyleCode:
+			if fence := codeFence(runes[s.Start:s.End]); len(fence) > 1 {
+				mark(fence + " ")
+			} else {
+				mark(fence)
+			}
+			verbatim++
+		case StylePre:
+			mark(preFence(runes[s.Start:s.End]) + s.Language + "\n")
+			verbatim++
+		default:
+			mark(markerFor(s.Style))
+		}
+	}
+
+	if quoted(0) {
+		b.WriteString("> ")
+	}
+	next := 0
+	for pos := 0; pos <= len(runes); pos++ {
+		// Close spans ending here, innermost first; spans opened inside one
+		// that ends are closed with it and reopened after.
+		for k := len(open) - 1; k >= 0; k-- {
+			if open[k].End != pos {
+				continue
+			}
+			var reopen []Span
+			for len(open) > k+1 {
+				top := open[len(open)-1]
+				open = open[:len(open)-1]
+				closeSpan(top)
+				if top.End > pos {
+					reopen = append([]Span{top}, reopen...)
+				}
+			}
+			closeSpan(open[k])
+			open = open[:k]
+			for _, s := range reopen {
+				openSpan(s)
+				open = append(open, s)
+			}
+		}
+		for next < len(spans) && spans[next].Start == pos {
+			openSpan(spans[next])
+			open = append(open, spans[next])
+			next++
+		}
+		if pos == len(runes) {
+			break
+		}
+
+		r := runes[pos]
+		last = ""
+		if verbatim > 0 {
+			b.WriteRune(r)
+			continue
+		}
+		if needsEscape(runes, pos) || (edges[pos] || edges[pos+1]) && strings.ContainsRune("*_~|", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+		if r == '\n' && quoted(pos+1) {
+			b.WriteString("> ")
+		}
+	}
+	return b.String()
+}
+
+// validSpans drops empty, out-of-range and unknown spans and sorts the rest
+// by start, longest first.
+func validSpans(spans []Span, n int) []Span {
+	out := make([]Span, 0, len(spans))
+	for _, s := range spans {
+		if s.Start < 0 || s.End > n || s.Start >= s.End {
+			continue
+		}
+		switch s.Style {
+		case StyleBold, StyleItalic, StyleUnderline, StyleStrike, StyleSpoiler,
+			StyleCode, StylePre, StyleLink, StyleQuote:
+			out = append(out, s)
+		}
+	}
+	sortSpans(out)
+	return out
+}
+
+// fitSpans narrows valid spans of runes to what the dialect can express:
+// spans of one style that touch are merged, spans overlapping without
+// nesting are split, inline markers cannot open or close next to whitespace,
+// "_" and "__" only work at word boundaries, quotes cover whole lines, and
+// code and pre hold no other formatting. Spans that cannot be narrowed are
+// dropped.
+func fitSpans(runes []rune, spans []Span) []Span {
+	spans = mergeSpans(runes, spans)
+	// Narrowing a piece can make it cross another span again, so split and
+	// narrow until the spans nest.
+	for crossed := true; crossed; {
+		spans, crossed = splitSpans(narrowSpans(runes, spans))
+	}
+
+	var verbatim, other []Span
+	for _, s := range spans {
+		if s.Style == StyleCode || s.Style == StylePre {
+			if !slices.ContainsFunc(verbatim, func(v Span) bool { return overlaps(s, v) }) {
+				verbatim = append(verbatim, s)
+			}
+			continue
+		}
+		other = append(other, s)
+	}
+	// Quotes end at newlines, which code and pre hide.
+	hidden := func(i int) bool {
+		return slices.ContainsFunc(verbatim, func(v Span) bool { return v.Start <= i && i < v.End })
+	}
+	out := verbatim
+	for _, s := range other {
+		if slices.ContainsFunc(verbatim, func(v Span) bool {
+			return overlaps(s, v) && (v.Start < s.Start || v.End > s.End)
+		}) {
+			continue
+		}
+		if s.Style == StyleQuote && (hidden(s.Start-1) || hidden(s.End)) {
+			continue
+		}
+		out = append(out, s)
+	}
+	sortSpans(out)
+	return out
+}
+
+// mergeSpans merges spans of the same style that overlap or touch, and
+// quotes of consecutive lines, as the dialect cannot tell them apart.
+func mergeSpans(runes []rune, spans []Span) []Span {
+	out := make([]Span, 0, len(spans))
+	for _, s := range spans {
+		merged := false
+		for i, o := range out {
+			if o.Style != s.Style || o.URL != s.URL || o.Language != s.Language {
+				continue
+			}
+			lo, hi := o, s
+			if hi.Start < lo.Start {
+				lo, hi = hi, lo
+			}
+			if hi.Start <= lo.End || s.Style == StyleQuote && hi.Start == lo.End+1 && runes[lo.End] == '\n' {
+				out[i].Start, out[i].End = lo.Start, max(lo.End, hi.End)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			out = append(out, s)
+		}
+	}
+	if len(out) < len(spans) {
+		// A merged span may now reach another one.
+		return mergeSpans(runes, out)
+	}
+	sortSpans(out)
+	return out
+}
+
+// narrowSpans trims inline styles of surrounding whitespace and quotes to
+// whole lines, dropping the spans that cannot be narrowed.
+func narrowSpans(runes []rune, spans []Span) []Span {
+	n := len(runes)
+	out := spans[:0]
+	for _, s := range spans {
+		switch s.Style {
+		case StyleBold, StyleItalic, StyleUnderline, StyleStrike, StyleSpoiler:
+			for s.Start < s.End && unicode.IsSpace(runes[s.Start]) {
+				s.Start++
+			}
+			for s.End > s.Start && unicode.IsSpace(runes[s.End-1]) {
+				s.End--
+			}
+			if markerFor(s.Style)[0] == '_' &&
+				(s.Start > 0 && isWordRune(runes[s.Start-1]) || s.End < n && isWordRune(runes[s.End])) {
+				continue
+			}
+		case StyleQuote:
+			if s.Start > 0 && runes[s.Start-1] != '\n' {
+				nl := slices.Index(runes[s.Start:s.End], '\n')
+				if nl < 0 {
+					continue
+				}
+				s.Start += nl + 1
+			}
+			if s.End < n && runes[s.End] != '\n' {
+				nl := lastIndexRune(runes[s.Start:s.End], '\n')
+				if nl < 0 {
+					continue
+				}
+				s.End = s.Start + nl
+			}
+			for s.End > s.Start && runes[s.End-1] == '\n' {
+				s.End--
+			}
+		case StyleCode:
+			// Fences longer than three around a newline read as pre.
+			content := runes[s.Start:s.End]
+			if len(codeFence(content)) > 3 && slices.Contains(content, '\n') {
+				continue
+			}
+		}
+		if s.Start < s.End {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// splitSpans splits spans that overlap without nesting into pieces that
+// nest, and reports whether there were any. Of two crossing spans the later
+// one is split, unless it is a quote, code or pre and the earlier one is not.
+func splitSpans(spans []Span) ([]Span, bool) {
+	crossed := false
+	for i := 0; i < len(spans); i++ {
+		for j := range spans {
+			a, b := spans[i], spans[j]
+			if !(a.Start < b.Start && b.Start < a.End && a.End < b.End) {
+				continue
+			}
+			crossed = true
+			if isBlockStyle(b.Style) && !isBlockStyle(a.Style) {
+				spans[i].End = b.Start
+				a.Start = b.Start
+				spans = append(spans, a)
+				continue
+			}
+			spans[j].End = a.End
+			b.Start = a.End
+			spans = append(spans, b)
+		}
+	}
+	sortSpans(spans)
+	return spans, crossed
+}
+
+// isBlockStyle reports whether spans of style are better kept whole than
+// split: each piece of a quote must cover whole lines, and pieces of code
+// or pre are fenced separately.
+func isBlockStyle(style string) bool {
+	return style == StyleQuote || style == StyleCode || style == StylePre
+}
+
+// overlaps reports whether spans a and b share a rune.
+func overlaps(a, b Span) bool {
+	return a.Start < b.End && b.Start < a.End
+}
+
+// sortSpans sorts spans by start, longest first, with quotes first as they
+// open at the start of a line, and code and pre inside other spans of the
+// same range.
+func sortSpans(spans []Span) {
+	verbatim := func(s Span) bool { return s.Style == StyleCode || s.Style == StylePre }
+	sort.SliceStable(spans, func(a, b int) bool {
+		if spans[a].Start != spans[b].Start {
+			return spans[a].Start < spans[b].Start
+		}
+		if qa, qb := spans[a].Style == StyleQuote, spans[b].Style == StyleQuote; qa != qb {
+			return qa
+		}
+		if spans[a].End != spans[b].End {
+			return spans[a].End > spans[b].End
+		}
+		return !verbatim(spans[a]) && verbatim(spans[b])
+	})
+}
+
+// codeFence returns the backtick run to fence code holding content: one
+// longer than its longest run, skipping three, which opens pre.
+func codeFence(content []rune) string {
+	n := longestRun(content) + 1
+	if n == 3 {
+		n = 4
+	}
+	return strings.Repeat("`", n)
+}
+
+// preFence returns the backtick run to fence pre holding content.
+func preFence(content []rune) string {
+	return strings.Repeat("`", max(3, longestRun(content)+1))
+}
+
+// longestRun returns the length of the longest backtick run in content.
+func longestRun(content []rune) int {
+	longest := 0
+	for i := 0; i < len(content); i++ {
+		if content[i] == '`' {
+			n := runLength(content, i)
+			longest = max(longest, n)
+			i += n - 1
+		}
+	}
+	return longest
+}
+
+// runLength returns the length of the backtick run starting at src[i].
+func runLength(src []rune, i int) int {
+	n := 0
+	for i+n < len(src) && src[i+n] == '`' {
+		n++
+	}
+	return n
+}
+
+// closingFence returns the index of the first run of exactly n backticks at
+// or after from, or -1.
+func closingFence(src []rune, from, n int) int {
+	for i := from; i < len(src); i++ {
+		if src[i] != '`' {
+			continue
+		}
+		m := runLength(src, i)
+		if m == n {
+			return i
+		}
+		i += m - 1
+	}
+	return -1
+}
+
+// closingParen returns the index of the first unescaped ')' at or after
+// from, or -1.
+func closingParen(src []rune, from int) int {
+	for i := from; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case ')':
+			return i
+		}
+	}
+	return -1
+}
+
+// escapeURL escapes the characters that would end a link URL early.
+func escapeURL(url string) string {
+	return strings.NewReplacer(`\`, `\\`, ")", `\)`).Replace(url)
+}
+
+// unescapeMarkdown removes the backslashes escaping punctuation in src.
+func unescapeMarkdown(src []rune) string {
+	out := make([]rune, 0, len(src))
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\\' && i+1 < len(src) && isMarkdownPunct(src[i+1]) {
+			i++
+		}
+		out = append(out, src[i])
+	}
+	return string(out)
+}
+
+// lastIndexRune returns the index of the last r in src, or -1.
+func lastIndexRune(src []rune, r rune) int {
+	for i := len(src) - 1; i >= 0; i-- {
+		if src[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// markerFor returns the paired marker of an inline style.
+func markerFor(style string) string {
+	for _, p := range markdownPairs {
+		if p.style == style {
+			return p.marker
+		}
+	}
+	return ""
+}
+
+// needsEscape reports whether runes[i] would be read as Markdown syntax.
+func needsEscape(runes []rune, i int) bool {
+	r := runes[i]
+	switch r {
+	case '\\', '`', '[', ']':
+		return true
+	case '>':
+		return i == 0 || runes[i-1] == '\n'
+	case '*', '~', '|':
+		return i+1 < len(runes) && runes[i+1] == r
+	case '_':
+		before := i > 0 && isWordRune(runes[i-1])
+		after := i+1 < len(runes) && isWordRune(runes[i+1])
+		return !before || !after
+	}
+	return false
+}
+
+// isMarkdownPunct reports whether r can be escaped with a backslash.
+func isMarkdownPunct(r rune) bool {
+	return strings.ContainsRune("\\`*_~|[]()>", r)
+}
+
+// isWordRune reports whether r is part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,318 @@
+package protocol
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	tests := []struct {
+		name, in string
+		text     string
+		spans    []Span
+	}{
+		{"plain", "hello", "hello", nil},
+		{"snake case", "snake_case_name", "snake_case_name", nil},
+		{"bold", "**hi** there", "hi there", []Span{{Start: 0, End: 2, Style: StyleBold}}},
+		{"unclosed bold", "**hi", "**hi", nil},
+		{"escaped marker", `\*\*hi\*\*`, "**hi**", nil},
+		{"code", "`a*b*`", "a*b*", []Span{{Start: 0, End: 4, Style: StyleCode}}},
+		{"fenced code", "`` a`b ``", "a`b", []Span{{Start: 0, End: 3, Style: StyleCode}}},
+		{"single fence keeps spaces", "` a `", " a ", []Span{{Start: 0, End: 3, Style: StyleCode}}},
+		{"unclosed fence", "``a`", "``a`", nil},
+		{"pre", "```go\nx := 1\n```", "x := 1", []Span{{Start: 0, End: 6, Style: StylePre, Language: "go"}}},
+		{"inline pre", "```x```", "x", []Span{{Start: 0, End: 1, Style: StylePre}}},
+		{"long pre fence", "````\na```b\n````", "a```b", []Span{{Start: 0, End: 5, Style: StylePre}}},
+		{"link", "[go](https://go.dev)", "go", []Span{{Start: 0, End: 2, Style: StyleLink, URL: "https://go.dev"}}},
+		{"link with escaped paren", `[Go](https://en.wikipedia.org/wiki/Go_\(language\))`, "Go",
+			[]Span{{Start: 0, End: 2, Style: StyleLink, URL: "https://en.wikipedia.org/wiki/Go_(language)"}}},
+		{"quote", "> a\n> b\nc", "a\nb\nc", []Span{{Start: 0, End: 3, Style: StyleQuote}}},
+		{"mid-line quote marker", "hi > there", "hi > there", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, spans := ParseMarkdown(tt.in)
+			if text != tt.text || !slices.Equal(spans, tt.spans) {
+				t.Errorf("ParseMarkdown(%q) = %q, %+v; want %q, %+v", tt.in, text, spans, tt.text, tt.spans)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		spans []Span
+		want  string
+		// parsed are the spans ParseMarkdown returns for want, when they
+		// differ from spans because the dialect cannot express them.
+		parsed []Span
+	}{
+		{
+			name:  "nested",
+			text:  "bold and italic",
+			spans: []Span{{Start: 0, End: 15, Style: StyleBold}, {Start: 9, End: 15, Style: StyleItalic}},
+			want:  "**bold and _italic_**",
+		},
+		{
+			name:  "escapes",
+			text:  "a **b** [c] `d` _e_",
+			spans: nil,
+			want:  "a \\**b\\** \\[c\\] \\`d\\` \\_e\\_",
+		},
+		{
+			name:   "trailing whitespace",
+			text:   "bold text",
+			spans:  []Span{{Start: 0, End: 5, Style: StyleBold}},
+			want:   "**bold** text",
+			parsed: []Span{{Start: 0, End: 4, Style: StyleBold}},
+		},
+		{
+			name:   "leading whitespace",
+			text:   "a strike",
+			spans:  []Span{{Start: 1, End: 8, Style: StyleStrike}},
+			want:   "a ~~strike~~",
+			parsed: []Span{{Start: 2, End: 8, Style: StyleStrike}},
+		},
+		{
+			name:   "whitespace only",
+			text:   "a  b",
+			spans:  []Span{{Start: 1, End: 3, Style: StyleSpoiler}},
+			want:   "a  b",
+			parsed: []Span{},
+		},
+		{
+			name:  "italic at word boundary",
+			text:  "foo bar",
+			spans: []Span{{Start: 4, End: 7, Style: StyleItalic}},
+			want:  "foo _bar_",
+		},
+		{
+			name:   "mid-word italic",
+			text:   "foobar",
+			spans:  []Span{{Start: 3, End: 6, Style: StyleItalic}},
+			want:   "foobar",
+			parsed: []Span{},
+		},
+		{
+			name:   "mid-word underline",
+			text:   "foobar",
+			spans:  []Span{{Start: 0, End: 3, Style: StyleUnderline}},
+			want:   "foobar",
+			parsed: []Span{},
+		},
+		{
+			name:   "cjk italic",
+			text:   "日本語です",
+			spans:  []Span{{Start: 2, End: 3, Style: StyleItalic}},
+			want:   "日本語です",
+			parsed: []Span{},
+		},
+		{
+			name:  "mid-word bold",
+			text:  "foobar",
+			spans: []Span{{Start: 3, End: 6, Style: StyleBold}},
+			want:  "foo**bar**",
+		},
+		{
+			name:  "code with backtick",
+			text:  "a`b",
+			spans: []Span{{Start: 0, End: 3, Style: StyleCode}},
+			want:  "`` a`b ``",
+		},
+		{
+			name:  "code starting with backtick",
+			text:  "`x",
+			spans: []Span{{Start: 0, End: 2, Style: StyleCode}},
+			want:  "`` `x ``",
+		},
+		{
+			name:  "code with double backtick",
+			text:  "x``y",
+			spans: []Span{{Start: 0, End: 4, Style: StyleCode}},
+			want:  "```` x``y ````",
+		},
+		{
+			name:  "pre with fence inside",
+			text:  "a\n```\nb",
+			spans: []Span{{Start: 0, End: 7, Style: StylePre, Language: "md"}},
+			want:  "````md\na\n```\nb\n````",
+		},
+		{
+			name:   "formatting inside code",
+			text:   "a+b",
+			spans:  []Span{{Start: 0, End: 3, Style: StyleCode}, {Start: 1, End: 2, Style: StyleBold}},
+			want:   "`a+b`",
+			parsed: []Span{{Start: 0, End: 3, Style: StyleCode}},
+		},
+		{
+			name:   "mid-line quote",
+			text:   "hi there",
+			spans:  []Span{{Start: 3, End: 8, Style: StyleQuote}},
+			want:   "hi there",
+			parsed: []Span{},
+		},
+		{
+			name:   "quote from mid-line",
+			text:   "a b\nc",
+			spans:  []Span{{Start: 2, End: 5, Style: StyleQuote}},
+			want:   "a b\n> c",
+			parsed: []Span{{Start: 4, End: 5, Style: StyleQuote}},
+		},
+		{
+			name:   "quote with trailing newline",
+			text:   "q\nr\nrest",
+			spans:  []Span{{Start: 0, End: 4, Style: StyleQuote}},
+			want:   "> q\n> r\nrest",
+			parsed: []Span{{Start: 0, End: 3, Style: StyleQuote}},
+		},
+		{
+			name:  "link with parens",
+			text:  "Go",
+			spans: []Span{{Start: 0, End: 2, Style: StyleLink, URL: `https://en.wikipedia.org/wiki/Go_(language)`}},
+			want:  `[Go](https://en.wikipedia.org/wiki/Go_(language\))`,
+		},
+		{
+			name:  "link with backslash",
+			text:  "x",
+			spans: []Span{{Start: 0, End: 1, Style: StyleLink, URL: `https://a/\)`}},
+			want:  `[x](https://a/\\\))`,
+		},
+		{
+			name:  "overlap",
+			text:  "abcd",
+			spans: []Span{{Start: 0, End: 3, Style: StyleBold}, {Start: 1, End: 4, Style: StyleStrike}},
+			want:  "**a~~bc~~**~~d~~",
+			parsed: []Span{
+				{Start: 0, End: 3, Style: StyleBold},
+				{Start: 1, End: 3, Style: StyleStrike},
+				{Start: 3, End: 4, Style: StyleStrike},
+			},
+		},
+		{
+			name:  "overlap at whitespace",
+			text:  "ab cd ef",
+			spans: []Span{{Start: 0, End: 5, Style: StyleBold}, {Start: 3, End: 8, Style: StyleItalic}},
+			want:  "**ab _cd_** _ef_",
+			parsed: []Span{
+				{Start: 0, End: 5, Style: StyleBold},
+				{Start: 3, End: 5, Style: StyleItalic},
+				{Start: 6, End: 8, Style: StyleItalic},
+			},
+		},
+		{
+			name:   "italic and underline",
+			text:   "hello",
+			spans:  []Span{{Start: 0, End: 5, Style: StyleItalic}, {Start: 0, End: 5, Style: StyleUnderline}},
+			want:   "_[]()__hello__[]()_",
+			parsed: []Span{{Start: 0, End: 5, Style: StyleUnderline}, {Start: 0, End: 5, Style: StyleItalic}},
+		},
+		{
+			name:  "italic ending underline",
+			text:  "hello world",
+			spans: []Span{{Start: 0, End: 11, Style: StyleUnderline}, {Start: 6, End: 11, Style: StyleItalic}},
+			want:  "__hello _world_[]()__",
+		},
+		{
+			name:  "marker character at edge",
+			text:  "bold *",
+			spans: []Span{{Start: 0, End: 6, Style: StyleBold}},
+			want:  `**bold \***`,
+		},
+		{
+			name:   "quotes of consecutive lines",
+			text:   "a\nb",
+			spans:  []Span{{Start: 0, End: 1, Style: StyleQuote}, {Start: 2, End: 3, Style: StyleQuote}},
+			want:   "> a\n> b",
+			parsed: []Span{{Start: 0, End: 3, Style: StyleQuote}},
+		},
+		{
+			name:  "emoji",
+			text:  "hi 👍🏽 👨‍👩‍👧",
+			spans: []Span{{Start: 3, End: 5, Style: StyleBold}, {Start: 6, End: 11, Style: StyleSpoiler}},
+			want:  "hi **👍🏽** ||👨‍👩‍👧||",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RenderMarkdown(tt.text, tt.spans)
+			if got != tt.want {
+				t.Errorf("RenderMarkdown = %q, want %q", got, tt.want)
+			}
+			want := tt.parsed
+			if want == nil {
+				want = tt.spans
+			}
+			text, spans := ParseMarkdown(got)
+			if text != tt.text {
+				t.Errorf("ParseMarkdown(%q) text = %q, want %q", got, text, tt.text)
+			}
+			if len(spans) != 0 || len(want) != 0 {
+				if !slices.Equal(spans, want) {
+					t.Errorf("ParseMarkdown(%q) spans = %+v, want %+v", got, spans, want)
+				}
+			}
+		})
+	}
+}
+
+// TestRenderMarkdownRoundTrip renders random text with random, often
+// overlapping spans and checks that ParseMarkdown gives back the text, with
+// every rune formatted as RenderMarkdown could express.
+func TestRenderMarkdownRoundTrip(t *testing.T) {
+	alphabet := []rune("ab1 \n*_~|`[]()>\\é👍")
+	styles := []string{StyleBold, StyleItalic, StyleUnderline, StyleStrike, StyleSpoiler,
+		StyleCode, StylePre, StyleLink, StyleQuote}
+	urls := []string{"https://a.b/", "https://a.b/(x)", `https://a.b/\`}
+	rng := rand.New(rand.NewPCG(1, 2))
+
+	for i := 0; i < 20000; i++ {
+		runes := make([]rune, rng.IntN(12))
+		for j := range runes {
+			runes[j] = alphabet[rng.IntN(len(alphabet))]
+		}
+		text := string(runes)
+		var spans []Span
+		for range rng.IntN(5) {
+			s := Span{Start: rng.IntN(len(runes) + 1), End: rng.IntN(len(runes) + 1), Style: styles[rng.IntN(len(styles))]}
+			switch s.Style {
+			case StyleLink:
+				s.URL = urls[rng.IntN(len(urls))]
+			case StylePre:
+				s.Language = []string{"", "go"}[rng.IntN(2)]
+			}
+			spans = append(spans, s)
+		}
+
+		md := RenderMarkdown(text, spans)
+		gotText, gotSpans := ParseMarkdown(md)
+		if gotText != text {
+			t.Fatalf("RenderMarkdown(%q, %+v) = %q, parses to text %q", text, spans, md, gotText)
+		}
+		want := styleCoverage(len(runes), fitSpans(runes, validSpans(spans, len(runes))))
+		if got := styleCoverage(len(runes), gotSpans); !slices.Equal(got, want) {
+			t.Fatalf("RenderMarkdown(%q, %+v) = %q, parses to spans %+v; want %+v",
+				text, spans, md, gotSpans, fitSpans(runes, validSpans(spans, len(runes))))
+		}
+	}
+}
+
+// styleCoverage returns, for each of n runes, the formatting spans give it.
+func styleCoverage(n int, spans []Span) []string {
+	out := make([]string, n)
+	for i := range out {
+		var styles []string
+		for _, s := range spans {
+			if s.Start <= i && i < s.End {
+				styles = append(styles, s.Style+"("+s.URL+s.Language+")")
+			}
+		}
+		slices.Sort(styles)
+		styles = slices.Compact(styles)
+		out[i] = strings.Join(styles, " ")
+	}
+	return out
+}
@@ -17,23 +17,95 @@ type Envelope struct {
 
 // Chat represents a conversation.
 type Chat struct {
-	ID          string `json:"id"`
-	Name        string `json:"name"`
-	UnreadCount int    `json:"unread"`
-	LastMessage string `json:"last_message,omitempty"`
-	LastTime    int64  `json:"last_time,omitempty"`
-	IsGroup     bool   `json:"is_group"`
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	UnreadCount int      `json:"unread"`
+	LastMessage string   `json:"last_message,omitempty"`
+	LastTime    int64    `json:"last_time,omitempty"`
+	IsGroup     bool     `json:"is_group"`
+	Pinned      bool     `json:"pinned,omitempty"`
+	Archived    bool     `json:"archived,omitempty"`
+	Muted       bool     `json:"muted,omitempty"`
+	MutedUntil  int64    `json:"muted_until,omitempty"` // unix seconds; unset for an indefinite mute
+	IsForum     bool     `json:"is_forum,omitempty"`    // Telegram group organised in topics
+	Folders     []string `json:"folders,omitempty"`     // IDs of the folders listing the chat
 }
 
 // Message represents a single message in a conversation.
 type Message struct {
-	ID        string `json:"id"`
+	ID        string     `json:"id"`
+	ChatID    string     `json:"chat_id"`
+	From      string     `json:"from"`
+	FromMe    bool       `json:"from_me"`
+	Text      string     `json:"text"`
+	Markdown  string     `json:"markdown,omitempty"` // Text with formatting, set only when it has any
+	Timestamp int64      `json:"timestamp"`
+	ImagePath string     `json:"image_path,omitempty"`
+	EditedAt  int64      `json:"edited_at,omitempty"`
+	Reactions []Reaction `json:"reactions,omitempty"`
+	TopicID   string     `json:"topic_id,omitempty"` // forum topic, see Topic
+}
+
+// Reaction is one emoji's aggregated reactions on a message.
+type Reaction struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	FromMe  bool     `json:"from_me"`
+	Senders []string `json:"senders,omitempty"`
+}
+
+// ReactionsChanged is emitted when the reactions on a message change.
+// Reactions holds the full aggregated set, replacing any previous one.
+type ReactionsChanged struct {
+	ChatID    string     `json:"chat_id"`
+	MessageID string     `json:"message_id"`
+	Reactions []Reaction `json:"reactions"`
+}
+
+// MessageDeleted is emitted when messages are removed from a chat.
+// ChatID is empty when the service does not say which chat the messages
+// belonged to (Telegram private chats and basic groups, whose message IDs
+// are unique per account).
+type MessageDeleted struct {
+	ChatID     string   `json:"chat_id,omitempty"`
+	MessageIDs []string `json:"message_ids"`
+}
+
+// Receipt is emitted when messages we sent are delivered, read or played.
+// When UpTo is set, MessageIDs holds a single ID and every earlier message
+// in the chat is covered too (Telegram reports read state as a watermark).
+type Receipt struct {
+	ChatID     string   `json:"chat_id"`
+	MessageIDs []string `json:"message_ids"`
+	Status     string   `json:"status"` // "delivered", "read", "played"
+	UpTo       bool     `json:"up_to,omitempty"`
+	From       string   `json:"from,omitempty"`
+	Timestamp  int64    `json:"timestamp,omitempty"`
+}
+
+// UnreadChanged is emitted when a chat's unread count changes because it was
+// read on another device.
+type UnreadChanged struct {
+	ChatID      string `json:"chat_id"`
+	UnreadCount int    `json:"unread"`
+}
+
+// Typing is emitted when someone starts or stops typing in a chat.
+// ExpiresAt is when the indicator lapses unless refreshed; a Typing event with
+// Typing=false is emitted automatically at that point.
+type Typing struct {
 	ChatID    string `json:"chat_id"`
 	From      string `json:"from"`
-	FromMe    bool   `json:"from_me"`
-	Text      string `json:"text"`
-	Timestamp int64  `json:"timestamp"`
-	ImagePath string `json:"image_path,omitempty"`
+	Typing    bool   `json:"typing"`
+	Action    string `json:"action,omitempty"` // "typing", "recording", "uploading"
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+// Presence is emitted when a contact's online status changes.
+type Presence struct {
+	UserID   string `json:"user_id"`
+	Online   bool   `json:"online"`
+	LastSeen int64  `json:"last_seen,omitempty"`
 }
 
 // AuthQR is emitted when a QR code is available for scanning.
@@ -41,6 +113,27 @@ type AuthQR struct {
 	Code string `json:"code"`
 }
 
+// AuthPairCode is emitted with the 8-character link code to enter on the
+// phone when pairing by phone number instead of scanning a QR code.
+type AuthPairCode struct {
+	Code string `json:"code"`
+}
+
+// LogoutRequest is received as auth.logout to sign the account out. Wipe also
+// deletes the account's local data: cached peers, message history and media.
+type LogoutRequest struct {
+	Wipe bool `json:"wipe,omitempty"`
+}
+
+// AuthFailed is emitted as auth.failed when pairing fails, and as
+// auth.timeout when no QR code was scanned in time. Reason is one of
+// "timeout", "client_outdated", "multidevice_limit", "pair_error",
+// "pair_phone", "invalid_phone", "connect" or "unexpected_state".
+type AuthFailed struct {
+	Reason  string `json:"reason"`
+	Message string `json:"message,omitempty"`
+}
+
 // AuthCodeNeeded is emitted when a phone code is needed.
 type AuthCodeNeeded struct {
 	PhoneHint string `json:"phone_hint"`
@@ -52,9 +145,12 @@ type AuthSuccess struct {
 	Phone string `json:"phone,omitempty"`
 }
 
-// AuthStart is received to begin authentication.
+// AuthStart is received to begin authentication. Method selects how a
+// WhatsApp device is linked: "qr" (default) or "phone", which pairs with a
+// link code for Phone instead of a QR scan.
 type AuthStart struct {
-	Phone string `json:"phone,omitempty"`
+	Phone  string `json:"phone,omitempty"`
+	Method string `json:"method,omitempty"`
 }
 
 // AuthCode is received with the verification code.
@@ -65,16 +161,96 @@ type AuthCode struct {
 // ChatListRequest is for requesting chats.
 type ChatListRequest struct{}
 
-// ChatMessagesRequest is for requesting messages in a chat.
+// ChatMessagesRequest is for requesting messages in a chat, newest first.
+// Cursor is the NextCursor of a previous response and continues with older
+// messages; it is opaque and bridge-specific.
 type ChatMessagesRequest struct {
-	ChatID string `json:"chat_id"`
+	ChatID  string `json:"chat_id"`
+	Limit   int    `json:"limit"`
+	Cursor  string `json:"cursor,omitempty"`
+	TopicID string `json:"topic_id,omitempty"` // only messages of this forum topic
+}
+
+// SearchRequest is for full-text message search, optionally restricted to a
+// chat, a sender (user ID or JID), a date range (unix seconds, inclusive) and
+// a media type ("photo", "video", "audio", "voice", "document", "link").
+// Results are paged with the same cursor scheme as chat.messages.
+type SearchRequest struct {
+	Query  string `json:"query"`
+	ChatID string `json:"chat_id,omitempty"`
+	From   string `json:"from,omitempty"`
+	After  int64  `json:"after,omitempty"`
+	Before int64  `json:"before,omitempty"`
+	Media  string `json:"media,omitempty"`
 	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor,omitempty"`
 }
 
 // SendMessageRequest is for sending a message.
 type SendMessageRequest struct {
+	ChatID  string `json:"chat_id"`
+	Text    string `json:"text"`
+	Format  string `json:"format,omitempty"`   // "markdown" to parse Text as Markdown
+	ReplyTo string `json:"reply_to,omitempty"` // ID of a message in the chat to reply to
+	TopicID string `json:"topic_id,omitempty"` // forum topic to post in
+}
+
+// EditMessageRequest is for replacing the text of a sent message.
+type EditMessageRequest struct {
+	ChatID    string `json:"chat_id"`
+	MessageID string `json:"message_id"`
+	Text      string `json:"text"`
+	Format    string `json:"format,omitempty"` // "markdown" to parse Text as Markdown
+}
+
+// DeleteMessageRequest is for deleting messages, either only for us or for
+// everyone in the chat. Sender is the author of the messages when they are
+// not our own (WhatsApp needs it to address them).
+type DeleteMessageRequest struct {
+	ChatID      string   `json:"chat_id"`
+	MessageIDs  []string `json:"message_ids"`
+	ForEveryone bool     `json:"for_everyone"`
+	Sender      string   `json:"sender,omitempty"`
+}
+
+// MarkReadRequest is for marking a chat as read. MessageIDs lists the
+// messages being read; Telegram reads up to the highest of them (or the whole
+// chat when empty), while WhatsApp needs the IDs themselves plus their Sender
+// in group chats.
+type MarkReadRequest struct {
+	ChatID     string   `json:"chat_id"`
+	MessageIDs []string `json:"message_ids,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+}
+
+// TypingRequest is for showing or clearing our typing indicator in a chat.
+type TypingRequest struct {
+	ChatID string `json:"chat_id"`
+	Typing bool   `json:"typing"`
+}
+
+// MuteRequest is received as chat.mute and chat.unmute. Until is when a
+// mute ends, in unix seconds; 0 mutes indefinitely. It is ignored on unmute.
+type MuteRequest struct {
+	ChatID string `json:"chat_id"`
+	Until  int64  `json:"until,omitempty"`
+}
+
+// MuteState answers chat.mute and chat.unmute, and is emitted as
+// chat.mute_changed when a chat is muted or unmuted on another device.
+// Until is unset for an indefinite mute.
+type MuteState struct {
 	ChatID string `json:"chat_id"`
-	Text   string `json:"text"`
+	Muted  bool   `json:"muted"`
+	Until  int64  `json:"until,omitempty"`
+}
+
+// ReactRequest is for adding (message.react) or removing (message.unreact)
+// our reaction on a message.
+type ReactRequest struct {
+	ChatID    string `json:"chat_id"`
+	MessageID string `json:"message_id"`
+	Emoji     string `json:"emoji,omitempty"`
 }
 
 // ChatListResponse wraps the list of chats.
@@ -82,21 +258,107 @@ type ChatListResponse struct {
 	Chats []Chat `json:"chats"`
 }
 
-// ChatMessagesResponse wraps the list of messages.
+// ChatMessagesResponse wraps the list of messages. NextCursor is empty when
+// there are no older messages to fetch. HistoryPending is set when the bridge
+// has asked the service for older history, which will be announced with a
+// history.synced event once it arrives.
 type ChatMessagesResponse struct {
-	Messages []Message `json:"messages"`
+	Messages       []Message `json:"messages"`
+	NextCursor     string    `json:"next_cursor,omitempty"`
+	HistoryPending bool      `json:"history_pending,omitempty"`
 }
 
-// Notification is emitted for OS notifications.
+// Folder is a Telegram chat folder. Which chats it lists is reported per
+// chat in Chat.Folders; Pinned holds the chats pinned in it, in order.
+type Folder struct {
+	ID       string   `json:"id"`
+	Title    string   `json:"title"`
+	Emoticon string   `json:"emoticon,omitempty"`
+	Pinned   []string `json:"pinned,omitempty"`
+}
+
+// FoldersResponse answers folders.list, and is emitted unprompted as
+// folders.changed when folders are edited, added, removed or reordered.
+type FoldersResponse struct {
+	Folders []Folder `json:"folders"`
+}
+
+// ChatsChanged is emitted when chats were pinned, archived or moved between
+// folders on another device; the UI should refetch chats.list. ChatIDs is
+// empty when any chat may have changed. History is set when messages of the
+// chats were missed, so their chat.messages must be refetched too.
+type ChatsChanged struct {
+	ChatIDs []string `json:"chat_ids,omitempty"`
+	History bool     `json:"history,omitempty"`
+}
+
+// Topic is a topic of a Telegram forum group. Its ID is the ID of the
+// message that created it; the General topic has ID "1".
+type Topic struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	UnreadCount int    `json:"unread"`
+	LastTime    int64  `json:"last_time,omitempty"`
+	Pinned      bool   `json:"pinned,omitempty"`
+	Closed      bool   `json:"closed,omitempty"`
+}
+
+// TopicsRequest is received as chat.topics to list the topics of a forum.
+type TopicsRequest struct {
+	ChatID string `json:"chat_id"`
+}
+
+// TopicsResponse answers chat.topics.
+type TopicsResponse struct {
+	ChatID string  `json:"chat_id"`
+	Topics []Topic `json:"topics"`
+}
+
+// HistorySynced is emitted after the bridge has stored a batch of history
+// for the listed chats, so the UI can refetch them.
+type HistorySynced struct {
+	ChatIDs  []string `json:"chat_ids"`
+	Messages int      `json:"messages"`
+}
+
+// SearchResponse wraps the messages matching a search, newest first.
+type SearchResponse struct {
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// Notification is emitted for OS notifications. Silent notifications, for
+// mentions in muted chats and messages in archived ones, should be shown
+// without sound. Bridges pass each through their NotificationRules, which
+// may drop it or set its Priority.
 type Notification struct {
-	Title   string `json:"title"`
-	Body    string `json:"body"`
-	Service string `json:"service"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Service   string `json:"service"`
+	ChatID    string `json:"chat_id,omitempty"`
+	Sender    string `json:"sender,omitempty"`    // sender ID
+	Mentioned bool   `json:"mentioned,omitempty"` // mentions or replies to us
+	Silent    bool   `json:"silent,omitempty"`
+	Priority  string `json:"priority,omitempty"` // PriorityLow, PriorityNormal or PriorityHigh
+}
+
+// ErrorData is the payload of an "error" envelope. Code is set for errors
+// the UI handles specially, e.g. "rate_limited" with RetryAfter in seconds.
+type ErrorData struct {
+	Message    string `json:"message"`
+	Code       string `json:"code,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
 }
 
-// StatusData wraps bridge status.
+// StatusData wraps bridge status: "connecting", "connected",
+// "reconnecting", "disconnected", "auth_needed", "logged_out", "banned" or
+// "locked". Reason explains the state in plain words; while reconnecting,
+// Attempt counts the retries and NextRetryAt is when the next one starts.
 type StatusData struct {
-	Status string `json:"status"` // "connected", "disconnected", "auth_needed"
+	Status      string `json:"status"`
+	Reason      string `json:"reason,omitempty"`
+	Attempt     int    `json:"attempt,omitempty"`
+	NextRetryAt int64  `json:"next_retry_at,omitempty"`
 }
 
 // Writer writes JSON-lines to stdout.
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ProxyRequest is received as proxy.set to change the bridge's proxy. URL is
+// socks5://[user:pass@]host:port, http://host:port (HTTP CONNECT) or, for
+// Telegram only, mtproxy://host:port?secret=<hex>. An empty URL disables it.
+type ProxyRequest struct {
+	URL string `json:"url"`
+}
+
+// ProxyResponse answers proxy.set and proxy.get with the active proxy, its
+// credentials redacted.
+type ProxyResponse struct {
+	URL string `json:"url"`
+}
+
+// proxyFile is the on-disk proxy setting of a bridge.
+type proxyFile struct {
+	URL string `json:"url"`
+}
+
+// LoadProxy returns the configured proxy URL for service ("telegram",
+// "whatsapp"). The <SERVICE>_PROXY environment variable takes precedence
+// over the <service>-proxy.json file in dir written by SaveProxy.
+func LoadProxy(dir, service string) (string, error) {
+	if v := os.Getenv(strings.ToUpper(service) + "_PROXY"); v != "" {
+		return v, nil
+	}
+	b, err := os.ReadFile(proxyPath(dir, service))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("read proxy config: %w", err)
+	}
+	var f proxyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return "", fmt.Errorf("parse proxy config: %w", err)
+	}
+	return f.URL, nil
+}
+
+// SaveProxy persists the proxy URL for service; an empty URL removes it.
+func SaveProxy(dir, service, rawURL string) error {
+	path := proxyPath(dir, service)
+	if rawURL == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove proxy config: %w", err)
+		}
+		return nil
+	}
+	b, err := json.Marshal(proxyFile{URL: rawURL})
+	if err != nil {
+		return fmt.Errorf("marshal proxy config: %w", err)
+	}
+	return writeFileAtomic(path, b)
+}
+
+// RedactProxy returns rawURL with any password replaced and the query, which
+// carries MTProxy secrets, removed, for logs and replies.
+func RedactProxy(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid proxy URL>"
+	}
+	u.RawQuery = ""
+	u.ForceQuery = false
+	u.Fragment = ""
+	return u.Redacted()
+}
+
+// proxyPath returns the proxy config file of service in dir.
+func proxyPath(dir, service string) string {
+	return filepath.Join(dir, service+"-proxy.json")
+}
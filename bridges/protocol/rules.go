@@ -0,0 +1,316 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification actions and priorities of a NotificationRule.
+const (
+	ActionDeliver = "deliver"
+	ActionDrop    = "drop"
+
+	PriorityLow    = "low"
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// NotificationRule decides what happens to the notifications it matches.
+// Rules are tried in file order and the first match wins; notifications no
+// rule matches are delivered unchanged, unless their chat is muted.
+type NotificationRule struct {
+	Name  string            `json:"name,omitempty"`
+	Match NotificationMatch `json:"match"`
+	// Action is ActionDeliver or ActionDrop.
+	Action string `json:"action"`
+	// Priority of delivered notifications: low ones are shown silently and
+	// high ones with sound, even in archived chats.
+	Priority string `json:"priority,omitempty"`
+}
+
+// NotificationMatch is the condition of a rule. Every field set must match;
+// an empty match matches everything.
+type NotificationMatch struct {
+	Service string   `json:"service,omitempty"`
+	Chats   []string `json:"chats,omitempty"`   // chat IDs
+	Senders []string `json:"senders,omitempty"` // sender IDs
+	// Text is a regular expression searched for in the body.
+	Text    string      `json:"text,omitempty"`
+	Mention *bool       `json:"mention,omitempty"`
+	Time    *TimeWindow `json:"time,omitempty"`
+}
+
+// TimeWindow is a daily span of local time, "HH:MM" to "HH:MM". A window
+// ending before it starts runs past midnight, and one ending as it starts
+// covers the whole day. Days ("mon" to "sun") limit the days it starts on.
+type TimeWindow struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`
+	Days []string `json:"days,omitempty"`
+}
+
+// NotificationRulesRequest is received as notifications.rules. Without Test
+// it reloads the rules file; with Test it is a dry run that reports what
+// the loaded rules would do to that notification at Time (unix seconds,
+// 0 for now), without reloading.
+type NotificationRulesRequest struct {
+	Test *Notification `json:"test,omitempty"`
+	Time int64         `json:"time,omitempty"`
+}
+
+// NotificationRulesResponse answers notifications.rules with the number of
+// rules loaded and, for a dry run, the decision.
+type NotificationRulesResponse struct {
+	Rules    int                   `json:"rules"`
+	Decision *NotificationDecision `json:"decision,omitempty"`
+}
+
+// NotificationDecision is the outcome of the rules for a notification. Rule
+// is the name, or else the 1-based position, of the rule that matched, and
+// is unset when none did.
+type NotificationDecision struct {
+	Deliver  bool   `json:"deliver"`
+	Priority string `json:"priority,omitempty"`
+	Rule     string `json:"rule,omitempty"`
+}
+
+// rulesFile is the on-disk form of the notification rules.
+type rulesFile struct {
+	Rules []NotificationRule `json:"rules"`
+}
+
+// compiledRule is a NotificationRule prepared for matching.
+type compiledRule struct {
+	NotificationRule
+	label   string
+	chats   map[string]bool
+	senders map[string]bool
+	text    *regexp.Regexp
+	window  *timeWindow
+}
+
+// timeWindow is a parsed TimeWindow, in minutes since midnight.
+type timeWindow struct {
+	from, to int
+	days     map[time.Weekday]bool // nil for every day
+}
+
+// NotificationRules evaluates notifications against the rules in the
+// notification-rules.json file of a config directory, which both bridges
+// share. It is safe for concurrent use.
+type NotificationRules struct {
+	path  string
+	mu    sync.RWMutex
+	rules []compiledRule
+}
+
+// NewNotificationRules returns an engine for the rules file in dir, with no
+// rules until Reload is called.
+func NewNotificationRules(dir string) *NotificationRules {
+	return &NotificationRules{path: filepath.Join(dir, "notification-rules.json")}
+}
+
+// Reload reads the rules file and returns the number of rules. A missing
+// file means no rules; an invalid one leaves the current rules in place.
+func (r *NotificationRules) Reload() (int, error) {
+	var f rulesFile
+	b, err := os.ReadFile(r.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("read notification rules: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, &f); err != nil {
+			return 0, fmt.Errorf("parse notification rules: %w", err)
+		}
+	}
+
+	rules := make([]compiledRule, 0, len(f.Rules))
+	for i, rule := range f.Rules {
+		c, err := compileRule(rule, i)
+		if err != nil {
+			return 0, fmt.Errorf("notification rule %s: %w", c.label, err)
+		}
+		rules = append(rules, c)
+	}
+	r.mu.Lock()
+	r.rules = rules
+	r.mu.Unlock()
+	return len(rules), nil
+}
+
+// Decide returns what the rules do to n at now.
+func (r *NotificationRules) Decide(n Notification, now time.Time) NotificationDecision {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, rule := range r.rules {
+		if rule.matches(n, now) {
+			return NotificationDecision{
+				Deliver:  rule.Action == ActionDeliver,
+				Priority: rule.Priority,
+				Rule:     rule.label,
+			}
+		}
+	}
+	return NotificationDecision{Deliver: true}
+}
+
+// Apply decides n now and reports whether to deliver it, setting its
+// priority and, from that, whether it is silent. Notifications of chats
+// muted upstream go through the rules too, so a rule can let them through;
+// when none matches they are only delivered if they mention us.
+func (r *NotificationRules) Apply(n *Notification, muted bool) bool {
+	d := r.Decide(*n, time.Now())
+	if d.Rule == "" {
+		return !muted || n.Mentioned
+	}
+	if !d.Deliver {
+		return false
+	}
+	n.Priority = d.Priority
+	switch d.Priority {
+	case PriorityLow:
+		n.Silent = true
+	case PriorityHigh:
+		n.Silent = false
+	}
+	return true
+}
+
+// Handle answers notifications.rules: a dry run of req.Test, or a reload.
+func (r *NotificationRules) Handle(req NotificationRulesRequest) (NotificationRulesResponse, error) {
+	if req.Test == nil {
+		n, err := r.Reload()
+		return NotificationRulesResponse{Rules: n}, err
+	}
+	now := time.Now()
+	if req.Time != 0 {
+		now = time.Unix(req.Time, 0)
+	}
+	d := r.Decide(*req.Test, now)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return NotificationRulesResponse{Rules: len(r.rules), Decision: &d}, nil
+}
+
+// compileRule validates rule, the i-th in the file, and prepares it.
+func compileRule(rule NotificationRule, i int) (compiledRule, error) {
+	c := compiledRule{NotificationRule: rule, label: rule.Name}
+	if c.label == "" {
+		c.label = fmt.Sprintf("#%d", i+1)
+	}
+	if rule.Action != ActionDeliver && rule.Action != ActionDrop {
+		return c, fmt.Errorf("unknown action %q", rule.Action)
+	}
+	switch rule.Priority {
+	case "", PriorityLow, PriorityNormal, PriorityHigh:
+	default:
+		return c, fmt.Errorf("unknown priority %q", rule.Priority)
+	}
+
+	m := rule.Match
+	c.chats = stringSet(m.Chats)
+	c.senders = stringSet(m.Senders)
+	if m.Text != "" {
+		re, err := regexp.Compile(m.Text)
+		if err != nil {
+			return c, fmt.Errorf("text: %w", err)
+		}
+		c.text = re
+	}
+	if m.Time != nil {
+		w, err := parseTimeWindow(*m.Time)
+		if err != nil {
+			return c, fmt.Errorf("time: %w", err)
+		}
+		c.window = &w
+	}
+	return c, nil
+}
+
+// matches reports whether n, notified at now, meets every condition of c.
+func (c compiledRule) matches(n Notification, now time.Time) bool {
+	m := c.Match
+	switch {
+	case m.Service != "" && m.Service != n.Service,
+		c.chats != nil && !c.chats[n.ChatID],
+		c.senders != nil && !c.senders[n.Sender],
+		c.text != nil && !c.text.MatchString(n.Body),
+		m.Mention != nil && *m.Mention != n.Mentioned,
+		c.window != nil && !c.window.contains(now):
+		return false
+	}
+	return true
+}
+
+// weekdays maps TimeWindow day names to weekdays.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseTimeWindow validates and parses w.
+func parseTimeWindow(w TimeWindow) (timeWindow, error) {
+	var out timeWindow
+	var err error
+	if out.from, err = parseClock(w.From); err != nil {
+		return out, err
+	}
+	if out.to, err = parseClock(w.To); err != nil {
+		return out, err
+	}
+	if len(w.Days) > 0 {
+		out.days = make(map[time.Weekday]bool, len(w.Days))
+		for _, d := range w.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return out, fmt.Errorf("unknown day %q", d)
+			}
+			out.days[wd] = true
+		}
+	}
+	return out, nil
+}
+
+// parseClock parses "HH:MM" to minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether now, in its own location, falls in the window.
+func (w timeWindow) contains(now time.Time) bool {
+	day := func(d time.Weekday) bool { return w.days == nil || w.days[d] }
+	m := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	switch {
+	case w.from == w.to:
+		return day(today)
+	case w.from < w.to:
+		return m >= w.from && m < w.to && day(today)
+	}
+	// Past midnight: late today, or early in a window started yesterday.
+	yesterday := (today + 6) % 7
+	return (m >= w.from && day(today)) || (m < w.to && day(yesterday))
+}
+
+// stringSet returns the set of ss, nil when empty.
+func stringSet(ss []string) map[string]bool {
+	if len(ss) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		set[s] = true
+	}
+	return set
+}
@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	// 2024-01-01 was a Monday.
+	at := func(day int, clock string) time.Time {
+		c, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2024, 1, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	mon, tue, sat, sun := 1, 2, 6, 7
+
+	tests := []struct {
+		name   string
+		window TimeWindow
+		now    time.Time
+		want   bool
+	}{
+		{"daytime inside", TimeWindow{From: "09:00", To: "17:00"}, at(mon, "12:00"), true},
+		{"daytime start is inclusive", TimeWindow{From: "09:00", To: "17:00"}, at(mon, "09:00"), true},
+		{"daytime end is exclusive", TimeWindow{From: "09:00", To: "17:00"}, at(mon, "17:00"), false},
+		{"daytime before", TimeWindow{From: "09:00", To: "17:00"}, at(mon, "08:59"), false},
+		{"whole day", TimeWindow{From: "00:00", To: "00:00"}, at(mon, "03:00"), true},
+
+		{"night before midnight", TimeWindow{From: "22:00", To: "07:00"}, at(mon, "23:30"), true},
+		{"night after midnight", TimeWindow{From: "22:00", To: "07:00"}, at(tue, "06:59"), true},
+		{"night end is exclusive", TimeWindow{From: "22:00", To: "07:00"}, at(tue, "07:00"), false},
+		{"night gap", TimeWindow{From: "22:00", To: "07:00"}, at(tue, "12:00"), false},
+
+		{"day allowed", TimeWindow{From: "09:00", To: "17:00", Days: []string{"mon"}}, at(mon, "10:00"), true},
+		{"day not allowed", TimeWindow{From: "09:00", To: "17:00", Days: []string{"mon"}}, at(tue, "10:00"), false},
+		{"whole day limited", TimeWindow{From: "00:00", To: "00:00", Days: []string{"sat", "sun"}}, at(sun, "10:00"), true},
+		{"whole day excluded", TimeWindow{From: "00:00", To: "00:00", Days: []string{"sat", "sun"}}, at(mon, "10:00"), false},
+		// A window past midnight belongs to the day it starts on.
+		{"night started on allowed day", TimeWindow{From: "22:00", To: "07:00", Days: []string{"sat"}}, at(sun, "02:00"), true},
+		{"night started the day before", TimeWindow{From: "22:00", To: "07:00", Days: []string{"sat"}}, at(sat, "02:00"), false},
+		{"night late on allowed day", TimeWindow{From: "22:00", To: "07:00", Days: []string{"sat"}}, at(sat, "23:00"), true},
+		{"night late on other day", TimeWindow{From: "22:00", To: "07:00", Days: []string{"sat"}}, at(sun, "23:00"), false},
+		{"night wraps the week", TimeWindow{From: "22:00", To: "07:00", Days: []string{"sun"}}, at(mon, "01:00"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseTimeWindow(tt.window)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.contains(tt.now); got != tt.want {
+				t.Errorf("%+v contains %s = %v, want %v", tt.window, tt.now.Format("Mon 15:04"), got, tt.want)
+			}
+		})
+	}
+}
+
+// loadRules writes rules as a rules file and loads it.
+func loadRules(t *testing.T, rules string) *NotificationRules {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notification-rules.json"), []byte(rules), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r := NewNotificationRules(dir)
+	if _, err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestNotificationRulesFirstMatchWins(t *testing.T) {
+	r := loadRules(t, `{"rules": [
+		{"name": "boss", "match": {"senders": ["42"]}, "action": "deliver", "priority": "high"},
+		{"name": "quiet group", "match": {"chats": ["ch_1"]}, "action": "drop"},
+		{"match": {"service": "telegram"}, "action": "deliver", "priority": "low"}
+	]}`)
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		n    Notification
+		want NotificationDecision
+	}{
+		{"earlier rule wins", Notification{Service: "telegram", ChatID: "ch_1", Sender: "42"},
+			NotificationDecision{Deliver: true, Priority: PriorityHigh, Rule: "boss"}},
+		{"second rule", Notification{Service: "telegram", ChatID: "ch_1", Sender: "7"},
+			NotificationDecision{Deliver: false, Rule: "quiet group"}},
+		{"unnamed rule by position", Notification{Service: "telegram", ChatID: "ch_2", Sender: "7"},
+			NotificationDecision{Deliver: true, Priority: PriorityLow, Rule: "#3"}},
+		{"no match", Notification{Service: "whatsapp", ChatID: "ch_2", Sender: "7"},
+			NotificationDecision{Deliver: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := r.Decide(tt.n, now); got != tt.want {
+				t.Errorf("Decide = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationRulesApplyMuted(t *testing.T) {
+	r := loadRules(t, `{"rules": [
+		{"match": {"chats": ["vip"]}, "action": "deliver", "priority": "high"},
+		{"match": {"chats": ["spam"]}, "action": "drop"}
+	]}`)
+
+	tests := []struct {
+		name         string
+		n            Notification
+		muted        bool
+		want         bool
+		wantSilent   bool
+		wantPriority string
+	}{
+		{name: "unmuted", n: Notification{ChatID: "a"}, want: true},
+		{name: "muted", n: Notification{ChatID: "a", Silent: true}, muted: true, want: false},
+		{name: "muted mention", n: Notification{ChatID: "a", Silent: true, Mentioned: true}, muted: true, want: true, wantSilent: true},
+		{name: "rule lets muted through", n: Notification{ChatID: "vip", Silent: true}, muted: true, want: true, wantPriority: PriorityHigh},
+		{name: "rule drops mention", n: Notification{ChatID: "spam", Mentioned: true}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := tt.n
+			got := r.Apply(&n, tt.muted)
+			if got != tt.want {
+				t.Fatalf("Apply = %v, want %v", got, tt.want)
+			}
+			if got && (n.Silent != tt.wantSilent || n.Priority != tt.wantPriority) {
+				t.Errorf("Apply set silent %v, priority %q; want %v, %q", n.Silent, n.Priority, tt.wantSilent, tt.wantPriority)
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// ErrSessionNotFound is returned by SessionStore.Load for a missing entry.
+var ErrSessionNotFound = errors.New("session entry not found")
+
+// SessionStore persists named blobs of account state — auth keys, device key
+// stores, peer caches — in the config dir. Bridges go through it instead of
+// writing these files directly so they can be encrypted at rest.
+type SessionStore interface {
+	// Load returns the entry stored under name, or ErrSessionNotFound.
+	Load(name string) ([]byte, error)
+	// Save replaces the entry stored under name.
+	Save(name string, data []byte) error
+	// Remove deletes the entry stored under name; a missing entry is not an error.
+	Remove(name string) error
+}
+
+// FileSessionStore stores entries as plain files in Dir.
+type FileSessionStore struct {
+	Dir string
+}
+
+var _ SessionStore = FileSessionStore{}
+
+// Load reads Dir/name.
+func (s FileSessionStore) Load(name string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(s.Dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// Save writes Dir/name atomically with owner-only permissions.
+func (s FileSessionStore) Save(name string, data []byte) error {
+	return writeFileAtomic(filepath.Join(s.Dir, name), data)
+}
+
+// Remove deletes Dir/name.
+func (s FileSessionStore) Remove(name string) error {
+	if err := os.Remove(filepath.Join(s.Dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove %s: %w", name, err)
+	}
+	return nil
+}
+
+// EncryptedSessionStore stores entries in Dir as name+".enc", sealed with
+// AES-256-GCM. A plaintext file left under name from before encryption was
+// enabled is encrypted and removed the first time it is loaded.
+type EncryptedSessionStore struct {
+	dir  string
+	aead cipher.AEAD
+}
+
+var _ SessionStore = (*EncryptedSessionStore)(nil)
+
+// NewEncryptedSessionStore creates a store in dir sealed with a 32-byte key.
+func NewEncryptedSessionStore(dir string, key []byte) (*EncryptedSessionStore, error) {
+	aead, err := newSessionAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedSessionStore{dir: dir, aead: aead}, nil
+}
+
+// Load decrypts Dir/name.enc, migrating a plaintext Dir/name if present.
+func (s *EncryptedSessionStore) Load(name string) ([]byte, error) {
+	sealed, err := os.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return s.migrate(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	b, err := s.open(name, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// Save encrypts data into Dir/name.enc.
+func (s *EncryptedSessionStore) Save(name string, data []byte) error {
+	sealed, err := s.seal(name, data)
+	if err != nil {
+		return fmt.Errorf("encrypt %s: %w", name, err)
+	}
+	return writeFileAtomic(s.path(name), sealed)
+}
+
+// Remove deletes Dir/name.enc and any plaintext Dir/name.
+func (s *EncryptedSessionStore) Remove(name string) error {
+	for _, p := range []string{s.path(name), filepath.Join(s.dir, name)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// path returns the file holding the encrypted entry name.
+func (s *EncryptedSessionStore) path(name string) string {
+	return filepath.Join(s.dir, name+".enc")
+}
+
+// migrate encrypts a plaintext entry written before encryption was enabled.
+func (s *EncryptedSessionStore) migrate(name string) ([]byte, error) {
+	plain := filepath.Join(s.dir, name)
+	b, err := os.ReadFile(plain)
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	if err := s.Save(name, b); err != nil {
+		return nil, err
+	}
+	if err := os.Remove(plain); err != nil {
+		return nil, fmt.Errorf("remove plaintext %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// seal encrypts the entry b stored under name, prefixing the random nonce.
+// The name is bound as associated data, so an entry's file does not decrypt
+// under another name.
+func (s *EncryptedSessionStore) seal(name string, b []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(b)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, b, []byte(name)), nil
+}
+
+// open decrypts the output of seal for name.
+func (s *EncryptedSessionStore) open(name string, sealed []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return s.aead.Open(nil, sealed[:n], sealed[n:], []byte(name))
+}
+
+// sessionKeyFile records the passphrase salt and a sealed check value, so a
+// wrong passphrase or key is rejected before any entry is touched.
+const sessionKeyFile = "session-key.json"
+
+// sessionKeyCheck is the plaintext sealed into the key file.
+const sessionKeyCheck = "switchboard-session"
+
+// sessionKeyInfo is the content of sessionKeyFile.
+type sessionKeyInfo struct {
+	Salt  []byte `json:"salt"`
+	Check []byte `json:"check"`
+}
+
+// SessionUnlock is received as session.unlock to deliver the session
+// encryption secret: either a passphrase, or a base64 32-byte key.
+type SessionUnlock struct {
+	Passphrase string `json:"passphrase,omitempty"`
+	Key        string `json:"key,omitempty"`
+}
+
+// SessionPassphraseEnv names the environment variable the host may use to
+// pass the session passphrase instead of sending session.unlock.
+const SessionPassphraseEnv = "SWITCHBOARD_SESSION_PASSPHRASE"
+
+// OpenSessionStore returns the session store for dir. Encryption is enabled
+// by setting SessionPassphraseEnv, and stays on once dir holds a key file.
+// When it is on but no passphrase is in the environment, the bridge reports
+// status "locked" and reads r until the host sends a valid session.unlock;
+// other commands are answered with an error meanwhile.
+func OpenSessionStore(dir string, r *Reader, w *Writer) (SessionStore, error) {
+	passphrase := os.Getenv(SessionPassphraseEnv)
+	_, err := os.Stat(filepath.Join(dir, sessionKeyFile))
+	if passphrase == "" && os.IsNotExist(err) {
+		return FileSessionStore{Dir: dir}, nil
+	}
+	if passphrase != "" {
+		return unlockSessionStore(dir, SessionUnlock{Passphrase: passphrase})
+	}
+
+	if err := w.SendTyped("status", "", StatusData{Status: "locked"}); err != nil {
+		return nil, err
+	}
+	for {
+		env, err := r.Read()
+		if err != nil {
+			return nil, fmt.Errorf("wait for session.unlock: %w", err)
+		}
+		if env.Type != "session.unlock" {
+			_ = w.SendTyped("error", env.ID, map[string]string{"message": "session store is locked"})
+			continue
+		}
+		var req SessionUnlock
+		if err := ParseData(env, &req); err != nil {
+			_ = w.SendTyped("error", env.ID, map[string]string{"message": err.Error()})
+			continue
+		}
+		store, err := unlockSessionStore(dir, req)
+		if err != nil {
+			_ = w.SendTyped("error", env.ID, map[string]string{"message": err.Error()})
+			continue
+		}
+		_ = w.SendTyped("session.unlocked", env.ID, nil)
+		return store, nil
+	}
+}
+
+// unlockSessionStore derives or decodes the key for req and checks it
+// against the key file in dir, creating the file on first use.
+func unlockSessionStore(dir string, req SessionUnlock) (*EncryptedSessionStore, error) {
+	keyPath := filepath.Join(dir, sessionKeyFile)
+	var info sessionKeyInfo
+	b, err := os.ReadFile(keyPath)
+	switch {
+	case os.IsNotExist(err):
+		info.Salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, info.Salt); err != nil {
+			return nil, fmt.Errorf("generate salt: %w", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("read %s: %w", sessionKeyFile, err)
+	default:
+		if err := json.Unmarshal(b, &info); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", sessionKeyFile, err)
+		}
+	}
+
+	var key []byte
+	switch {
+	case req.Key != "":
+		key, err = base64.StdEncoding.DecodeString(req.Key)
+		if err != nil {
+			return nil, fmt.Errorf("decode session key: %w", err)
+		}
+	case req.Passphrase != "":
+		key = argon2.IDKey([]byte(req.Passphrase), info.Salt, 3, 64*1024, 4, 32)
+	default:
+		return nil, errors.New("session.unlock needs a passphrase or key")
+	}
+
+	store, err := NewEncryptedSessionStore(dir, key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Check == nil {
+		if info.Check, err = store.seal(sessionKeyFile, []byte(sessionKeyCheck)); err != nil {
+			return nil, fmt.Errorf("seal key check: %w", err)
+		}
+		b, err := json.Marshal(info)
+		if err != nil {
+			return nil, fmt.Errorf("marshal %s: %w", sessionKeyFile, err)
+		}
+		if err := writeFileAtomic(keyPath, b); err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	if check, err := store.open(sessionKeyFile, info.Check); err != nil || string(check) != sessionKeyCheck {
+		return nil, errors.New("wrong session passphrase or key")
+	}
+	return store, nil
+}
+
+// newSessionAEAD builds the AES-256-GCM cipher for key.
+func newSessionAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("session key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeFileAtomic writes data to path via a temporary file and rename.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write %s: %w", filepath.Base(path), err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("rename %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryptedSessionStoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewEncryptedSessionStore(dir, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Load("auth"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("Load of a missing entry = %v, want ErrSessionNotFound", err)
+	}
+	data := []byte("auth key material")
+	if err := s.Save("auth", data); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.Load("auth")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Load = %q, %v; want %q", got, err, data)
+	}
+
+	sealed, err := os.ReadFile(filepath.Join(dir, "auth.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, data) {
+		t.Error("entry is stored in plaintext")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "auth")); !os.IsNotExist(err) {
+		t.Errorf("plaintext file exists: %v", err)
+	}
+
+	if err := s.Remove("auth"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load("auth"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Load after Remove = %v, want ErrSessionNotFound", err)
+	}
+	if err := s.Remove("auth"); err != nil {
+		t.Errorf("Remove of a missing entry = %v", err)
+	}
+}
+
+func TestEncryptedSessionStoreRejects(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewEncryptedSessionStore(dir, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("peers", []byte("peer cache")); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		other, err := NewEncryptedSessionStore(dir, testKey(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := other.Load("peers"); err == nil {
+			t.Errorf("Load with the wrong key = %q, want an error", b)
+		}
+	})
+
+	t.Run("other entry name", func(t *testing.T) {
+		sealed, err := os.ReadFile(filepath.Join(dir, "peers.enc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "auth.enc"), sealed, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if b, err := s.Load("auth"); err == nil {
+			t.Errorf("Load of an entry copied from another name = %q, want an error", b)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		if err := os.WriteFile(filepath.Join(dir, "short.enc"), []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Load("short"); err == nil {
+			t.Error("Load of a truncated entry succeeded")
+		}
+	})
+
+	t.Run("key length", func(t *testing.T) {
+		if _, err := NewEncryptedSessionStore(dir, testKey(1)[:16]); err == nil {
+			t.Error("NewEncryptedSessionStore accepted a 16-byte key")
+		}
+	})
+}
+
+func TestEncryptedSessionStoreMigrate(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("plaintext session")
+	plain := filepath.Join(dir, "session.json")
+	if err := os.WriteFile(plain, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewEncryptedSessionStore(dir, testKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.Load("session.json")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Load = %q, %v; want %q", got, err, data)
+	}
+	if _, err := os.Stat(plain); !os.IsNotExist(err) {
+		t.Errorf("plaintext file left after migration: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "session.json.enc")); err != nil {
+		t.Errorf("encrypted entry missing after migration: %v", err)
+	}
+	if got, err := s.Load("session.json"); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("Load after migration = %q, %v; want %q", got, err, data)
+	}
+}
+
+func TestUnlockSessionStore(t *testing.T) {
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, sessionKeyFile)
+
+	s, err := unlockSessionStore(dir, SessionUnlock{Passphrase: "correct horse"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save("auth", []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("key file not created: %v", err)
+	}
+
+	t.Run("same passphrase", func(t *testing.T) {
+		s, err := unlockSessionStore(dir, SessionUnlock{Passphrase: "correct horse"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Load("auth"); err != nil || string(got) != "secret" {
+			t.Errorf("Load = %q, %v; want %q", got, err, "secret")
+		}
+		if b, _ := os.ReadFile(keyPath); !bytes.Equal(b, keyFile) {
+			t.Error("key file rewritten on a later unlock")
+		}
+	})
+
+	t.Run("wrong passphrase", func(t *testing.T) {
+		if _, err := unlockSessionStore(dir, SessionUnlock{Passphrase: "battery staple"}); err == nil {
+			t.Error("unlock with the wrong passphrase succeeded")
+		}
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		key := base64.StdEncoding.EncodeToString(testKey(3))
+		if _, err := unlockSessionStore(dir, SessionUnlock{Key: key}); err == nil {
+			t.Error("unlock with the wrong key succeeded")
+		}
+	})
+
+	t.Run("nothing", func(t *testing.T) {
+		if _, err := unlockSessionStore(dir, SessionUnlock{}); err == nil {
+			t.Error("unlock without a passphrase or key succeeded")
+		}
+	})
+}
+
+func TestUnlockSessionStoreKey(t *testing.T) {
+	dir := t.TempDir()
+	key := base64.StdEncoding.EncodeToString(testKey(4))
+	if _, err := unlockSessionStore(dir, SessionUnlock{Key: key}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unlockSessionStore(dir, SessionUnlock{Key: key}); err != nil {
+		t.Errorf("second unlock with the same key: %v", err)
+	}
+	short := base64.StdEncoding.EncodeToString(testKey(4)[:31])
+	if _, err := unlockSessionStore(t.TempDir(), SessionUnlock{Key: short}); err == nil {
+		t.Error("unlock with a 31-byte key succeeded")
+	}
+}
+
+func TestOpenSessionStore(t *testing.T) {
+	t.Run("plain", func(t *testing.T) {
+		t.Setenv(SessionPassphraseEnv, "")
+		dir := t.TempDir()
+		s, err := OpenSessionStore(dir, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.(FileSessionStore); !ok {
+			t.Fatalf("OpenSessionStore = %T, want FileSessionStore", s)
+		}
+		if err := s.Save("auth", []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.Load("auth"); err != nil || string(got) != "x" {
+			t.Errorf("Load = %q, %v; want %q", got, err, "x")
+		}
+	})
+
+	t.Run("passphrase from environment", func(t *testing.T) {
+		t.Setenv(SessionPassphraseEnv, "from env")
+		dir := t.TempDir()
+		s, err := OpenSessionStore(dir, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.(*EncryptedSessionStore); !ok {
+			t.Fatalf("OpenSessionStore = %T, want *EncryptedSessionStore", s)
+		}
+		if _, err := os.Stat(filepath.Join(dir, sessionKeyFile)); err != nil {
+			t.Errorf("key file not created: %v", err)
+		}
+	})
+}
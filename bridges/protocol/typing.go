@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"sync"
+	"time"
+)
+
+// TypingTracker emits "typing" events and expires them automatically.
+// Services only announce that someone is typing and rely on the client to
+// drop the indicator after a few seconds without a refresh, so the tracker
+// emits the matching Typing=false event itself when the timer lapses.
+type TypingTracker struct {
+	mu     sync.Mutex
+	writer *Writer
+	timers map[string]*typingEntry
+}
+
+// typingEntry is the expiry of one indicator. Entries are compared by
+// identity, so a timer can tell whether it is still the current one.
+type typingEntry struct {
+	timer *time.Timer
+}
+
+// NewTypingTracker creates a TypingTracker that emits through w.
+func NewTypingTracker(w *Writer) *TypingTracker {
+	return &TypingTracker{
+		writer: w,
+		timers: make(map[string]*typingEntry),
+	}
+}
+
+// Start emits a typing event for from in chatID and (re)schedules its expiry.
+func (t *TypingTracker) Start(chatID, from, action string, ttl time.Duration) error {
+	key := chatID + "\x00" + from
+
+	t.mu.Lock()
+	if old, ok := t.timers[key]; ok {
+		old.timer.Stop()
+	}
+	entry := &typingEntry{}
+	entry.timer = time.AfterFunc(ttl, func() {
+		_ = t.expire(chatID, from, entry)
+	})
+	t.timers[key] = entry
+	t.mu.Unlock()
+
+	return t.writer.SendTyped("typing", "", Typing{
+		ChatID:    chatID,
+		From:      from,
+		Typing:    true,
+		Action:    action,
+		ExpiresAt: time.Now().Add(ttl).Unix(),
+	})
+}
+
+// Stop emits a typing-stopped event for from in chatID if one is active.
+func (t *TypingTracker) Stop(chatID, from string) error {
+	return t.expire(chatID, from, nil)
+}
+
+// expire ends the indicator of from in chatID. With a non-nil entry it only
+// does so while that entry is the current one: a timer that fired just as
+// Start replaced it must not end the refreshed indicator.
+func (t *TypingTracker) expire(chatID, from string, entry *typingEntry) error {
+	key := chatID + "\x00" + from
+
+	t.mu.Lock()
+	current, ok := t.timers[key]
+	if ok && entry != nil && current != entry {
+		ok = false
+	}
+	if ok {
+		current.timer.Stop()
+		delete(t.timers, key)
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return t.writer.SendTyped("typing", "", Typing{
+		ChatID: chatID,
+		From:   from,
+		Typing: false,
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/aigustalabs/switchboard/bridges/protocol"
@@ -114,7 +115,7 @@ func runAuthFlow(ctx context.Context, client *tgClient, flow *authFlow, id strin
 	authFlow := auth.NewFlow(flow, auth.SendCodeOptions{})
 	if err := authFlow.Run(ctx, authClient); err != nil {
 		log.Printf("[auth] flow error: %v\n", err)
-		_ = client.writer.SendTyped("error", id, map[string]string{"message": err.Error()})
+		sendRPCError(client.writer, id, err)
 		return
 	}
 
@@ -133,4 +134,44 @@ func runAuthFlow(ctx context.Context, client *tgClient, flow *authFlow, id strin
 		Phone: self.Phone,
 	})
 	log.Printf("[auth] authenticated as %s\n", name)
+	go client.runUpdates(ctx, self.ID)
+}
+
+// handleLogout signs out with auth.logOut and returns the bridge to
+// auth_needed. With req.Wipe it also deletes the session file, the persisted
+// update state (including channel access hashes) and downloaded media.
+func handleLogout(ctx context.Context, client *tgClient, id string, req protocol.LogoutRequest) {
+	var userID int64
+	if self, err := client.tg.Self(ctx); err == nil {
+		userID = self.ID
+	}
+
+	client.haltUpdates()
+	client.af = nil
+
+	if _, err := client.tg.API().AuthLogOut(ctx); err != nil {
+		// The session may already be revoked from another device; the
+		// local state is still reset below.
+		log.Printf("[auth] logOut error: %v\n", err)
+	}
+
+	if req.Wipe {
+		if userID != 0 {
+			if err := client.updateState.forget(userID); err != nil {
+				log.Printf("[auth] wipe update state: %v\n", err)
+			}
+		}
+		if err := client.sessions.Remove(sessionName); err != nil {
+			log.Printf("[auth] remove session: %v\n", err)
+		}
+		if err := os.RemoveAll(client.mediaDir); err != nil {
+			log.Printf("[auth] remove media: %v\n", err)
+		}
+		if err := os.MkdirAll(client.mediaDir, 0o700); err != nil {
+			log.Printf("[auth] mkdir %s: %v\n", client.mediaDir, err)
+		}
+	}
+
+	_ = client.writer.SendTyped("auth.logged_out", id, nil)
+	_ = client.writer.SendTyped("status", "", protocol.StatusData{Status: "auth_needed"})
 }
@@ -3,39 +3,58 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"time"
 
 	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/telegram/downloader"
 	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
 )
 
-// handleChatsList fetches the user's dialogs and emits a chats.list response.
+// handleChatsList fetches the user's dialogs, archived ones included, and
+// emits a chats.list response.
 func handleChatsList(ctx context.Context, client *tgClient, writer *protocol.Writer, id string) {
 	api := client.tg.API()
 
-	result, err := api.MessagesGetDialogs(ctx, &tg.MessagesGetDialogsRequest{
-		OffsetPeer: &tg.InputPeerEmpty{},
-		Limit:      100,
-	})
+	folders, err := client.folders.get(ctx, api)
 	if err != nil {
-		log.Printf("[chats] GetDialogs error: %v\n", err)
-		_ = writer.SendTyped("error", id, map[string]string{"message": err.Error()})
-		return
+		log.Printf("[chats] GetDialogFilters error: %v\n", err)
 	}
 
-	chats := extractChats(result)
+	if err := client.mutes.loadDefaults(ctx, api); err != nil {
+		log.Printf("[chats] %v\n", err)
+	}
+
+	var chats []protocol.Chat
+	// Folder 0 holds the main chat list and folder 1 the archive.
+	for _, folderID := range []int{0, 1} {
+		result, err := api.MessagesGetDialogs(ctx, &tg.MessagesGetDialogsRequest{
+			FolderID:   folderID,
+			OffsetPeer: &tg.InputPeerEmpty{},
+			Limit:      100,
+		})
+		if err != nil {
+			log.Printf("[chats] GetDialogs error: %v\n", err)
+			sendRPCError(writer, id, err)
+			return
+		}
+		if m, ok := result.AsModified(); ok {
+			client.peers.remember(m.GetUsers(), m.GetChats())
+		}
+		chats = append(chats, extractChats(result, folders, client.mutes)...)
+	}
 	_ = writer.SendTyped("chats.list", id, protocol.ChatListResponse{Chats: chats})
 }
 
-// extractChats converts a dialogs result into the protocol Chat slice.
-func extractChats(result tg.MessagesDialogsClass) []protocol.Chat {
+// extractChats converts a dialogs result into the protocol Chat slice,
+// listing for each chat the folders it belongs to and recording its notify
+// settings in mutes.
+func extractChats(result tg.MessagesDialogsClass, folders []folder, mutes *muteTracker) []protocol.Chat {
 	var (
 		rawDialogs []tg.DialogClass
 		usersList  []tg.UserClass
@@ -95,12 +114,21 @@ func extractChats(result tg.MessagesDialogsClass) []protocol.Chat {
 			chatID   string
 			chatName string
 			isGroup  bool
+			isForum  bool
+			kind     dialogKind
 		)
 
 		switch p := d.Peer.(type) {
 		case *tg.PeerUser:
 			chatID = strconv.FormatInt(p.UserID, 10)
+			kind = kindNonContact
 			if u, ok := userMap[p.UserID]; ok {
+				switch {
+				case u.Bot:
+					kind = kindBot
+				case u.Contact:
+					kind = kindContact
+				}
 				chatName = u.FirstName
 				if u.LastName != "" {
 					chatName += " " + u.LastName
@@ -112,6 +140,7 @@ func extractChats(result tg.MessagesDialogsClass) []protocol.Chat {
 		case *tg.PeerChat:
 			chatID = "c_" + strconv.FormatInt(p.ChatID, 10)
 			isGroup = true
+			kind = kindGroup
 			if c, ok := chatMap[p.ChatID]; ok {
 				if ch, ok := c.(*tg.Chat); ok {
 					chatName = ch.Title
@@ -123,6 +152,12 @@ func extractChats(result tg.MessagesDialogsClass) []protocol.Chat {
 				if ch, ok := c.(*tg.Channel); ok {
 					chatName = ch.Title
 					isGroup = ch.Megagroup || ch.Broadcast
+					isForum = ch.Forum
+					if ch.Broadcast {
+						kind = kindBroadcast
+					} else {
+						kind = kindGroup
+					}
 				}
 			}
 		default:
@@ -142,6 +177,15 @@ func extractChats(result tg.MessagesDialogsClass) []protocol.Chat {
 			}
 		}
 
+		mute := mutes.set(chatID, kind.notifyScope(), d.NotifySettings)
+		info := dialogInfo{
+			chatID:   chatID,
+			kind:     kind,
+			muted:    mute.Muted,
+			unread:   d.UnreadCount > 0 || d.UnreadMark,
+			archived: d.FolderID == 1,
+		}
+
 		out = append(out, protocol.Chat{
 			ID:          chatID,
 			Name:        chatName,
@@ -149,6 +193,12 @@ func extractChats(result tg.MessagesDialogsClass) []protocol.Chat {
 			LastMessage: lastMsg,
 			LastTime:    lastTime,
 			IsGroup:     isGroup,
+			Pinned:      d.Pinned,
+			Archived:    info.archived,
+			Muted:       mute.Muted,
+			MutedUntil:  mute.Until,
+			IsForum:     isForum,
+			Folders:     folderIDs(folders, info),
 		})
 	}
 	return out
@@ -156,9 +206,9 @@ func extractChats(result tg.MessagesDialogsClass) []protocol.Chat {
 
 // handleChatMessages fetches history for a chat and emits a chat.messages response.
 func handleChatMessages(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.ChatMessagesRequest) {
-	peer, err := parsePeer(req.ChatID)
+	peer, err := client.inputPeer(req.ChatID)
 	if err != nil {
-		_ = writer.SendTyped("error", id, map[string]string{"message": err.Error()})
+		sendRPCError(writer, id, err)
 		return
 	}
 
@@ -167,23 +217,95 @@ func handleChatMessages(ctx context.Context, client *tgClient, writer *protocol.
 		limit = 50
 	}
 
+	offsetID, err := parseCursor(req.Cursor)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	var topicID int
+	if req.TopicID != "" {
+		if topicID, err = strconv.Atoi(req.TopicID); err != nil {
+			sendRPCError(writer, id, fmt.Errorf("invalid topic id %q", req.TopicID))
+			return
+		}
+	}
+
 	api := client.tg.API()
-	result, err := api.MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{
-		Peer:  peer,
-		Limit: limit,
-	})
+	var (
+		result tg.MessagesMessagesClass
+		next   string
+	)
+	switch {
+	case req.TopicID == generalTopic:
+		result, next, err = generalHistory(ctx, api, peer, offsetID, limit)
+	case topicID != 0:
+		result, err = api.MessagesGetReplies(ctx, &tg.MessagesGetRepliesRequest{
+			Peer:     peer,
+			MsgID:    topicID,
+			OffsetID: offsetID,
+			Limit:    limit,
+		})
+	default:
+		result, err = api.MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{
+			Peer:     peer,
+			OffsetID: offsetID,
+			Limit:    limit,
+		})
+	}
 	if err != nil {
 		log.Printf("[chats] GetHistory error: %v\n", err)
-		_ = writer.SendTyped("error", id, map[string]string{"message": err.Error()})
+		sendRPCError(writer, id, err)
 		return
 	}
+	if req.TopicID != generalTopic {
+		next = historyCursor(result, limit)
+	}
 
-	messages := extractMessages(result, req.ChatID, client.mediaDir)
-	_ = writer.SendTyped("chat.messages", id, protocol.ChatMessagesResponse{Messages: messages})
+	client.peers.rememberMessages(result)
+	messages := extractMessages(ctx, client, result, req.ChatID)
+	_ = writer.SendTyped("chat.messages", id, protocol.ChatMessagesResponse{
+		Messages:   messages,
+		NextCursor: next,
+	})
+}
+
+// parseCursor decodes a history cursor, which is the ID of the oldest message
+// already returned. An empty cursor starts from the newest message.
+func parseCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(cursor)
+	if err != nil {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return n, nil
+}
+
+// historyCursor returns the cursor for the page after result, or "" when the
+// page was short and there is nothing older to fetch.
+func historyCursor(result tg.MessagesMessagesClass, limit int) string {
+	modified, ok := result.AsModified()
+	if !ok {
+		return ""
+	}
+	raw := modified.GetMessages()
+	if len(raw) < limit {
+		return ""
+	}
+	oldest := 0
+	for _, m := range raw {
+		if oldest == 0 || m.GetID() < oldest {
+			oldest = m.GetID()
+		}
+	}
+	return strconv.Itoa(oldest)
 }
 
 // extractMessages converts a history result into the protocol Message slice.
-func extractMessages(result tg.MessagesMessagesClass, chatID string, mediaDir string) []protocol.Message {
+// When chatID is empty (global search) each message's own peer is used.
+func extractMessages(ctx context.Context, client *tgClient, result tg.MessagesMessagesClass, chatID string) []protocol.Message {
 	var rawMsgs []tg.MessageClass
 	var usersList []tg.UserClass
 
@@ -234,18 +356,33 @@ func extractMessages(result tg.MessagesMessagesClass, chatID string, mediaDir st
 		var imagePath string
 		if msg.Media != nil {
 			if photo, ok := msg.Media.(*tg.MessageMediaPhoto); ok {
-				imagePath = downloadPhoto(photo, mediaDir)
+				// Best effort: the message is still listed without it.
+				path, err := downloadPhoto(ctx, client.tg.API(), photo, client.mediaDir)
+				if err != nil {
+					log.Printf("[media] download photo of message %d: %v\n", msg.ID, err)
+				}
+				imagePath = path
 			}
 		}
 
+		msgChatID := chatID
+		if msgChatID == "" {
+			msgChatID = peerToChatID(msg.PeerID)
+		}
+
+		editDate, _ := msg.GetEditDate()
 		out = append(out, protocol.Message{
 			ID:        strconv.Itoa(msg.ID),
-			ChatID:    chatID,
+			ChatID:    msgChatID,
 			From:      fromName,
 			FromMe:    fromMe,
 			Text:      msg.Message,
+			Markdown:  messageMarkdown(msg),
 			Timestamp: int64(msg.Date),
 			ImagePath: imagePath,
+			EditedAt:  int64(editDate),
+			Reactions: messageReactions(msg),
+			TopicID:   messageTopic(msg, client.peers.forum(msg.PeerID)),
 		})
 	}
 	return out
@@ -253,27 +390,210 @@ func extractMessages(result tg.MessagesMessagesClass, chatID string, mediaDir st
 
 // handleSendMessage sends a text message to a chat and emits an ack.
 func handleSendMessage(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.SendMessageRequest) {
-	peer, err := parsePeer(req.ChatID)
+	peer, err := client.inputPeer(req.ChatID)
 	if err != nil {
-		_ = writer.SendTyped("error", id, map[string]string{"message": err.Error()})
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	text, entities, err := formatText(req.Text, req.Format)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	replyTo, err := replyHeader(req.ReplyTo, req.TopicID)
+	if err != nil {
+		sendRPCError(writer, id, err)
 		return
 	}
 
 	api := client.tg.API()
 	randomID := rand.Int63() //nolint:gosec — not security-sensitive
-	_, err = api.MessagesSendMessage(ctx, &tg.MessagesSendMessageRequest{
+	client.sent.expect(randomID, req.ChatID)
+	result, err := api.MessagesSendMessage(ctx, &tg.MessagesSendMessageRequest{
 		Peer:      peer,
-		Message:   req.Text,
+		Message:   text,
+		Entities:  entities,
+		ReplyTo:   replyTo,
 		RandomID:  randomID,
 		NoWebpage: true,
 	})
 	if err != nil {
+		client.sent.cancel(randomID)
 		log.Printf("[chats] SendMessage error: %v\n", err)
-		_ = writer.SendTyped("error", id, map[string]string{"message": err.Error()})
+		if req.ReplyTo != "" && tgerr.Is(err, "REPLY_MESSAGE_ID_INVALID", "REPLY_TO_INVALID") {
+			err = fmt.Errorf("unknown message %s in %s: %w", req.ReplyTo, req.ChatID, err)
+		}
+		sendRPCError(writer, id, err)
 		return
 	}
 
-	_ = writer.SendTyped("message.sent", id, map[string]string{"chat_id": req.ChatID})
+	msgID := sentMessageID(result, randomID)
+	if msgID != 0 {
+		client.sent.mark(req.ChatID, msgID)
+	}
+	_ = writer.SendTyped("message.sent", id, map[string]string{
+		"chat_id":    req.ChatID,
+		"message_id": strconv.Itoa(msgID),
+	})
+}
+
+// handleEditMessage replaces the text of a sent message and emits an ack.
+func handleEditMessage(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.EditMessageRequest) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	msgID, err := strconv.Atoi(req.MessageID)
+	if err != nil {
+		_ = writer.SendTyped("error", id, map[string]string{"message": fmt.Sprintf("invalid message id %q", req.MessageID)})
+		return
+	}
+
+	text, entities, err := formatText(req.Text, req.Format)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	api := client.tg.API()
+	result, err := api.MessagesEditMessage(ctx, &tg.MessagesEditMessageRequest{
+		Peer:      peer,
+		ID:        msgID,
+		Message:   text,
+		Entities:  entities,
+		NoWebpage: true,
+	})
+	if err != nil {
+		log.Printf("[chats] EditMessage error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	out := protocol.Message{
+		ID:       req.MessageID,
+		ChatID:   req.ChatID,
+		From:     "me",
+		FromMe:   true,
+		Text:     req.Text,
+		EditedAt: time.Now().Unix(),
+	}
+	if msg := editedMessage(result); msg != nil {
+		out = buildIncomingMessage(msg, req.ChatID, client.peers.forum(msg.PeerID))
+		out.From = "me"
+	}
+	_ = writer.SendTyped("message.edited", id, out)
+}
+
+// editedMessage returns the message carried by an edit result, if any.
+func editedMessage(u tg.UpdatesClass) *tg.Message {
+	r, ok := u.(*tg.Updates)
+	if !ok {
+		return nil
+	}
+	for _, upd := range r.Updates {
+		var m tg.MessageClass
+		switch e := upd.(type) {
+		case *tg.UpdateEditMessage:
+			m = e.Message
+		case *tg.UpdateEditChannelMessage:
+			m = e.Message
+		}
+		if msg, ok := m.(*tg.Message); ok {
+			return msg
+		}
+	}
+	return nil
+}
+
+// handleDeleteMessages deletes messages for us or for everyone and emits an ack.
+// Messages in channels and supergroups can only be deleted for everyone.
+func handleDeleteMessages(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.DeleteMessageRequest) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	ids := make([]int, 0, len(req.MessageIDs))
+	for _, s := range req.MessageIDs {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			_ = writer.SendTyped("error", id, map[string]string{"message": fmt.Sprintf("invalid message id %q", s)})
+			return
+		}
+		ids = append(ids, n)
+	}
+
+	api := client.tg.API()
+	if ch, ok := peer.(*tg.InputPeerChannel); ok {
+		if !req.ForEveryone {
+			_ = writer.SendTyped("error", id, map[string]string{
+				"message": "messages in channels and supergroups can only be deleted for everyone",
+			})
+			return
+		}
+		_, err = api.ChannelsDeleteMessages(ctx, &tg.ChannelsDeleteMessagesRequest{
+			Channel: &tg.InputChannel{ChannelID: ch.ChannelID, AccessHash: ch.AccessHash},
+			ID:      ids,
+		})
+	} else {
+		_, err = api.MessagesDeleteMessages(ctx, &tg.MessagesDeleteMessagesRequest{
+			Revoke: req.ForEveryone,
+			ID:     ids,
+		})
+	}
+	if err != nil {
+		log.Printf("[chats] DeleteMessages error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	_ = writer.SendTyped("message.deleted", id, protocol.MessageDeleted{
+		ChatID:     req.ChatID,
+		MessageIDs: req.MessageIDs,
+	})
+}
+
+// handleMarkRead marks a chat read up to the highest requested message ID,
+// or entirely when none are given, and emits an ack.
+func handleMarkRead(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.MarkReadRequest) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	maxID := 0
+	for _, s := range req.MessageIDs {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			_ = writer.SendTyped("error", id, map[string]string{"message": fmt.Sprintf("invalid message id %q", s)})
+			return
+		}
+		if n > maxID {
+			maxID = n
+		}
+	}
+
+	api := client.tg.API()
+	if ch, ok := peer.(*tg.InputPeerChannel); ok {
+		_, err = api.ChannelsReadHistory(ctx, &tg.ChannelsReadHistoryRequest{
+			Channel: &tg.InputChannel{ChannelID: ch.ChannelID, AccessHash: ch.AccessHash},
+			MaxID:   maxID,
+		})
+	} else {
+		_, err = api.MessagesReadHistory(ctx, &tg.MessagesReadHistoryRequest{
+			Peer:  peer,
+			MaxID: maxID,
+		})
+	}
+	if err != nil {
+		log.Printf("[chats] ReadHistory error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	_ = writer.SendTyped("chat.marked_read", id, map[string]string{"chat_id": req.ChatID})
 }
 
 // parsePeer converts a Switchboard chat ID string to a tg.InputPeerClass.
@@ -281,6 +601,8 @@ func handleSendMessage(ctx context.Context, client *tgClient, writer *protocol.W
 //   - plain integer → InputPeerUser
 //   - "c_<int>"    → InputPeerChat (basic group)
 //   - "ch_<int>"   → InputPeerChannel (supergroup/channel)
+//
+// The peer has no access hash; tgClient.inputPeer adds it for requests.
 func parsePeer(chatID string) (tg.InputPeerClass, error) {
 	if len(chatID) > 3 && chatID[:3] == "ch_" {
 		n, err := strconv.ParseInt(chatID[3:], 10, 64)
@@ -303,12 +625,12 @@ func parsePeer(chatID string) (tg.InputPeerClass, error) {
 	return &tg.InputPeerUser{UserID: n}, nil
 }
 
-// downloadPhoto saves the largest photo size to the media dir and returns the path.
-// Returns an empty string if downloading fails (non-fatal).
-func downloadPhoto(photo *tg.MessageMediaPhoto, mediaDir string) string {
+// downloadPhoto saves the largest photo size to the media dir and returns the
+// path, or "" for a photo without sizes. Downloads are cached by photo ID.
+func downloadPhoto(ctx context.Context, api *tg.Client, photo *tg.MessageMediaPhoto, mediaDir string) (string, error) {
 	p, ok := photo.Photo.(*tg.Photo)
 	if !ok {
-		return ""
+		return "", nil
 	}
 
 	// Find the largest PhotoSize.
@@ -323,56 +645,58 @@ func downloadPhoto(photo *tg.MessageMediaPhoto, mediaDir string) string {
 		}
 	}
 	if bestType == "" {
-		return ""
+		return "", nil
 	}
 
 	localPath := filepath.Join(mediaDir, fmt.Sprintf("photo_%d_%s.jpg", p.ID, bestType))
 	if _, err := os.Stat(localPath); err == nil {
-		return localPath // already cached
+		return localPath, nil // already cached
 	}
 
-	// Attempt an HTTP download using the DC-independent photo URL format.
-	// This is a best-effort attempt; failures are non-fatal.
-	dlURL := fmt.Sprintf("https://t.me/i/userpic/%d/%d", p.ID, p.AccessHash)
-	//nolint:gosec — user-visible media URL
-	resp, err := (&http.Client{Timeout: 15 * time.Second}).Get(dlURL)
-	if err != nil {
-		log.Printf("[media] download error for %s: %v\n", dlURL, err)
-		return ""
+	// Download next to the cache entry and move it in place once complete,
+	// so an interrupted download is never taken for a cached one.
+	tmpPath := localPath + ".part"
+	_, err := downloader.NewDownloader().Download(api, &tg.InputPhotoFileLocation{
+		ID:            p.ID,
+		AccessHash:    p.AccessHash,
+		FileReference: p.FileReference,
+		ThumbSize:     bestType,
+	}).ToPath(ctx, tmpPath)
+	if err == nil {
+		err = os.Rename(tmpPath, localPath)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[media] download status %d for %s\n", resp.StatusCode, dlURL)
-		return ""
-	}
-
-	f, err := os.Create(localPath)
 	if err != nil {
-		log.Printf("[media] create file %s: %v\n", localPath, err)
-		return ""
-	}
-	defer f.Close()
-
-	if _, err := io.Copy(f, resp.Body); err != nil {
-		log.Printf("[media] write file %s: %v\n", localPath, err)
-		os.Remove(localPath)
-		return ""
+		os.Remove(tmpPath)
+		return "", err
 	}
-
-	return localPath
+	return localPath, nil
 }
 
 // buildIncomingMessage converts a tg.Message from an update into a protocol.Message.
-func buildIncomingMessage(msg *tg.Message, chatID string) protocol.Message {
+// forum tells whether its chat is a forum, see messageTopic.
+func buildIncomingMessage(msg *tg.Message, chatID string, forum bool) protocol.Message {
+	editDate, _ := msg.GetEditDate()
 	return protocol.Message{
 		ID:        strconv.Itoa(msg.ID),
 		ChatID:    chatID,
 		From:      "unknown",
 		FromMe:    msg.Out,
 		Text:      msg.Message,
+		Markdown:  messageMarkdown(msg),
 		Timestamp: int64(msg.Date),
+		EditedAt:  int64(editDate),
+		Reactions: messageReactions(msg),
+		TopicID:   messageTopic(msg, forum),
+	}
+}
+
+// messageSender returns the Switchboard ID of the sender of msg: its from_id,
+// or the chat itself for messages without one, such as in private chats.
+func messageSender(msg *tg.Message) string {
+	if msg.FromID != nil {
+		return peerToChatID(msg.FromID)
 	}
+	return peerToChatID(msg.PeerID)
 }
 
 // peerToChatID converts a tg.PeerClass to a Switchboard chat ID string.
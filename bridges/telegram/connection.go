@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/cenkalti/backoff/v4"
+	"github.com/gotd/td/telegram/auth"
+	"github.com/gotd/td/tgerr"
+)
+
+// Reconnect delays grow from reconnectMin to reconnectMax.
+const (
+	reconnectMin = time.Second
+	reconnectMax = 2 * time.Minute
+)
+
+// reconnectBackoff drives gotd's own reconnect loop with a
+// protocol.Backoff, so every retry is reported to the host as a
+// "reconnecting" status and connection.retry_now can skip the wait. gotd
+// keeps retrying for as long as this returns delays, so tgc.Run only ends on
+// shutdown or on errors a reconnect cannot fix.
+type reconnectBackoff struct {
+	ctx    context.Context
+	b      *protocol.Backoff
+	writer *protocol.Writer
+}
+
+var _ backoff.BackOff = (*reconnectBackoff)(nil)
+
+// NextBackOff announces the next attempt and waits for it itself, returning
+// a zero delay, so that the wait can be interrupted by RetryNow.
+func (r *reconnectBackoff) NextBackOff() time.Duration {
+	attempt, d := r.b.Next()
+	log.Printf("[conn] connection lost, retry %d in %s\n", attempt, d.Round(time.Millisecond))
+	_ = r.writer.SendTyped("status", "", protocol.StatusData{
+		Status:      "reconnecting",
+		Reason:      "connection to Telegram lost",
+		Attempt:     attempt,
+		NextRetryAt: time.Now().Add(d).Unix(),
+	})
+	if err := r.b.Wait(r.ctx, d); err != nil {
+		return backoff.Stop
+	}
+	return 0
+}
+
+// Reset is called by gotd whenever a connection becomes ready.
+func (r *reconnectBackoff) Reset() {
+	if r.b.Attempt() > 0 {
+		log.Println("[conn] reconnected")
+		_ = r.writer.SendTyped("status", "", protocol.StatusData{Status: "connected"})
+	}
+	r.b.Reset()
+}
+
+// runErrorStatus maps the error that ended tgc.Run to the final status.
+func runErrorStatus(err error) protocol.StatusData {
+	switch {
+	case err == nil:
+		return protocol.StatusData{Status: "disconnected"}
+	case tgerr.Is(err, "USER_DEACTIVATED_BAN", "USER_DEACTIVATED", "PHONE_NUMBER_BANNED"):
+		return protocol.StatusData{Status: "banned", Reason: err.Error()}
+	case tgerr.Is(err, "AUTH_KEY_UNREGISTERED", "SESSION_REVOKED", "SESSION_EXPIRED", "AUTH_KEY_DUPLICATED"),
+		auth.IsUnauthorized(err):
+		return protocol.StatusData{Status: "logged_out", Reason: err.Error()}
+	}
+	return protocol.StatusData{Status: "disconnected", Reason: err.Error()}
+}
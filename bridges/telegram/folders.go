@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/tg"
+)
+
+// folder is a Telegram chat folder (dialog filter) prepared for membership
+// checks.
+type folder struct {
+	id       int
+	title    string
+	emoticon string
+	// rules are the folder's chat type and exclusion rules; nil for shared
+	// folders, which only list chats explicitly.
+	rules    *tg.DialogFilter
+	pinned   []string
+	included map[string]bool
+	excluded map[string]bool
+}
+
+// dialogKind is the kind of chat a folder rule matches.
+type dialogKind int
+
+const (
+	kindContact dialogKind = iota
+	kindNonContact
+	kindBot
+	kindGroup
+	kindBroadcast
+)
+
+// dialogInfo is what folder rules look at in a dialog.
+type dialogInfo struct {
+	chatID   string
+	kind     dialogKind
+	muted    bool
+	unread   bool
+	archived bool
+}
+
+// contains reports whether the folder lists the dialog d.
+func (f folder) contains(d dialogInfo) bool {
+	if f.included[d.chatID] {
+		return true
+	}
+	r := f.rules
+	if r == nil || f.excluded[d.chatID] {
+		return false
+	}
+	if (r.ExcludeMuted && d.muted) || (r.ExcludeRead && !d.unread) || (r.ExcludeArchived && d.archived) {
+		return false
+	}
+	switch d.kind {
+	case kindContact:
+		return r.Contacts
+	case kindNonContact:
+		return r.NonContacts
+	case kindBot:
+		return r.Bots
+	case kindGroup:
+		return r.Groups
+	case kindBroadcast:
+		return r.Broadcasts
+	}
+	return false
+}
+
+// parseFolders converts dialog filters to folders, skipping the built-in
+// "All chats" entry.
+func parseFolders(filters []tg.DialogFilterClass) []folder {
+	var out []folder
+	for _, raw := range filters {
+		var f folder
+		var pinned, included, excluded []tg.InputPeerClass
+		switch d := raw.(type) {
+		case *tg.DialogFilter:
+			f = folder{id: d.ID, title: d.Title.Text, emoticon: d.Emoticon, rules: d}
+			pinned, included, excluded = d.PinnedPeers, d.IncludePeers, d.ExcludePeers
+		case *tg.DialogFilterChatlist:
+			f = folder{id: d.ID, title: d.Title.Text, emoticon: d.Emoticon}
+			pinned, included = d.PinnedPeers, d.IncludePeers
+		default:
+			continue
+		}
+
+		f.included = make(map[string]bool, len(pinned)+len(included))
+		f.excluded = make(map[string]bool, len(excluded))
+		for _, p := range pinned {
+			if id := inputPeerChatID(p); id != "" {
+				f.pinned = append(f.pinned, id)
+				f.included[id] = true
+			}
+		}
+		for _, p := range included {
+			if id := inputPeerChatID(p); id != "" {
+				f.included[id] = true
+			}
+		}
+		for _, p := range excluded {
+			if id := inputPeerChatID(p); id != "" {
+				f.excluded[id] = true
+			}
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// folderIDs returns the IDs of the folders listing d.
+func folderIDs(folders []folder, d dialogInfo) []string {
+	var out []string
+	for _, f := range folders {
+		if f.contains(d) {
+			out = append(out, strconv.Itoa(f.id))
+		}
+	}
+	return out
+}
+
+// inputPeerChatID converts an input peer to a Switchboard chat ID, "" for
+// peers without one (such as InputPeerSelf).
+func inputPeerChatID(p tg.InputPeerClass) string {
+	switch p := p.(type) {
+	case *tg.InputPeerUser:
+		return strconv.FormatInt(p.UserID, 10)
+	case *tg.InputPeerChat:
+		return "c_" + strconv.FormatInt(p.ChatID, 10)
+	case *tg.InputPeerChannel:
+		return "ch_" + strconv.FormatInt(p.ChannelID, 10)
+	}
+	return ""
+}
+
+// dialogPeerChatID converts a dialog peer to a chat ID, "" for peer folders.
+func dialogPeerChatID(p tg.DialogPeerClass) string {
+	if d, ok := p.(*tg.DialogPeer); ok {
+		return peerToChatID(d.Peer)
+	}
+	return ""
+}
+
+// folderCache holds the account's folders between changes.
+type folderCache struct {
+	mu      sync.Mutex
+	folders []folder
+	loaded  bool
+}
+
+// get returns the folders, fetching them if they are not cached.
+func (c *folderCache) get(ctx context.Context, api *tg.Client) ([]folder, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded {
+		return c.folders, nil
+	}
+	result, err := api.MessagesGetDialogFilters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.folders = parseFolders(result.Filters)
+	c.loaded = true
+	return c.folders, nil
+}
+
+// invalidate drops the cached folders.
+func (c *folderCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.folders = nil
+	c.loaded = false
+}
+
+// handleFoldersList emits folders.list with the account's folders.
+func handleFoldersList(ctx context.Context, client *tgClient, writer *protocol.Writer, id string) {
+	folders, err := client.folders.get(ctx, client.tg.API())
+	if err != nil {
+		log.Printf("[chats] GetDialogFilters error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+	_ = writer.SendTyped("folders.list", id, foldersResponse(folders))
+}
+
+// foldersResponse converts folders to the protocol form.
+func foldersResponse(folders []folder) protocol.FoldersResponse {
+	resp := protocol.FoldersResponse{Folders: make([]protocol.Folder, 0, len(folders))}
+	for _, f := range folders {
+		resp.Folders = append(resp.Folders, protocol.Folder{
+			ID:       strconv.Itoa(f.id),
+			Title:    f.title,
+			Emoticon: f.emoticon,
+			Pinned:   f.pinned,
+		})
+	}
+	return resp
+}
+
+// emitFoldersChanged refetches the folders after a change and emits them as
+// folders.changed, followed by chats.changed since membership may differ.
+func emitFoldersChanged(client *tgClient) {
+	client.folders.invalidate()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	folders, err := client.folders.get(ctx, client.tg.API())
+	if err != nil {
+		log.Printf("[update] refetch folders: %v\n", err)
+		return
+	}
+	if err := client.writer.SendTyped("folders.changed", "", foldersResponse(folders)); err != nil {
+		log.Printf("[update] emit folders.changed: %v\n", err)
+	}
+	emitChatsChanged(client)
+}
+
+// emitChatsChanged emits chats.changed for chatIDs, or for all chats when
+// none are given.
+func emitChatsChanged(client *tgClient, chatIDs ...string) {
+	if err := client.writer.SendTyped("chats.changed", "", protocol.ChatsChanged{ChatIDs: chatIDs}); err != nil {
+		log.Printf("[update] emit chats.changed: %v\n", err)
+	}
+}
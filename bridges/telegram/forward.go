@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/telegram/uploader"
+	"github.com/gotd/td/tg"
+)
+
+// handleForward forwards messages natively to another Telegram chat, or
+// emits forward.copy for the host when the target is another service.
+func handleForward(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.ForwardRequest) {
+	if req.ToService != "" && req.ToService != "telegram" {
+		handleForwardCopy(ctx, client, writer, id, req)
+		return
+	}
+
+	fromPeer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	toPeer, err := client.inputPeer(req.ToChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	ids, err := parseMessageIDs(req.MessageIDs)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	randomIDs := make([]int64, len(ids))
+	for i := range randomIDs {
+		randomIDs[i] = rand.Int63() //nolint:gosec — not security-sensitive
+		client.sent.expect(randomIDs[i], req.ToChatID)
+	}
+	result, err := client.tg.API().MessagesForwardMessages(ctx, &tg.MessagesForwardMessagesRequest{
+		FromPeer: fromPeer,
+		ID:       ids,
+		RandomID: randomIDs,
+		ToPeer:   toPeer,
+	})
+	if err != nil {
+		for _, r := range randomIDs {
+			client.sent.cancel(r)
+		}
+		log.Printf("[chats] ForwardMessages error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	resp := protocol.ForwardResponse{ChatID: req.ToChatID, MessageIDs: []string{}}
+	for _, r := range randomIDs {
+		if msgID := sentMessageID(result, r); msgID != 0 {
+			client.sent.mark(req.ToChatID, msgID)
+			resp.MessageIDs = append(resp.MessageIDs, strconv.Itoa(msgID))
+		}
+	}
+	_ = writer.SendTyped("message.forward", id, resp)
+}
+
+// handleForwardCopy fetches the messages to forward and hands them to the
+// host as forward.copy, to be re-sent by the bridge of req.ToService.
+func handleForwardCopy(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.ForwardRequest) {
+	ids, err := parseMessageIDs(req.MessageIDs)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	messages, err := fetchMessages(ctx, client, req.ChatID, ids)
+	if err != nil {
+		log.Printf("[chats] GetMessages error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+	if len(messages) != len(ids) {
+		sendRPCError(writer, id, fmt.Errorf("unknown message in %s", req.ChatID))
+		return
+	}
+
+	out := protocol.ForwardCopy{ToService: req.ToService}
+	for _, m := range messages {
+		out.Messages = append(out.Messages, protocol.CopyMessageRequest{
+			ChatID:      req.ToChatID,
+			Text:        m.Text,
+			Markdown:    m.Markdown,
+			ImagePath:   m.ImagePath,
+			Attribution: protocol.ForwardAttribution(m.From, "Telegram"),
+		})
+	}
+	_ = writer.SendTyped("forward.copy", id, out)
+}
+
+// fetchMessages loads messages of a chat by ID, in the order of ids, with
+// their photos. Unlike history, it fails when a photo cannot be downloaded.
+func fetchMessages(ctx context.Context, client *tgClient, chatID string, ids []int) ([]protocol.Message, error) {
+	peer, err := client.inputPeer(chatID)
+	if err != nil {
+		return nil, err
+	}
+	input := make([]tg.InputMessageClass, len(ids))
+	for i, msgID := range ids {
+		input[i] = &tg.InputMessageID{ID: msgID}
+	}
+
+	api := client.tg.API()
+	var result tg.MessagesMessagesClass
+	if ch, ok := peer.(*tg.InputPeerChannel); ok {
+		result, err = api.ChannelsGetMessages(ctx, &tg.ChannelsGetMessagesRequest{
+			Channel: &tg.InputChannel{ChannelID: ch.ChannelID, AccessHash: ch.AccessHash},
+			ID:      input,
+		})
+	} else {
+		result, err = api.MessagesGetMessages(ctx, input)
+	}
+	if err != nil {
+		return nil, err
+	}
+	client.peers.rememberMessages(result)
+	messages := extractMessages(ctx, client, result, chatID)
+
+	// extractMessages only logs failed downloads, but a copy must not lose
+	// its photo: retry those, failing with the error.
+	photos := make(map[string]*tg.MessageMediaPhoto)
+	if m, ok := result.AsModified(); ok {
+		for _, raw := range m.GetMessages() {
+			if msg, ok := raw.(*tg.Message); ok {
+				if photo, ok := msg.Media.(*tg.MessageMediaPhoto); ok {
+					photos[strconv.Itoa(msg.ID)] = photo
+				}
+			}
+		}
+	}
+	for i, m := range messages {
+		photo, ok := photos[m.ID]
+		if !ok || m.ImagePath != "" {
+			continue
+		}
+		path, err := downloadPhoto(ctx, api, photo, client.mediaDir)
+		if err != nil {
+			return nil, fmt.Errorf("download photo of message %s: %w", m.ID, err)
+		}
+		messages[i].ImagePath = path
+	}
+	return messages, nil
+}
+
+// handleCopyMessage re-sends a message forwarded from another service, with
+// its attribution header and image.
+func handleCopyMessage(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.CopyMessageRequest) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	text, spans := protocol.CopyText(req)
+	entities := spansToEntities(text, spans)
+
+	api := client.tg.API()
+	randomID := rand.Int63() //nolint:gosec — not security-sensitive
+	client.sent.expect(randomID, req.ChatID)
+	var result tg.UpdatesClass
+	if req.ImagePath != "" {
+		var file tg.InputFileClass
+		file, err = uploader.NewUploader(api).FromPath(ctx, req.ImagePath)
+		if err == nil {
+			result, err = api.MessagesSendMedia(ctx, &tg.MessagesSendMediaRequest{
+				Peer:     peer,
+				Media:    &tg.InputMediaUploadedPhoto{File: file},
+				Message:  text,
+				Entities: entities,
+				RandomID: randomID,
+			})
+		}
+	} else {
+		result, err = api.MessagesSendMessage(ctx, &tg.MessagesSendMessageRequest{
+			Peer:      peer,
+			Message:   text,
+			Entities:  entities,
+			RandomID:  randomID,
+			NoWebpage: true,
+		})
+	}
+	if err != nil {
+		client.sent.cancel(randomID)
+		log.Printf("[chats] copy message error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	msgID := sentMessageID(result, randomID)
+	if msgID != 0 {
+		client.sent.mark(req.ChatID, msgID)
+	}
+	_ = writer.SendTyped("message.sent", id, map[string]string{
+		"chat_id":    req.ChatID,
+		"message_id": strconv.Itoa(msgID),
+	})
+}
+
+// parseMessageIDs converts message IDs from the protocol to Telegram's.
+func parseMessageIDs(ids []string) ([]int, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no message ids")
+	}
+	out := make([]int, len(ids))
+	for i, s := range ids {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message id %q", s)
+		}
+		out[i] = n
+	}
+	return out, nil
+}
@@ -10,20 +10,60 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/cenkalti/backoff/v4"
 	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/updates"
+	"github.com/gotd/td/telegram/updates/hook"
 	"github.com/gotd/td/tg"
 )
 
+// Session store entries holding the gotd session and the update state.
+const (
+	sessionName     = "telegram-session.json"
+	updateStateName = "telegram-updates.json"
+)
+
 // tgClient wraps a connected gotd telegram.Client together with shared state.
 type tgClient struct {
 	tg       *telegram.Client
 	writer   *protocol.Writer
 	mediaDir string
+	// configDir holds per-bridge settings such as the proxy.
+	configDir string
+	// proxy routes connections to Telegram and can be switched at runtime.
+	proxy *proxyResolver
+	// sessions holds the auth key and update state, removed by a wiping logout.
+	sessions protocol.SessionStore
+	// updateState persists update state and channel access hashes.
+	updateState *fileUpdateStorage
+	// sent tracks messages sent from Switchboard to dedupe their echoes.
+	sent *sentTracker
+	// typing expires inbound typing indicators that are not refreshed.
+	typing *protocol.TypingTracker
+	// gaps is the updates manager that orders updates and recovers gaps.
+	gaps *updates.Manager
+	// mutes tracks which chats are muted, to hold back their notifications.
+	mutes *muteTracker
+	// rules are the local notification rules; upstream mutes only apply
+	// to notifications no rule matches.
+	rules *protocol.NotificationRules
+	// peers holds the access hashes needed to address users and channels.
+	peers *peerCache
+	// folders caches the chat folders between changes.
+	folders *folderCache
+	// reconnect paces reconnects; connection.retry_now cuts its wait short.
+	reconnect *protocol.Backoff
 	// af is the active auth flow (nil when not in progress).
 	af *authFlow
+
+	// updatesMu guards stopUpdates, which stops the running updates manager.
+	updatesMu   sync.Mutex
+	stopUpdates func()
 }
 
 func main() {
@@ -40,7 +80,6 @@ func main() {
 	// --- Config dirs ---
 	configDir := filepath.Join(os.Getenv("HOME"), ".config", "switchboard")
 	mediaDir := filepath.Join(configDir, "media", "telegram")
-	sessionPath := filepath.Join(configDir, "telegram-session.json")
 
 	for _, d := range []string{configDir, mediaDir} {
 		if err := os.MkdirAll(d, 0o700); err != nil {
@@ -48,8 +87,15 @@ func main() {
 		}
 	}
 
-	// --- Protocol writer (stdout) ---
+	// --- Protocol writer (stdout) and reader (stdin) ---
 	writer := protocol.NewWriter()
+	reader := protocol.NewReader()
+
+	// --- Session store (encrypted at rest when a passphrase is configured) ---
+	sessions, err := protocol.OpenSessionStore(configDir, reader, writer)
+	if err != nil {
+		log.Fatalf("[main] session store: %v\n", err)
+	}
 
 	// --- Signal handling ---
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
@@ -58,39 +104,91 @@ func main() {
 	// --- Update dispatcher (handles incoming messages) ---
 	dispatcher := tg.NewUpdateDispatcher()
 
+	// --- Updates manager (gap recovery with persisted pts/qts/date/seq) ---
+	updateState, err := newFileUpdateStorage(sessions, updateStateName)
+	if err != nil {
+		log.Printf("[main] update state: %v (starting fresh)\n", err)
+	}
+	peers := newPeerCache(updateState)
+	gaps := updates.New(updates.Config{
+		Handler:      peers.handler(dispatcher),
+		Storage:      updateState,
+		AccessHasher: updateState,
+		OnChannelTooLong: func(channelID int64) {
+			log.Printf("[update] channel %d difference too long, history must be refetched\n", channelID)
+			chatID := "ch_" + strconv.FormatInt(channelID, 10)
+			if err := writer.SendTyped("chats.changed", "", protocol.ChatsChanged{
+				ChatIDs: []string{chatID},
+				History: true,
+			}); err != nil {
+				log.Printf("[update] emit chats.changed: %v\n", err)
+			}
+		},
+	})
+
+	// --- Proxy (env, config file, or proxy.set at runtime) ---
+	proxyURL, err := protocol.LoadProxy(configDir, "telegram")
+	if err != nil {
+		log.Printf("[main] proxy: %v (connecting directly)\n", err)
+	}
+	resolver, err := newProxyResolver(proxyURL)
+	if err != nil {
+		log.Printf("[main] proxy %s: %v (connecting directly)\n", protocol.RedactProxy(proxyURL), err)
+		resolver, _ = newProxyResolver("")
+	} else if proxyURL != "" {
+		log.Printf("[main] using proxy %s\n", protocol.RedactProxy(proxyURL))
+	}
+
+	// --- Reconnect backoff (retried until shutdown, see reconnectBackoff) ---
+	reconnect := &reconnectBackoff{
+		ctx:    ctx,
+		b:      protocol.NewBackoff(reconnectMin, reconnectMax),
+		writer: writer,
+	}
+
 	// --- Build gotd client ---
 	tgc := telegram.NewClient(apiID, apiHash, telegram.Options{
-		SessionStorage: &telegram.FileSessionStorage{Path: sessionPath},
-		UpdateHandler:  dispatcher,
+		Resolver:            resolver,
+		ReconnectionBackoff: func() backoff.BackOff { return reconnect },
+		SessionStorage:      &sessionStorage{store: sessions, name: sessionName},
+		UpdateHandler:       gaps,
+		// Space out calls and wait out FLOOD_WAITs, then feed RPC results
+		// (e.g. our own sends) into the manager so pts stays in sync without
+		// a needless getDifference round-trip.
+		Middlewares: []telegram.Middleware{
+			newRateLimiter(floodWaitMax()),
+			hook.UpdateHook(gaps.Handle),
+		},
 	})
 
 	client := &tgClient{
-		tg:       tgc,
-		writer:   writer,
-		mediaDir: mediaDir,
+		tg:          tgc,
+		writer:      writer,
+		mediaDir:    mediaDir,
+		configDir:   configDir,
+		proxy:       resolver,
+		sessions:    sessions,
+		updateState: updateState,
+		sent:        newSentTracker(),
+		typing:      protocol.NewTypingTracker(writer),
+		gaps:        gaps,
+		peers:       peers,
+		mutes:       newMuteTracker(),
+		rules:       protocol.NewNotificationRules(configDir),
+		folders:     &folderCache{},
+		reconnect:   reconnect.b,
 	}
 
-	// Wire the incoming-message handler.
-	dispatcher.OnNewMessage(func(mctx context.Context, _ tg.Entities, u *tg.UpdateNewMessage) error {
-		msg, ok := u.Message.(*tg.Message)
-		if !ok || msg.Out {
-			return nil
-		}
-		chatID := peerToChatID(msg.PeerID)
-		pm := buildIncomingMessage(msg, chatID)
-		if err := writer.SendTyped("message.new", "", pm); err != nil {
-			log.Printf("[update] emit message.new: %v\n", err)
-		}
-		_ = writer.SendTyped("notification", "", protocol.Notification{
-			Title:   "Telegram",
-			Body:    pm.Text,
-			Service: "telegram",
-		})
-		return nil
-	})
+	if _, err := client.rules.Reload(); err != nil {
+		log.Printf("[notify] %v\n", err)
+	}
+
+	// Wire the update handlers (messages, channel edits/deletes, gaps).
+	registerUpdateHandlers(dispatcher, client)
 
 	// --- Run client ---
 	runErr := make(chan error, 1)
+	_ = writer.SendTyped("status", "", protocol.StatusData{Status: "connecting"})
 	go func() {
 		runErr <- tgc.Run(ctx, func(runCtx context.Context) error {
 			// Emit initial status.
@@ -111,6 +209,7 @@ func main() {
 						Phone: self.Phone,
 					})
 					log.Printf("[main] already authenticated as %s\n", name)
+					go client.runUpdates(runCtx, self.ID)
 				}
 			} else {
 				_ = writer.SendTyped("status", "", protocol.StatusData{Status: "auth_needed"})
@@ -123,7 +222,6 @@ func main() {
 	}()
 
 	// --- Stdin command loop ---
-	reader := protocol.NewReader()
 	stdinDone := make(chan struct{})
 	go func() {
 		defer close(stdinDone)
@@ -141,6 +239,7 @@ func main() {
 	}()
 
 	// Wait for shutdown signal or stdin EOF.
+	final := protocol.StatusData{Status: "disconnected"}
 	select {
 	case <-ctx.Done():
 		log.Println("[main] shutting down…")
@@ -148,9 +247,13 @@ func main() {
 		if err != nil {
 			log.Printf("[main] client run error: %v\n", err)
 		}
+		final = runErrorStatus(err)
 	}
 
-	_ = writer.SendTyped("status", "", protocol.StatusData{Status: "disconnected"})
+	if err := updateState.flush(); err != nil {
+		log.Printf("[main] %v\n", err)
+	}
+	_ = writer.SendTyped("status", "", final)
 }
 
 // handleCommand dispatches a single protocol envelope to the correct handler.
@@ -176,6 +279,14 @@ func handleCommand(ctx context.Context, client *tgClient, env protocol.Envelope)
 		}
 		handleAuthCode(client, req)
 
+	case "auth.logout":
+		var req protocol.LogoutRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse auth.logout: %v\n", err)
+			return
+		}
+		go handleLogout(ctx, client, env.ID, req)
+
 	case "chats.list":
 		go handleChatsList(ctx, client, client.writer, env.ID)
 
@@ -187,6 +298,25 @@ func handleCommand(ctx context.Context, client *tgClient, env protocol.Envelope)
 		}
 		go handleChatMessages(ctx, client, client.writer, env.ID, req)
 
+	case "folders.list":
+		go handleFoldersList(ctx, client, client.writer, env.ID)
+
+	case "chat.mute", "chat.unmute":
+		var req protocol.MuteRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse %s: %v\n", env.Type, err)
+			return
+		}
+		go handleMute(ctx, client, client.writer, env.ID, env.Type, req, env.Type == "chat.mute")
+
+	case "chat.topics":
+		var req protocol.TopicsRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse chat.topics: %v\n", err)
+			return
+		}
+		go handleChatTopics(ctx, client, client.writer, env.ID, req)
+
 	case "message.send":
 		var req protocol.SendMessageRequest
 		if err := protocol.ParseData(env, &req); err != nil {
@@ -195,6 +325,95 @@ func handleCommand(ctx context.Context, client *tgClient, env protocol.Envelope)
 		}
 		go handleSendMessage(ctx, client, client.writer, env.ID, req)
 
+	case "message.forward":
+		var req protocol.ForwardRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse message.forward: %v\n", err)
+			return
+		}
+		go handleForward(ctx, client, client.writer, env.ID, req)
+
+	case "message.copy":
+		var req protocol.CopyMessageRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse message.copy: %v\n", err)
+			return
+		}
+		go handleCopyMessage(ctx, client, client.writer, env.ID, req)
+
+	case "messages.search":
+		var req protocol.SearchRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse messages.search: %v\n", err)
+			return
+		}
+		go handleSearch(ctx, client, client.writer, env.ID, req)
+
+	case "message.edit":
+		var req protocol.EditMessageRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse message.edit: %v\n", err)
+			return
+		}
+		go handleEditMessage(ctx, client, client.writer, env.ID, req)
+
+	case "message.delete":
+		var req protocol.DeleteMessageRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse message.delete: %v\n", err)
+			return
+		}
+		go handleDeleteMessages(ctx, client, client.writer, env.ID, req)
+
+	case "chat.mark_read":
+		var req protocol.MarkReadRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse chat.mark_read: %v\n", err)
+			return
+		}
+		go handleMarkRead(ctx, client, client.writer, env.ID, req)
+
+	case "message.react", "message.unreact":
+		var req protocol.ReactRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse %s: %v\n", env.Type, err)
+			return
+		}
+		if env.Type == "message.unreact" {
+			req.Emoji = ""
+		}
+		go handleReact(ctx, client, client.writer, env.ID, req)
+
+	case "chat.typing":
+		var req protocol.TypingRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse chat.typing: %v\n", err)
+			return
+		}
+		go handleSetTyping(ctx, client, client.writer, env.ID, req)
+
+	case "proxy.set":
+		var req protocol.ProxyRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse proxy.set: %v\n", err)
+			return
+		}
+		handleSetProxy(client, client.writer, env.ID, req)
+
+	case "proxy.get":
+		handleGetProxy(client, client.writer, env.ID)
+
+	case "notifications.rules":
+		var req protocol.NotificationRulesRequest
+		if err := protocol.ParseData(env, &req); err != nil {
+			log.Printf("[cmd] parse notifications.rules: %v\n", err)
+			return
+		}
+		handleNotificationRules(client, client.writer, env.ID, req)
+
+	case "connection.retry_now":
+		client.reconnect.RetryNow()
+
 	default:
 		log.Printf("[cmd] unknown type: %s\n", env.Type)
 		_ = client.writer.SendTyped("error", env.ID, map[string]string{
@@ -224,6 +443,21 @@ func handleAuthCode(client *tgClient, req protocol.AuthCode) {
 	client.af.submitCode(req.Code)
 }
 
+// floodWaitMax returns the FLOOD_WAIT ceiling from TELEGRAM_FLOOD_WAIT_MAX
+// (in seconds), or defaultFloodWaitMax if unset or invalid.
+func floodWaitMax() time.Duration {
+	v := os.Getenv("TELEGRAM_FLOOD_WAIT_MAX")
+	if v == "" {
+		return defaultFloodWaitMax
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs < 0 {
+		log.Printf("[main] invalid TELEGRAM_FLOOD_WAIT_MAX %q, using %s\n", v, defaultFloodWaitMax)
+		return defaultFloodWaitMax
+	}
+	return time.Duration(secs) * time.Second
+}
+
 // loadCredentials reads TELEGRAM_API_ID and TELEGRAM_API_HASH from env,
 // falling back to ~/.config/switchboard/telegram.env if either is missing.
 func loadCredentials() (int, string, error) {
@@ -291,4 +525,3 @@ func parseEnvFile(path string) (map[string]string, error) {
 	}
 	return out, scanner.Err()
 }
-
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/tg"
+)
+
+// Telegram entity offsets and lengths count UTF-16 code units, while
+// protocol.Span counts runes; characters outside the BMP (most emoji) are two
+// units but one rune.
+
+// utf16Index maps rune offsets of text to UTF-16 offsets: index i holds the
+// UTF-16 offset of rune i, and the last entry the total length.
+func utf16Index(text string) []int {
+	idx := make([]int, 0, utf8.RuneCountInString(text)+1)
+	n := 0
+	for _, r := range text {
+		idx = append(idx, n)
+		n += utf16Len(r)
+	}
+	return append(idx, n)
+}
+
+// utf16Len returns the number of UTF-16 code units encoding r.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// runeOffset converts a UTF-16 offset to a rune offset using idx from
+// utf16Index. An offset inside a surrogate pair rounds down, or up when end.
+func runeOffset(idx []int, u16 int, end bool) int {
+	lo, hi := 0, len(idx)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if idx[mid] < u16 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if idx[lo] > u16 && !end && lo > 0 {
+		lo--
+	}
+	return lo
+}
+
+// messageMarkdown renders the formatting entities of a message as Markdown.
+// It returns "" when the message has no formatting, so plain messages only
+// carry Text.
+func messageMarkdown(msg *tg.Message) string {
+	entities, ok := msg.GetEntities()
+	if !ok || len(entities) == 0 {
+		return ""
+	}
+	spans := entitiesToSpans(msg.Message, entities)
+	if len(spans) == 0 {
+		return ""
+	}
+	return protocol.RenderMarkdown(msg.Message, spans)
+}
+
+// entitiesToSpans converts formatting entities to spans. Entities Telegram
+// detects by itself (mentions, hashtags, URLs, ...) are left out, as the
+// client finds them again in the plain text.
+func entitiesToSpans(text string, entities []tg.MessageEntityClass) []protocol.Span {
+	idx := utf16Index(text)
+	spans := make([]protocol.Span, 0, len(entities))
+	for _, e := range entities {
+		s := protocol.Span{
+			Start: runeOffset(idx, e.GetOffset(), false),
+			End:   runeOffset(idx, e.GetOffset()+e.GetLength(), true),
+		}
+		switch e := e.(type) {
+		case *tg.MessageEntityBold:
+			s.Style = protocol.StyleBold
+		case *tg.MessageEntityItalic:
+			s.Style = protocol.StyleItalic
+		case *tg.MessageEntityUnderline:
+			s.Style = protocol.StyleUnderline
+		case *tg.MessageEntityStrike:
+			s.Style = protocol.StyleStrike
+		case *tg.MessageEntitySpoiler:
+			s.Style = protocol.StyleSpoiler
+		case *tg.MessageEntityCode:
+			s.Style = protocol.StyleCode
+		case *tg.MessageEntityPre:
+			s.Style = protocol.StylePre
+			s.Language = e.Language
+		case *tg.MessageEntityBlockquote:
+			s.Style = protocol.StyleQuote
+		case *tg.MessageEntityTextURL:
+			s.Style = protocol.StyleLink
+			s.URL = e.URL
+		case *tg.MessageEntityMentionName:
+			s.Style = protocol.StyleLink
+			s.URL = "tg://user?id=" + strconv.FormatInt(e.UserID, 10)
+		default:
+			continue
+		}
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+// spansToEntities converts spans of text to Telegram formatting entities.
+// All links, tg://user?id=N mentions included, are sent as text URLs.
+func spansToEntities(text string, spans []protocol.Span) []tg.MessageEntityClass {
+	idx := utf16Index(text)
+	entities := make([]tg.MessageEntityClass, 0, len(spans))
+	for _, s := range spans {
+		if s.Start < 0 || s.End >= len(idx) || s.Start >= s.End {
+			continue
+		}
+		off, length := idx[s.Start], idx[s.End]-idx[s.Start]
+		switch s.Style {
+		case protocol.StyleBold:
+			entities = append(entities, &tg.MessageEntityBold{Offset: off, Length: length})
+		case protocol.StyleItalic:
+			entities = append(entities, &tg.MessageEntityItalic{Offset: off, Length: length})
+		case protocol.StyleUnderline:
+			entities = append(entities, &tg.MessageEntityUnderline{Offset: off, Length: length})
+		case protocol.StyleStrike:
+			entities = append(entities, &tg.MessageEntityStrike{Offset: off, Length: length})
+		case protocol.StyleSpoiler:
+			entities = append(entities, &tg.MessageEntitySpoiler{Offset: off, Length: length})
+		case protocol.StyleCode:
+			entities = append(entities, &tg.MessageEntityCode{Offset: off, Length: length})
+		case protocol.StylePre:
+			entities = append(entities, &tg.MessageEntityPre{Offset: off, Length: length, Language: s.Language})
+		case protocol.StyleQuote:
+			entities = append(entities, &tg.MessageEntityBlockquote{Offset: off, Length: length})
+		case protocol.StyleLink:
+			entities = append(entities, &tg.MessageEntityTextURL{Offset: off, Length: length, URL: s.URL})
+		}
+	}
+	return entities
+}
+
+// formatText returns the text and entities to send for text in format:
+// "markdown" parses it, "" sends it as is.
+func formatText(text, format string) (string, []tg.MessageEntityClass, error) {
+	switch format {
+	case "":
+		return text, nil, nil
+	case "markdown":
+		plain, spans := protocol.ParseMarkdown(text)
+		return plain, spansToEntities(plain, spans), nil
+	}
+	return "", nil, fmt.Errorf("unsupported format %q", format)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/tg"
+)
+
+func TestUTF16Index(t *testing.T) {
+	tests := []struct {
+		name, text string
+		want       []int
+	}{
+		{"empty", "", []int{0}},
+		{"ascii", "abc", []int{0, 1, 2, 3}},
+		{"bmp", "é日本", []int{0, 1, 2, 3}},
+		{"emoji", "a👍b", []int{0, 1, 3, 4}},
+		{"skin tone", "👍🏽", []int{0, 2, 4}},
+		// 👨‍👩‍👧 is man, ZWJ, woman, ZWJ, girl.
+		{"zwj sequence", "👨‍👩‍👧!", []int{0, 2, 3, 5, 6, 8, 9}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := utf16Index(tt.text); !slices.Equal(got, tt.want) {
+				t.Errorf("utf16Index(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRuneOffset(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		u16   int
+		end   bool
+		want  int
+		whole bool // u16 falls on a rune boundary
+	}{
+		{name: "start", text: "abc", u16: 0, want: 0},
+		{name: "bmp", text: "é日本", u16: 2, want: 2},
+		{name: "total length", text: "é日本", u16: 3, want: 3},
+		{name: "after emoji", text: "a👍b", u16: 3, want: 2},
+		{name: "before emoji", text: "a👍b", u16: 1, want: 1},
+		{name: "inside surrogate pair", text: "a👍b", u16: 2, want: 1},
+		{name: "inside surrogate pair at end", text: "a👍b", u16: 2, end: true, want: 2},
+		{name: "zwj sequence member", text: "👨‍👩‍👧!", u16: 3, want: 2},
+		{name: "inside zwj member", text: "👨‍👩‍👧!", u16: 4, want: 2},
+		{name: "inside zwj member at end", text: "👨‍👩‍👧!", u16: 4, end: true, want: 3},
+		{name: "after zwj sequence", text: "👨‍👩‍👧!", u16: 8, want: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runeOffset(utf16Index(tt.text), tt.u16, tt.end); got != tt.want {
+				t.Errorf("runeOffset(%q, %d, %v) = %d, want %d", tt.text, tt.u16, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntitiesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		entities []tg.MessageEntityClass
+		spans    []protocol.Span
+	}{
+		{
+			name: "bmp",
+			text: "hello world",
+			entities: []tg.MessageEntityClass{
+				&tg.MessageEntityBold{Offset: 0, Length: 5},
+				&tg.MessageEntityTextURL{Offset: 6, Length: 5, URL: "https://example.com"},
+			},
+			spans: []protocol.Span{
+				{Start: 0, End: 5, Style: protocol.StyleBold},
+				{Start: 6, End: 11, Style: protocol.StyleLink, URL: "https://example.com"},
+			},
+		},
+		{
+			name: "emoji",
+			text: "a👍b 👨‍👩‍👧 c",
+			entities: []tg.MessageEntityClass{
+				&tg.MessageEntityBold{Offset: 1, Length: 2},
+				&tg.MessageEntitySpoiler{Offset: 5, Length: 8},
+				&tg.MessageEntityCode{Offset: 14, Length: 1},
+			},
+			spans: []protocol.Span{
+				{Start: 1, End: 2, Style: protocol.StyleBold},
+				{Start: 4, End: 9, Style: protocol.StyleSpoiler},
+				{Start: 10, End: 11, Style: protocol.StyleCode},
+			},
+		},
+		{
+			name: "pre",
+			text: "x 🙂\nfmt",
+			entities: []tg.MessageEntityClass{
+				&tg.MessageEntityPre{Offset: 5, Length: 3, Language: "go"},
+			},
+			spans: []protocol.Span{
+				{Start: 4, End: 7, Style: protocol.StylePre, Language: "go"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spans := entitiesToSpans(tt.text, tt.entities)
+			if !slices.Equal(spans, tt.spans) {
+				t.Fatalf("entitiesToSpans = %+v, want %+v", spans, tt.spans)
+			}
+			if got := spansToEntities(tt.text, spans); !reflect.DeepEqual(got, tt.entities) {
+				t.Errorf("spansToEntities = %+v, want %+v", got, tt.entities)
+			}
+
+			// Rendered as Markdown and parsed back, the message is unchanged.
+			msg := &tg.Message{Message: tt.text}
+			msg.SetEntities(tt.entities)
+			md := messageMarkdown(msg)
+			text, entities, err := formatText(md, "markdown")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != tt.text || !reflect.DeepEqual(entities, tt.entities) {
+				t.Errorf("formatText(%q) = %q, %+v; want %q, %+v", md, text, entities, tt.text, tt.entities)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/tg"
+)
+
+// muteForever is the mute_until Telegram clients use for an indefinite mute.
+// Any mute ending more than muteForeverAfter from now is reported as one.
+const (
+	muteForever      = math.MaxInt32
+	muteForeverAfter = 10 * 365 * 24 * time.Hour
+)
+
+// notifyScope is the type of chat whose default notify settings apply to a
+// chat without a mute_until of its own.
+type notifyScope int
+
+const (
+	scopeUsers notifyScope = iota
+	scopeChats
+	scopeBroadcasts
+)
+
+// notifyScopes maps each scope to the input peer of its default settings.
+var notifyScopes = map[notifyScope]tg.InputNotifyPeerClass{
+	scopeUsers:      &tg.InputNotifyUsers{},
+	scopeChats:      &tg.InputNotifyChats{},
+	scopeBroadcasts: &tg.InputNotifyBroadcasts{},
+}
+
+// notifyScope returns the scope of a chat of kind k.
+func (k dialogKind) notifyScope() notifyScope {
+	switch k {
+	case kindGroup:
+		return scopeChats
+	case kindBroadcast:
+		return scopeBroadcasts
+	}
+	return scopeUsers
+}
+
+// notifyScope returns the scope of chatID. Channels not seen yet count as
+// groups.
+func (c *tgClient) notifyScope(chatID string) notifyScope {
+	peer, _ := parsePeer(chatID)
+	switch p := peer.(type) {
+	case *tg.InputPeerChat:
+		return scopeChats
+	case *tg.InputPeerChannel:
+		if c.peers.broadcast(p.ChannelID) {
+			return scopeBroadcasts
+		}
+		return scopeChats
+	}
+	return scopeUsers
+}
+
+// muteStateFor converts a chat's notify settings to its mute state. Without
+// a mute_until of its own, the chat follows def, the defaults of its scope.
+func muteStateFor(chatID string, s, def tg.PeerNotifySettings) protocol.MuteState {
+	state := protocol.MuteState{ChatID: chatID}
+	until, ok := s.GetMuteUntil()
+	if !ok {
+		until, ok = def.GetMuteUntil()
+	}
+	now := time.Now()
+	if !ok || int64(until) <= now.Unix() {
+		return state
+	}
+	state.Muted = true
+	if int64(until) < now.Add(muteForeverAfter).Unix() {
+		state.Until = int64(until)
+	}
+	return state
+}
+
+// chatNotify is what muteTracker knows of a chat's notify settings.
+type chatNotify struct {
+	scope    notifyScope
+	settings tg.PeerNotifySettings
+}
+
+// muteTracker remembers the notify settings of chats and the defaults of
+// each scope, learned from the chat list, notify settings updates and, for
+// chats not seen yet, a lookup.
+type muteTracker struct {
+	mu       sync.Mutex
+	chats    map[string]chatNotify
+	defaults map[notifyScope]tg.PeerNotifySettings
+}
+
+// newMuteTracker creates an empty muteTracker.
+func newMuteTracker() *muteTracker {
+	return &muteTracker{
+		chats:    make(map[string]chatNotify),
+		defaults: make(map[notifyScope]tg.PeerNotifySettings),
+	}
+}
+
+// set records the notify settings of a chat and returns its mute state.
+func (t *muteTracker) set(chatID string, scope notifyScope, s tg.PeerNotifySettings) protocol.MuteState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.chats[chatID] = chatNotify{scope: scope, settings: s}
+	return muteStateFor(chatID, s, t.defaults[scope])
+}
+
+// setDefaults records the default notify settings of scope and returns the
+// new mute state of each known chat that follows them and changed.
+func (t *muteTracker) setDefaults(scope notifyScope, s tg.PeerNotifySettings) []protocol.MuteState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.defaults[scope]
+	t.defaults[scope] = s
+	var changed []protocol.MuteState
+	for chatID, c := range t.chats {
+		if c.scope != scope {
+			continue
+		}
+		if state := muteStateFor(chatID, c.settings, s); state != muteStateFor(chatID, c.settings, old) {
+			changed = append(changed, state)
+		}
+	}
+	return changed
+}
+
+// loadDefaults fetches the default notify settings of the scopes not known
+// yet. It makes requests, so it must not be called from the update
+// dispatcher.
+func (t *muteTracker) loadDefaults(ctx context.Context, api *tg.Client) error {
+	for scope, peer := range notifyScopes {
+		t.mu.Lock()
+		_, ok := t.defaults[scope]
+		t.mu.Unlock()
+		if ok {
+			continue
+		}
+		settings, err := api.AccountGetNotifySettings(ctx, peer)
+		if err != nil {
+			return fmt.Errorf("get default notify settings: %w", err)
+		}
+		t.setDefaults(scope, *settings)
+	}
+	return nil
+}
+
+// muted reports whether chatID is muted now, fetching its notify settings
+// the first time the chat is seen, and the defaults they may fall back to.
+// A failed lookup counts as unmuted and is not remembered, so the next
+// message retries it. It makes requests, so it must not be called from the
+// update dispatcher.
+func (t *muteTracker) muted(ctx context.Context, client *tgClient, chatID string) bool {
+	if err := t.loadDefaults(ctx, client.tg.API()); err != nil {
+		log.Printf("[mute] %v\n", err)
+	}
+	t.mu.Lock()
+	c, ok := t.chats[chatID]
+	state := muteStateFor(chatID, c.settings, t.defaults[c.scope])
+	t.mu.Unlock()
+	if !ok {
+		peer, err := client.inputPeer(chatID)
+		if err != nil {
+			log.Printf("[mute] get notify settings of %s: %v\n", chatID, err)
+			return false
+		}
+		settings, err := client.tg.API().AccountGetNotifySettings(ctx, &tg.InputNotifyPeer{Peer: peer})
+		if err != nil {
+			log.Printf("[mute] get notify settings of %s: %v\n", chatID, err)
+			return false
+		}
+		state = t.set(chatID, client.notifyScope(chatID), *settings)
+	}
+	return state.Muted && (state.Until == 0 || state.Until > time.Now().Unix())
+}
+
+// handleMute mutes or unmutes a chat upstream and answers with its new state.
+func handleMute(ctx context.Context, client *tgClient, writer *protocol.Writer, id, cmd string, req protocol.MuteRequest, mute bool) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	until := 0
+	if mute {
+		until = muteForever
+		if req.Until > 0 {
+			until = int(req.Until)
+		}
+	}
+	var settings tg.InputPeerNotifySettings
+	// Set explicitly, as a zero mute_until is what unmutes.
+	settings.SetMuteUntil(until)
+	if _, err := client.tg.API().AccountUpdateNotifySettings(ctx, &tg.AccountUpdateNotifySettingsRequest{
+		Peer:     &tg.InputNotifyPeer{Peer: peer},
+		Settings: settings,
+	}); err != nil {
+		log.Printf("[mute] UpdateNotifySettings error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+	var current tg.PeerNotifySettings
+	current.SetMuteUntil(until)
+	state := client.mutes.set(req.ChatID, client.notifyScope(req.ChatID), current)
+	_ = writer.SendTyped(cmd, id, state)
+}
+
+// emitMuteChanged records notify settings changed on another device and
+// emits chat.mute_changed for each chat whose mute state they change. Forum
+// topic settings are ignored.
+func emitMuteChanged(client *tgClient, peer tg.NotifyPeerClass, settings tg.PeerNotifySettings) {
+	var states []protocol.MuteState
+	switch p := peer.(type) {
+	case *tg.NotifyPeer:
+		chatID := peerToChatID(p.Peer)
+		states = append(states, client.mutes.set(chatID, client.notifyScope(chatID), settings))
+	case *tg.NotifyUsers:
+		states = client.mutes.setDefaults(scopeUsers, settings)
+	case *tg.NotifyChats:
+		states = client.mutes.setDefaults(scopeChats, settings)
+	case *tg.NotifyBroadcasts:
+		states = client.mutes.setDefaults(scopeBroadcasts, settings)
+	}
+	for _, state := range states {
+		if err := client.writer.SendTyped("chat.mute_changed", "", state); err != nil {
+			log.Printf("[update] emit chat.mute_changed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+)
+
+// handleNotificationRules reloads the notification rules or, for a dry run,
+// reports what they would do to a sample notification.
+func handleNotificationRules(client *tgClient, writer *protocol.Writer, id string, req protocol.NotificationRulesRequest) {
+	resp, err := client.rules.Handle(req)
+	if err != nil {
+		log.Printf("[notify] %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+	_ = writer.SendTyped("notifications.rules", id, resp)
+}
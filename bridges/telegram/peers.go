@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+)
+
+// peerCache remembers the access hashes of users and channels seen in
+// dialogs, histories and updates. Telegram rejects input peers with a zero
+// access hash for anyone the server has not just sent to this session. It
+// also remembers which channels are forums and which are broadcasts.
+type peerCache struct {
+	mu         sync.Mutex
+	users      map[int64]int64
+	channels   map[int64]int64
+	forums     map[int64]bool
+	broadcasts map[int64]bool
+	// state holds the channel access hashes persisted by the updates
+	// manager, for channels not seen since start.
+	state *fileUpdateStorage
+}
+
+// newPeerCache creates an empty peerCache backed by state.
+func newPeerCache(state *fileUpdateStorage) *peerCache {
+	return &peerCache{
+		users:      make(map[int64]int64),
+		channels:   make(map[int64]int64),
+		forums:     make(map[int64]bool),
+		broadcasts: make(map[int64]bool),
+		state:      state,
+	}
+}
+
+// remember records the access hashes of users and chats. Min constructors
+// carry hashes that cannot be used to address the peer and are skipped.
+func (c *peerCache) remember(users []tg.UserClass, chats []tg.ChatClass) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range users {
+		if u, ok := u.(*tg.User); ok && !u.Min {
+			if hash, ok := u.GetAccessHash(); ok {
+				c.users[u.ID] = hash
+			}
+		}
+	}
+	for _, ch := range chats {
+		switch ch := ch.(type) {
+		case *tg.Channel:
+			if hash, ok := ch.GetAccessHash(); ok && !ch.Min {
+				c.channels[ch.ID] = hash
+			}
+			c.forums[ch.ID] = ch.Forum
+			c.broadcasts[ch.ID] = ch.Broadcast
+		case *tg.ChannelForbidden:
+			c.channels[ch.ID] = ch.AccessHash
+			c.broadcasts[ch.ID] = ch.Broadcast
+		}
+	}
+}
+
+// rememberUpdates records the peers carried by an updates batch.
+func (c *peerCache) rememberUpdates(u tg.UpdatesClass) {
+	switch u := u.(type) {
+	case *tg.Updates:
+		c.remember(u.Users, u.Chats)
+	case *tg.UpdatesCombined:
+		c.remember(u.Users, u.Chats)
+	}
+}
+
+// rememberMessages records the peers of a history or search result.
+func (c *peerCache) rememberMessages(result tg.MessagesMessagesClass) {
+	if m, ok := result.AsModified(); ok {
+		c.remember(m.GetUsers(), m.GetChats())
+	}
+}
+
+// handler wraps next so it records the peers of every update first.
+func (c *peerCache) handler(next telegram.UpdateHandler) telegram.UpdateHandler {
+	return telegram.UpdateHandlerFunc(func(ctx context.Context, u tg.UpdatesClass) error {
+		c.rememberUpdates(u)
+		return next.Handle(ctx, u)
+	})
+}
+
+// forum reports whether peer is a channel known to be a forum.
+func (c *peerCache) forum(peer tg.PeerClass) bool {
+	p, ok := peer.(*tg.PeerChannel)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.forums[p.ChannelID]
+}
+
+// broadcast reports whether channelID is known to be a broadcast channel.
+func (c *peerCache) broadcast(channelID int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.broadcasts[channelID]
+}
+
+// fill sets the access hash of a parsed peer, where one is known.
+func (c *peerCache) fill(peer tg.InputPeerClass) tg.InputPeerClass {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch p := peer.(type) {
+	case *tg.InputPeerUser:
+		p.AccessHash = c.users[p.UserID]
+	case *tg.InputPeerChannel:
+		hash, ok := c.channels[p.ChannelID]
+		if !ok && c.state != nil {
+			hash, _ = c.state.channelAccessHash(p.ChannelID)
+		}
+		p.AccessHash = hash
+	}
+	return peer
+}
+
+// inputPeer converts a Switchboard chat ID to an input peer carrying its
+// access hash, see parsePeer.
+func (c *tgClient) inputPeer(chatID string) (tg.InputPeerClass, error) {
+	peer, err := parsePeer(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return c.peers.fill(peer), nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/telegram/dcs"
+	"github.com/gotd/td/transport"
+	"golang.org/x/net/proxy"
+)
+
+// proxyResolver is a dcs.Resolver whose route to Telegram can be swapped at
+// runtime by proxy.set. A change applies to connections opened afterwards.
+type proxyResolver struct {
+	mu sync.RWMutex
+	r  dcs.Resolver
+}
+
+var _ dcs.Resolver = (*proxyResolver)(nil)
+
+// newProxyResolver creates a resolver routing through rawURL ("" for direct).
+func newProxyResolver(rawURL string) (*proxyResolver, error) {
+	r, err := resolverFor(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyResolver{r: r}, nil
+}
+
+// set switches to the route for rawURL.
+func (p *proxyResolver) set(rawURL string) error {
+	r, err := resolverFor(rawURL)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.r = r
+	p.mu.Unlock()
+	return nil
+}
+
+// current returns the active resolver.
+func (p *proxyResolver) current() dcs.Resolver {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.r
+}
+
+// Primary implements dcs.Resolver.
+func (p *proxyResolver) Primary(ctx context.Context, dc int, list dcs.List) (transport.Conn, error) {
+	return p.current().Primary(ctx, dc, list)
+}
+
+// MediaOnly implements dcs.Resolver.
+func (p *proxyResolver) MediaOnly(ctx context.Context, dc int, list dcs.List) (transport.Conn, error) {
+	return p.current().MediaOnly(ctx, dc, list)
+}
+
+// CDN implements dcs.Resolver.
+func (p *proxyResolver) CDN(ctx context.Context, dc int, list dcs.List) (transport.Conn, error) {
+	return p.current().CDN(ctx, dc, list)
+}
+
+// resolverFor builds the resolver for a proxy URL: SOCKS5 and HTTP CONNECT
+// proxies tunnel the plain transport, MTProxy uses its obfuscated one.
+func resolverFor(rawURL string) (dcs.Resolver, error) {
+	if rawURL == "" {
+		return dcs.DefaultResolver(), nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse proxy URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("socks5 proxy: %w", err)
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("socks5 proxy: dialer does not support contexts")
+		}
+		return dcs.Plain(dcs.PlainOptions{Dial: cd.DialContext}), nil
+
+	case "http":
+		return dcs.Plain(dcs.PlainOptions{Dial: httpConnectDialer(u)}), nil
+
+	case "mtproxy":
+		secret, err := decodeMTProxySecret(u.Query().Get("secret"))
+		if err != nil {
+			return nil, err
+		}
+		r, err := dcs.MTProxy(u.Host, secret, dcs.MTProxyOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("mtproxy: %w", err)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+}
+
+// decodeMTProxySecret accepts the hex or base64url secret forms found in
+// tg://proxy links.
+func decodeMTProxySecret(s string) ([]byte, error) {
+	if s == "" {
+		return nil, fmt.Errorf("mtproxy: secret is required")
+	}
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return nil, fmt.Errorf("mtproxy: secret must be hex or base64url")
+}
+
+// httpConnectDialer returns a dial function tunnelling TCP through the HTTP
+// proxy u with a CONNECT request, using basic auth when u has credentials.
+func httpConnectDialer(u *url.URL) dcs.DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("dial http proxy: %w", err)
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u.User != nil {
+			pass, _ := u.User.Password()
+			cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+			req.Header.Set("Proxy-Authorization", "Basic "+cred)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("http proxy CONNECT: %w", err)
+		}
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("http proxy CONNECT: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("http proxy CONNECT: %s", resp.Status)
+		}
+		if br.Buffered() > 0 {
+			conn.Close()
+			return nil, fmt.Errorf("http proxy CONNECT: unexpected data after response")
+		}
+		_ = conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+// handleSetProxy validates, applies and persists a new proxy setting.
+func handleSetProxy(client *tgClient, writer *protocol.Writer, id string, req protocol.ProxyRequest) {
+	if err := client.proxy.set(req.URL); err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	if err := protocol.SaveProxy(client.configDir, "telegram", req.URL); err != nil {
+		log.Printf("[proxy] %v\n", err)
+	}
+	if req.URL == "" {
+		log.Println("[proxy] proxy disabled")
+	} else {
+		log.Printf("[proxy] using %s\n", protocol.RedactProxy(req.URL))
+	}
+	_ = writer.SendTyped("proxy.set", id, protocol.ProxyResponse{URL: protocol.RedactProxy(req.URL)})
+}
+
+// handleGetProxy reports the active proxy setting.
+func handleGetProxy(client *tgClient, writer *protocol.Writer, id string) {
+	rawURL, err := protocol.LoadProxy(client.configDir, "telegram")
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	_ = writer.SendTyped("proxy.get", id, protocol.ProxyResponse{URL: protocol.RedactProxy(rawURL)})
+}
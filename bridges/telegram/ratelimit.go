@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/bin"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+)
+
+// defaultFloodWaitMax is the longest FLOOD_WAIT the bridge sits out itself
+// before giving up and reporting rate_limited to the host.
+const defaultFloodWaitMax = 30 * time.Second
+
+// floodWaitRetries bounds how many FLOOD_WAITs a single call waits out.
+const floodWaitRetries = 3
+
+// methodIntervals is the minimum spacing between calls of the same method.
+// Methods not listed use defaultMethodInterval.
+var methodIntervals = map[string]time.Duration{
+	"messages.sendMessage":     time.Second,
+	"messages.sendMedia":       time.Second,
+	"messages.forwardMessages": time.Second,
+	"messages.editMessage":     time.Second,
+	"messages.getHistory":      300 * time.Millisecond,
+	"messages.search":          500 * time.Millisecond,
+	"messages.searchGlobal":    time.Second,
+	"messages.getDialogs":      time.Second,
+}
+
+// defaultMethodInterval is the spacing for methods not in methodIntervals.
+const defaultMethodInterval = 50 * time.Millisecond
+
+// rateLimitedError is returned when Telegram asks for a wait longer than
+// the configured ceiling.
+type rateLimitedError struct {
+	Method     string
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("%s: rate limited, retry after %s", e.Method, e.RetryAfter)
+}
+
+func (e *rateLimitedError) Unwrap() error { return e.Err }
+
+// rateLimiter is a gotd middleware that spaces out calls per method and
+// transparently waits out FLOOD_WAIT errors up to maxWait.
+type rateLimiter struct {
+	maxWait time.Duration
+
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// newRateLimiter creates a rateLimiter that waits out floods up to maxWait.
+func newRateLimiter(maxWait time.Duration) *rateLimiter {
+	return &rateLimiter{
+		maxWait: maxWait,
+		next:    make(map[string]time.Time),
+	}
+}
+
+// Handle implements telegram.Middleware.
+func (r *rateLimiter) Handle(next tg.Invoker) telegram.InvokeFunc {
+	return func(ctx context.Context, input bin.Encoder, output bin.Decoder) error {
+		method := methodName(input)
+		for attempt := 0; ; attempt++ {
+			if err := r.reserve(ctx, method); err != nil {
+				return err
+			}
+			err := next.Invoke(ctx, input, output)
+			d, ok := tgerr.AsFloodWait(err)
+			if !ok {
+				return err
+			}
+			if d > r.maxWait || attempt >= floodWaitRetries {
+				return &rateLimitedError{Method: method, RetryAfter: d, Err: err}
+			}
+			log.Printf("[ratelimit] %s: FLOOD_WAIT %s, waiting\n", method, d)
+			r.delay(method, d)
+			if err := sleepCtx(ctx, d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reserve waits for the next free slot of method and claims it.
+func (r *rateLimiter) reserve(ctx context.Context, method string) error {
+	interval, ok := methodIntervals[method]
+	if !ok {
+		interval = defaultMethodInterval
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	at := r.next[method]
+	if at.Before(now) {
+		at = now
+	}
+	r.next[method] = at.Add(interval)
+	r.mu.Unlock()
+
+	return sleepCtx(ctx, time.Until(at))
+}
+
+// delay holds back every call of method for d after a FLOOD_WAIT.
+func (r *rateLimiter) delay(method string, d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if until := time.Now().Add(d); until.After(r.next[method]) {
+		r.next[method] = until
+	}
+}
+
+// methodName returns the TL name of an RPC request, e.g. messages.sendMessage.
+func methodName(input bin.Encoder) string {
+	if t, ok := input.(interface{ TypeName() string }); ok {
+		return t.TypeName()
+	}
+	return fmt.Sprintf("%T", input)
+}
+
+// sleepCtx sleeps for d or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sendRPCError reports err for request id to the host. Floods beyond the
+// wait ceiling are reported with code rate_limited and a retry_after.
+func sendRPCError(writer *protocol.Writer, id string, err error) {
+	data := protocol.ErrorData{Message: err.Error()}
+	var rl *rateLimitedError
+	if errors.As(err, &rl) {
+		data.Code = "rate_limited"
+		data.RetryAfter = int(rl.RetryAfter.Round(time.Second) / time.Second)
+	}
+	_ = writer.SendTyped("error", id, data)
+}
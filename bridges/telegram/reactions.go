@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/tg"
+)
+
+// convertReactions aggregates Telegram message reactions into protocol form.
+// Custom emoji are reported as "custom:<document id>".
+func convertReactions(r tg.MessageReactions) []protocol.Reaction {
+	out := make([]protocol.Reaction, 0, len(r.Results))
+	for _, rc := range r.Results {
+		var emoji string
+		switch re := rc.Reaction.(type) {
+		case *tg.ReactionEmoji:
+			emoji = re.Emoticon
+		case *tg.ReactionCustomEmoji:
+			emoji = "custom:" + strconv.FormatInt(re.DocumentID, 10)
+		case *tg.ReactionPaid:
+			emoji = "⭐"
+		default:
+			continue
+		}
+		_, chosen := rc.GetChosenOrder()
+		out = append(out, protocol.Reaction{
+			Emoji:  emoji,
+			Count:  rc.Count,
+			FromMe: chosen,
+		})
+	}
+	return out
+}
+
+// messageReactions returns the aggregated reactions of msg, if any.
+func messageReactions(msg *tg.Message) []protocol.Reaction {
+	r, ok := msg.GetReactions()
+	if !ok {
+		return nil
+	}
+	return convertReactions(r)
+}
+
+// emitReactionsChanged emits message.reactions_changed for a message.
+func emitReactionsChanged(client *tgClient, chatID string, msgID int, r tg.MessageReactions) {
+	if err := client.writer.SendTyped("message.reactions_changed", "", protocol.ReactionsChanged{
+		ChatID:    chatID,
+		MessageID: strconv.Itoa(msgID),
+		Reactions: convertReactions(r),
+	}); err != nil {
+		log.Printf("[update] emit message.reactions_changed: %v\n", err)
+	}
+}
+
+// handleReact sets (message.react) or clears (message.unreact, empty emoji)
+// our reaction on a message. Telegram replaces our whole reaction set.
+func handleReact(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.ReactRequest) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	msgID, err := strconv.Atoi(req.MessageID)
+	if err != nil {
+		_ = writer.SendTyped("error", id, map[string]string{"message": fmt.Sprintf("invalid message id %q", req.MessageID)})
+		return
+	}
+
+	var reaction []tg.ReactionClass
+	if req.Emoji != "" {
+		reaction = []tg.ReactionClass{&tg.ReactionEmoji{Emoticon: req.Emoji}}
+	}
+
+	api := client.tg.API()
+	result, err := api.MessagesSendReaction(ctx, &tg.MessagesSendReactionRequest{
+		Peer:     peer,
+		MsgID:    msgID,
+		Reaction: reaction,
+	})
+	if err != nil {
+		log.Printf("[chats] SendReaction error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	out := protocol.ReactionsChanged{ChatID: req.ChatID, MessageID: req.MessageID}
+	if r, ok := result.(*tg.Updates); ok {
+		for _, u := range r.Updates {
+			if mr, ok := u.(*tg.UpdateMessageReactions); ok && mr.MsgID == msgID {
+				out.Reactions = convertReactions(mr.Reactions)
+			}
+		}
+	}
+	_ = writer.SendTyped("message.reactions_changed", id, out)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/tg"
+)
+
+// handleSearch runs a server-side message search and emits messages.search.
+// With a chat ID it uses messages.search (which also supports a sender
+// filter); without one it uses messages.searchGlobal.
+func handleSearch(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.SearchRequest) {
+	filter, err := searchFilter(req.Media)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	var (
+		result tg.MessagesMessagesClass
+		next   string
+	)
+	if req.ChatID != "" {
+		result, next, err = searchChat(ctx, client, req, filter, limit)
+	} else {
+		result, next, err = searchGlobal(ctx, client, req, filter, limit)
+	}
+	if err != nil {
+		log.Printf("[search] error: %v\n", err)
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	client.peers.rememberMessages(result)
+	messages := extractMessages(ctx, client, result, req.ChatID)
+	if messages == nil {
+		messages = []protocol.Message{}
+	}
+	_ = writer.SendTyped("messages.search", id, protocol.SearchResponse{
+		Messages:   messages,
+		NextCursor: next,
+	})
+}
+
+// searchChat searches a single chat. The cursor is the oldest message ID of
+// the previous page, as for chat history.
+func searchChat(ctx context.Context, client *tgClient, req protocol.SearchRequest, filter tg.MessagesFilterClass, limit int) (tg.MessagesMessagesClass, string, error) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		return nil, "", err
+	}
+	offsetID, err := parseCursor(req.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	search := &tg.MessagesSearchRequest{
+		Peer:     peer,
+		Q:        req.Query,
+		Filter:   filter,
+		MinDate:  int(req.After),
+		MaxDate:  int(req.Before),
+		OffsetID: offsetID,
+		Limit:    limit,
+	}
+	if req.From != "" {
+		from, err := client.inputPeer(req.From)
+		if err != nil {
+			return nil, "", err
+		}
+		search.SetFromID(from)
+	}
+
+	result, err := client.tg.API().MessagesSearch(ctx, search)
+	if err != nil {
+		return nil, "", err
+	}
+	return result, historyCursor(result, limit), nil
+}
+
+// searchGlobal searches across all chats. Telegram pages global results by
+// (next_rate, peer, id), which the cursor encodes as "rate/chatID/msgID".
+func searchGlobal(ctx context.Context, client *tgClient, req protocol.SearchRequest, filter tg.MessagesFilterClass, limit int) (tg.MessagesMessagesClass, string, error) {
+	if req.From != "" {
+		return nil, "", fmt.Errorf("sender filter requires chat_id on Telegram")
+	}
+
+	search := &tg.MessagesSearchGlobalRequest{
+		Q:          req.Query,
+		Filter:     filter,
+		MinDate:    int(req.After),
+		MaxDate:    int(req.Before),
+		OffsetPeer: &tg.InputPeerEmpty{},
+		Limit:      limit,
+	}
+	if req.Cursor != "" {
+		parts := strings.SplitN(req.Cursor, "/", 3)
+		if len(parts) != 3 {
+			return nil, "", fmt.Errorf("invalid cursor %q", req.Cursor)
+		}
+		rate, err1 := strconv.Atoi(parts[0])
+		peer, err2 := client.inputPeer(parts[1])
+		offsetID, err3 := strconv.Atoi(parts[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", req.Cursor)
+		}
+		search.OffsetRate = rate
+		search.OffsetPeer = peer
+		search.OffsetID = offsetID
+	}
+
+	result, err := client.tg.API().MessagesSearchGlobal(ctx, search)
+	if err != nil {
+		return nil, "", err
+	}
+
+	slice, ok := result.(*tg.MessagesMessagesSlice)
+	if !ok || len(slice.Messages) < limit {
+		return result, "", nil
+	}
+	last, ok := slice.Messages[len(slice.Messages)-1].(*tg.Message)
+	if !ok {
+		return result, "", nil
+	}
+	rate, _ := slice.GetNextRate()
+	next := fmt.Sprintf("%d/%s/%d", rate, peerToChatID(last.PeerID), last.ID)
+	return result, next, nil
+}
+
+// searchFilter maps a protocol media type to a Telegram search filter.
+func searchFilter(media string) (tg.MessagesFilterClass, error) {
+	switch media {
+	case "":
+		return &tg.InputMessagesFilterEmpty{}, nil
+	case "photo":
+		return &tg.InputMessagesFilterPhotos{}, nil
+	case "video":
+		return &tg.InputMessagesFilterVideo{}, nil
+	case "audio":
+		return &tg.InputMessagesFilterMusic{}, nil
+	case "voice":
+		return &tg.InputMessagesFilterVoice{}, nil
+	case "document":
+		return &tg.InputMessagesFilterDocument{}, nil
+	case "link":
+		return &tg.InputMessagesFilterURL{}, nil
+	}
+	return nil, fmt.Errorf("unsupported media filter %q", media)
+}
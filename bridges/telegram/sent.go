@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gotd/td/tg"
+)
+
+// sentTTL bounds how long a sent message is remembered for deduplication.
+const sentTTL = 10 * time.Minute
+
+// sentTracker remembers messages sent from Switchboard so that their echo
+// arriving through the update stream is not reported again as a message
+// authored on another device.
+type sentTracker struct {
+	mu sync.Mutex
+	// pending maps random_id → chat ID until the server assigns a message ID.
+	pending map[int64]string
+	// sent holds "chatID/msgID" keys of messages we sent, with the time recorded.
+	sent map[string]time.Time
+}
+
+// newSentTracker creates an empty sentTracker.
+func newSentTracker() *sentTracker {
+	return &sentTracker{
+		pending: make(map[int64]string),
+		sent:    make(map[string]time.Time),
+	}
+}
+
+// expect records that a message with randomID is about to be sent to chatID.
+func (t *sentTracker) expect(randomID int64, chatID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending[randomID] = chatID
+}
+
+// cancel drops a pending randomID whose send failed.
+func (t *sentTracker) cancel(randomID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, randomID)
+}
+
+// resolve maps a pending randomID to the server-assigned message ID.
+func (t *sentTracker) resolve(randomID int64, msgID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	chatID, ok := t.pending[randomID]
+	if !ok {
+		return
+	}
+	delete(t.pending, randomID)
+	t.markLocked(chatID, msgID)
+}
+
+// mark records msgID in chatID as sent by us.
+func (t *sentTracker) mark(chatID string, msgID int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.markLocked(chatID, msgID)
+}
+
+func (t *sentTracker) markLocked(chatID string, msgID int) {
+	now := time.Now()
+	for k, at := range t.sent {
+		if now.Sub(at) > sentTTL {
+			delete(t.sent, k)
+		}
+	}
+	t.sent[chatID+"/"+strconv.Itoa(msgID)] = now
+}
+
+// isOwn reports whether msgID in chatID was sent from Switchboard.
+func (t *sentTracker) isOwn(chatID string, msgID int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.sent[chatID+"/"+strconv.Itoa(msgID)]
+	return ok
+}
+
+// sentMessageID extracts the ID of the message created by a send request,
+// matching UpdateMessageID entries against randomID. Returns 0 if not found.
+func sentMessageID(u tg.UpdatesClass, randomID int64) int {
+	switch r := u.(type) {
+	case *tg.UpdateShortSentMessage:
+		return r.ID
+	case *tg.Updates:
+		for _, upd := range r.Updates {
+			if m, ok := upd.(*tg.UpdateMessageID); ok && m.RandomID == randomID {
+				return m.ID
+			}
+		}
+	}
+	return 0
+}
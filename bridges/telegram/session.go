@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/session"
+)
+
+// sessionStorage adapts a protocol.SessionStore entry to gotd's
+// session.Storage, so the auth key can be encrypted at rest.
+type sessionStorage struct {
+	store protocol.SessionStore
+	name  string
+}
+
+var _ session.Storage = (*sessionStorage)(nil)
+
+// LoadSession returns the stored session, or session.ErrNotFound.
+func (s *sessionStorage) LoadSession(_ context.Context) ([]byte, error) {
+	b, err := s.store.Load(s.name)
+	if errors.Is(err, protocol.ErrSessionNotFound) {
+		return nil, session.ErrNotFound
+	}
+	return b, err
+}
+
+// StoreSession replaces the stored session.
+func (s *sessionStorage) StoreSession(_ context.Context, data []byte) error {
+	return s.store.Save(s.name, data)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/tg"
+)
+
+// generalTopic is the ID of a forum's General topic, which, unlike the
+// others, was not created by a message.
+const generalTopic = "1"
+
+// Topic listing and General history are fetched in pages of topicsPageSize
+// and historyScanSize. A General page scans at most generalScanPages of
+// history, as the rest of the forum's messages are skipped.
+const (
+	topicsPageSize   = 100
+	historyScanSize  = 100
+	generalScanPages = 5
+)
+
+// handleChatTopics lists the topics of a forum group and emits chat.topics.
+func handleChatTopics(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.TopicsRequest) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+	if _, ok := peer.(*tg.InputPeerChannel); !ok {
+		sendRPCError(writer, id, fmt.Errorf("%s is not a forum", req.ChatID))
+		return
+	}
+
+	resp := protocol.TopicsResponse{ChatID: req.ChatID, Topics: []protocol.Topic{}}
+	page := &tg.MessagesGetForumTopicsRequest{Peer: peer, Limit: topicsPageSize}
+	for {
+		result, err := client.tg.API().MessagesGetForumTopics(ctx, page)
+		if err != nil {
+			log.Printf("[chats] GetForumTopics error: %v\n", err)
+			sendRPCError(writer, id, err)
+			return
+		}
+		client.peers.remember(result.Users, result.Chats)
+
+		lastTime := make(map[int]int64, len(result.Messages))
+		for _, m := range result.Messages {
+			if msg, ok := m.(*tg.Message); ok {
+				lastTime[msg.ID] = int64(msg.Date)
+			}
+		}
+		for _, t := range result.Topics {
+			topic, ok := t.(*tg.ForumTopic)
+			if !ok || topic.Hidden {
+				continue
+			}
+			resp.Topics = append(resp.Topics, protocol.Topic{
+				ID:          strconv.Itoa(topic.ID),
+				Title:       topic.Title,
+				UnreadCount: topic.UnreadCount,
+				LastTime:    lastTime[topic.TopMessage],
+				Pinned:      topic.Pinned,
+				Closed:      topic.Closed,
+			})
+		}
+
+		// The next page starts after the last topic, by its last message.
+		if len(result.Topics) < topicsPageSize {
+			break
+		}
+		last, ok := result.Topics[len(result.Topics)-1].(*tg.ForumTopic)
+		if !ok || last.ID == page.OffsetTopic {
+			break
+		}
+		page.OffsetTopic = last.ID
+		page.OffsetID = last.TopMessage
+		page.OffsetDate = int(lastTime[last.TopMessage])
+	}
+	_ = writer.SendTyped("chat.topics", id, resp)
+}
+
+// generalHistory fetches a page of a forum's General topic older than
+// offsetID. The topic has no thread to fetch, so the forum's history is
+// scanned for its messages; the cursor continues the scan.
+func generalHistory(ctx context.Context, api *tg.Client, peer tg.InputPeerClass, offsetID, limit int) (tg.MessagesMessagesClass, string, error) {
+	page := &tg.MessagesMessages{}
+	for range generalScanPages {
+		result, err := api.MessagesGetHistory(ctx, &tg.MessagesGetHistoryRequest{
+			Peer:     peer,
+			OffsetID: offsetID,
+			Limit:    historyScanSize,
+		})
+		if err != nil {
+			return nil, "", err
+		}
+		modified, ok := result.AsModified()
+		if !ok {
+			return page, "", nil
+		}
+		page.Users = append(page.Users, modified.GetUsers()...)
+		page.Chats = append(page.Chats, modified.GetChats()...)
+
+		raw := modified.GetMessages()
+		for _, m := range raw {
+			offsetID = m.GetID()
+			if msg, ok := m.(*tg.Message); ok && messageTopic(msg, true) == generalTopic {
+				page.Messages = append(page.Messages, m)
+				if len(page.Messages) == limit {
+					return page, strconv.Itoa(offsetID), nil
+				}
+			}
+		}
+		if len(raw) < historyScanSize {
+			return page, "", nil
+		}
+	}
+	return page, strconv.Itoa(offsetID), nil
+}
+
+// messageTopic returns the forum topic of a message in a chat that is a
+// forum or not: "" outside forums, and generalTopic for messages without a
+// topic reply header, which belong to the General topic.
+func messageTopic(msg *tg.Message, forum bool) string {
+	header, ok := msg.ReplyTo.(*tg.MessageReplyHeader)
+	if !ok || !header.ForumTopic {
+		if forum {
+			return generalTopic
+		}
+		return ""
+	}
+	if header.ReplyToTopID != 0 {
+		return strconv.Itoa(header.ReplyToTopID)
+	}
+	return strconv.Itoa(header.ReplyToMsgID)
+}
+
+// replyHeader builds the reply_to of a message sent as a reply to replyTo,
+// into the forum topic topicID, or both. It returns nil when neither is set.
+// Messages of the General topic are posted without a topic, as in any group.
+func replyHeader(replyTo, topicID string) (tg.InputReplyToClass, error) {
+	var msgID, topID int
+	var err error
+	if replyTo != "" {
+		if msgID, err = strconv.Atoi(replyTo); err != nil {
+			return nil, fmt.Errorf("invalid message id %q", replyTo)
+		}
+	}
+	if topicID != "" && topicID != generalTopic {
+		if topID, err = strconv.Atoi(topicID); err != nil {
+			return nil, fmt.Errorf("invalid topic id %q", topicID)
+		}
+	}
+
+	switch {
+	case msgID != 0 && topID != 0:
+		return &tg.InputReplyToMessage{ReplyToMsgID: msgID, TopMsgID: topID}, nil
+	case msgID != 0:
+		return &tg.InputReplyToMessage{ReplyToMsgID: msgID}, nil
+	case topID != 0:
+		// Posting in a topic is replying to the message that created it.
+		return &tg.InputReplyToMessage{ReplyToMsgID: topID}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/tg"
+)
+
+// typingTTL is how long Telegram keeps a typing action alive without a repeat.
+const typingTTL = 6 * time.Second
+
+// emitTyping starts or stops the typing indicator for from in chatID.
+func emitTyping(client *tgClient, chatID, from string, action tg.SendMessageActionClass) {
+	name, active := typingAction(action)
+	var err error
+	if active {
+		err = client.typing.Start(chatID, from, name, typingTTL)
+	} else {
+		err = client.typing.Stop(chatID, from)
+	}
+	if err != nil {
+		log.Printf("[update] emit typing: %v\n", err)
+	}
+}
+
+// typingAction maps a Telegram send-message action to the protocol action
+// name. The second result is false for actions that end the indicator.
+func typingAction(action tg.SendMessageActionClass) (string, bool) {
+	switch action.(type) {
+	case *tg.SendMessageTypingAction:
+		return "typing", true
+	case *tg.SendMessageRecordAudioAction, *tg.SendMessageRecordRoundAction, *tg.SendMessageRecordVideoAction:
+		return "recording", true
+	case *tg.SendMessageUploadPhotoAction, *tg.SendMessageUploadVideoAction,
+		*tg.SendMessageUploadAudioAction, *tg.SendMessageUploadDocumentAction,
+		*tg.SendMessageUploadRoundAction:
+		return "uploading", true
+	case *tg.SendMessageCancelAction:
+		return "", false
+	}
+	// Other actions (choosing a sticker, playing a game, …) still mean the
+	// user is busy composing something.
+	return "typing", true
+}
+
+// emitPresence emits a presence event for userID from a Telegram user status.
+func emitPresence(client *tgClient, userID int64, status tg.UserStatusClass) {
+	p := protocol.Presence{UserID: strconv.FormatInt(userID, 10)}
+	switch s := status.(type) {
+	case *tg.UserStatusOnline:
+		p.Online = true
+	case *tg.UserStatusOffline:
+		p.LastSeen = int64(s.WasOnline)
+	default:
+		// Recently / last week / last month: the user hides exact times.
+	}
+	if err := client.writer.SendTyped("presence", "", p); err != nil {
+		log.Printf("[update] emit presence: %v\n", err)
+	}
+}
+
+// peerIDString formats the sender of a typing update as a user/chat ID.
+func peerIDString(peer tg.PeerClass) string {
+	if pu, ok := peer.(*tg.PeerUser); ok {
+		return strconv.FormatInt(pu.UserID, 10)
+	}
+	return peerToChatID(peer)
+}
+
+// handleSetTyping shows or clears our typing indicator in a chat.
+func handleSetTyping(ctx context.Context, client *tgClient, writer *protocol.Writer, id string, req protocol.TypingRequest) {
+	peer, err := client.inputPeer(req.ChatID)
+	if err != nil {
+		sendRPCError(writer, id, err)
+		return
+	}
+
+	var action tg.SendMessageActionClass = &tg.SendMessageCancelAction{}
+	if req.Typing {
+		action = &tg.SendMessageTypingAction{}
+	}
+
+	api := client.tg.API()
+	if _, err := api.MessagesSetTyping(ctx, &tg.MessagesSetTypingRequest{
+		Peer:   peer,
+		Action: action,
+	}); err != nil {
+		log.Printf("[chats] SetTyping error: %v\n", err)
+		sendRPCError(writer, id, err)
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/telegram/updates"
+	"github.com/gotd/td/tg"
+)
+
+// registerUpdateHandlers wires all update handlers into the dispatcher.
+// Ordering and gap recovery (pts/qts/seq, including per-channel pts) are
+// handled upstream by the updates manager, so handlers only emit events.
+func registerUpdateHandlers(dispatcher tg.UpdateDispatcher, client *tgClient) {
+	dispatcher.OnMessageID(func(_ context.Context, _ tg.Entities, u *tg.UpdateMessageID) error {
+		client.sent.resolve(u.RandomID, u.ID)
+		return nil
+	})
+
+	dispatcher.OnNewMessage(func(_ context.Context, _ tg.Entities, u *tg.UpdateNewMessage) error {
+		if msg, ok := u.Message.(*tg.Message); ok {
+			emitNewMessage(client, msg)
+		}
+		return nil
+	})
+
+	dispatcher.OnNewChannelMessage(func(_ context.Context, _ tg.Entities, u *tg.UpdateNewChannelMessage) error {
+		if msg, ok := u.Message.(*tg.Message); ok {
+			emitNewMessage(client, msg)
+		}
+		return nil
+	})
+
+	dispatcher.OnEditMessage(func(_ context.Context, _ tg.Entities, u *tg.UpdateEditMessage) error {
+		if msg, ok := u.Message.(*tg.Message); ok {
+			emitEditedMessage(client, msg)
+		}
+		return nil
+	})
+
+	dispatcher.OnDeleteMessages(func(_ context.Context, _ tg.Entities, u *tg.UpdateDeleteMessages) error {
+		// Private chat and basic group message IDs are account-wide, so
+		// Telegram does not say which chat they belonged to.
+		emitDeletedMessages(client, "", u.Messages)
+		return nil
+	})
+
+	dispatcher.OnReadHistoryOutbox(func(_ context.Context, _ tg.Entities, u *tg.UpdateReadHistoryOutbox) error {
+		emitReadReceipt(client, peerToChatID(u.Peer), u.MaxID)
+		return nil
+	})
+
+	dispatcher.OnReadChannelOutbox(func(_ context.Context, _ tg.Entities, u *tg.UpdateReadChannelOutbox) error {
+		emitReadReceipt(client, "ch_"+strconv.FormatInt(u.ChannelID, 10), u.MaxID)
+		return nil
+	})
+
+	dispatcher.OnReadHistoryInbox(func(_ context.Context, _ tg.Entities, u *tg.UpdateReadHistoryInbox) error {
+		emitUnreadChanged(client, peerToChatID(u.Peer), u.StillUnreadCount)
+		return nil
+	})
+
+	dispatcher.OnReadChannelInbox(func(_ context.Context, _ tg.Entities, u *tg.UpdateReadChannelInbox) error {
+		emitUnreadChanged(client, "ch_"+strconv.FormatInt(u.ChannelID, 10), u.StillUnreadCount)
+		return nil
+	})
+
+	dispatcher.OnUserTyping(func(_ context.Context, _ tg.Entities, u *tg.UpdateUserTyping) error {
+		userID := strconv.FormatInt(u.UserID, 10)
+		emitTyping(client, userID, userID, u.Action)
+		return nil
+	})
+
+	dispatcher.OnChatUserTyping(func(_ context.Context, _ tg.Entities, u *tg.UpdateChatUserTyping) error {
+		emitTyping(client, "c_"+strconv.FormatInt(u.ChatID, 10), peerIDString(u.FromID), u.Action)
+		return nil
+	})
+
+	dispatcher.OnChannelUserTyping(func(_ context.Context, _ tg.Entities, u *tg.UpdateChannelUserTyping) error {
+		emitTyping(client, "ch_"+strconv.FormatInt(u.ChannelID, 10), peerIDString(u.FromID), u.Action)
+		return nil
+	})
+
+	dispatcher.OnUserStatus(func(_ context.Context, _ tg.Entities, u *tg.UpdateUserStatus) error {
+		emitPresence(client, u.UserID, u.Status)
+		return nil
+	})
+
+	dispatcher.OnMessageReactions(func(_ context.Context, _ tg.Entities, u *tg.UpdateMessageReactions) error {
+		emitReactionsChanged(client, peerToChatID(u.Peer), u.MsgID, u.Reactions)
+		return nil
+	})
+
+	dispatcher.OnEditChannelMessage(func(_ context.Context, _ tg.Entities, u *tg.UpdateEditChannelMessage) error {
+		if msg, ok := u.Message.(*tg.Message); ok {
+			emitEditedMessage(client, msg)
+		}
+		return nil
+	})
+
+	dispatcher.OnNotifySettings(func(_ context.Context, _ tg.Entities, u *tg.UpdateNotifySettings) error {
+		emitMuteChanged(client, u.Peer, u.NotifySettings)
+		return nil
+	})
+
+	dispatcher.OnDialogFilter(func(_ context.Context, _ tg.Entities, _ *tg.UpdateDialogFilter) error {
+		go emitFoldersChanged(client)
+		return nil
+	})
+
+	dispatcher.OnDialogFilters(func(_ context.Context, _ tg.Entities, _ *tg.UpdateDialogFilters) error {
+		go emitFoldersChanged(client)
+		return nil
+	})
+
+	dispatcher.OnDialogFilterOrder(func(_ context.Context, _ tg.Entities, _ *tg.UpdateDialogFilterOrder) error {
+		go emitFoldersChanged(client)
+		return nil
+	})
+
+	dispatcher.OnDialogPinned(func(_ context.Context, _ tg.Entities, u *tg.UpdateDialogPinned) error {
+		if id := dialogPeerChatID(u.Peer); id != "" {
+			emitChatsChanged(client, id)
+		}
+		return nil
+	})
+
+	dispatcher.OnPinnedDialogs(func(_ context.Context, _ tg.Entities, u *tg.UpdatePinnedDialogs) error {
+		var ids []string
+		for _, p := range u.Order {
+			if id := dialogPeerChatID(p); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		emitChatsChanged(client, ids...)
+		return nil
+	})
+
+	dispatcher.OnFolderPeers(func(_ context.Context, _ tg.Entities, u *tg.UpdateFolderPeers) error {
+		ids := make([]string, 0, len(u.FolderPeers))
+		for _, fp := range u.FolderPeers {
+			ids = append(ids, peerToChatID(fp.Peer))
+		}
+		emitChatsChanged(client, ids...)
+		return nil
+	})
+
+	dispatcher.OnDeleteChannelMessages(func(_ context.Context, _ tg.Entities, u *tg.UpdateDeleteChannelMessages) error {
+		emitDeletedMessages(client, "ch_"+strconv.FormatInt(u.ChannelID, 10), u.Messages)
+		return nil
+	})
+}
+
+// runUpdates starts the gap-recovering updates manager for the authorized
+// user. On start the manager calls updates.getDifference (and
+// getChannelDifference per known channel) against the persisted state and
+// replays anything missed through the dispatcher. It blocks until ctx ends
+// or haltUpdates is called.
+func (c *tgClient) runUpdates(ctx context.Context, userID int64) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	defer close(done)
+	c.updatesMu.Lock()
+	c.stopUpdates = func() {
+		cancel()
+		<-done
+	}
+	c.updatesMu.Unlock()
+
+	err := c.gaps.Run(ctx, c.tg.API(), userID, updates.AuthOptions{
+		OnStart: func(context.Context) {
+			log.Printf("[update] updates manager started for user %d\n", userID)
+		},
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("[update] updates manager: %v\n", err)
+	}
+}
+
+// haltUpdates stops the updates manager, if running, waits for it to exit and
+// resets it so a later login can run it again.
+func (c *tgClient) haltUpdates() {
+	c.updatesMu.Lock()
+	stop := c.stopUpdates
+	c.stopUpdates = nil
+	c.updatesMu.Unlock()
+	if stop != nil {
+		stop()
+	}
+	c.gaps.Reset()
+}
+
+// emitNewMessage emits message.new for msg. Outgoing messages are reported
+// only when they were sent from another device, and never notify.
+func emitNewMessage(client *tgClient, msg *tg.Message) {
+	chatID := peerToChatID(msg.PeerID)
+	pm := buildIncomingMessage(msg, chatID, client.peers.forum(msg.PeerID))
+	if msg.Out {
+		if client.sent.isOwn(chatID, msg.ID) {
+			return
+		}
+		pm.From = "me"
+		if err := client.writer.SendTyped("message.new", "", pm); err != nil {
+			log.Printf("[update] emit message.new: %v\n", err)
+		}
+		return
+	}
+	if err := client.writer.SendTyped("message.new", "", pm); err != nil {
+		log.Printf("[update] emit message.new: %v\n", err)
+	}
+	// The mute lookup may make a request, which must not hold up updates.
+	go notifyMessage(client, msg, pm)
+}
+
+// notifyMessage emits the notification for an incoming message. Unless a
+// rule decides otherwise, muted chats only notify, silently, when we are
+// mentioned or replied to.
+func notifyMessage(client *tgClient, msg *tg.Message, pm protocol.Message) {
+	chatID := pm.ChatID
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	muted := client.mutes.muted(ctx, client, chatID)
+	notif := protocol.Notification{
+		Title:     "Telegram",
+		Body:      pm.Text,
+		Service:   "telegram",
+		ChatID:    chatID,
+		Sender:    messageSender(msg),
+		Mentioned: msg.Mentioned,
+		Silent:    muted,
+	}
+	if client.rules.Apply(&notif, muted) {
+		_ = client.writer.SendTyped("notification", "", notif)
+	}
+}
+
+// emitEditedMessage emits message.edited carrying the updated content of msg.
+func emitEditedMessage(client *tgClient, msg *tg.Message) {
+	pm := buildIncomingMessage(msg, peerToChatID(msg.PeerID), client.peers.forum(msg.PeerID))
+	if err := client.writer.SendTyped("message.edited", "", pm); err != nil {
+		log.Printf("[update] emit message.edited: %v\n", err)
+	}
+}
+
+// emitDeletedMessages emits message.deleted for the given message IDs.
+func emitDeletedMessages(client *tgClient, chatID string, ids []int) {
+	out := protocol.MessageDeleted{
+		ChatID:     chatID,
+		MessageIDs: make([]string, 0, len(ids)),
+	}
+	for _, id := range ids {
+		out.MessageIDs = append(out.MessageIDs, strconv.Itoa(id))
+	}
+	if err := client.writer.SendTyped("message.deleted", "", out); err != nil {
+		log.Printf("[update] emit message.deleted: %v\n", err)
+	}
+}
+
+// emitReadReceipt emits a receipt saying our messages in chatID up to maxID
+// have been read by the other side.
+func emitReadReceipt(client *tgClient, chatID string, maxID int) {
+	if err := client.writer.SendTyped("receipt", "", protocol.Receipt{
+		ChatID:     chatID,
+		MessageIDs: []string{strconv.Itoa(maxID)},
+		Status:     "read",
+		UpTo:       true,
+		Timestamp:  time.Now().Unix(),
+	}); err != nil {
+		log.Printf("[update] emit receipt: %v\n", err)
+	}
+}
+
+// emitUnreadChanged emits chat.unread_changed after a chat was read elsewhere.
+func emitUnreadChanged(client *tgClient, chatID string, unread int) {
+	if err := client.writer.SendTyped("chat.unread_changed", "", protocol.UnreadChanged{
+		ChatID:      chatID,
+		UnreadCount: unread,
+	}); err != nil {
+		log.Printf("[update] emit chat.unread_changed: %v\n", err)
+	}
+}
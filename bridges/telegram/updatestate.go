@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/gotd/td/telegram/updates"
+)
+
+// fileUpdateStorage persists the gotd update state (pts/qts/date/seq),
+// per-channel pts and channel access hashes as a JSON session store entry,
+// so missed updates can be recovered via getDifference after a restart.
+// It implements both updates.StateStorage and updates.ChannelAccessHasher.
+//
+// pts, qts, date and seq change with almost every update, so their writes
+// are batched: they are saved updateStateSaveDelay after the first change,
+// or by flush on shutdown.
+type fileUpdateStorage struct {
+	mu    sync.Mutex
+	store protocol.SessionStore
+	name  string
+	users map[string]*userUpdateState
+	// pending is the timer of a batched save, nil when none is scheduled.
+	pending *time.Timer
+}
+
+// updateStateSaveDelay is how long pts changes wait to be saved together.
+const updateStateSaveDelay = 2 * time.Second
+
+// userUpdateState is the persisted update state of a single account.
+type userUpdateState struct {
+	State        updates.State    `json:"state"`
+	HasState     bool             `json:"has_state"`
+	Channels     map[string]int   `json:"channels"`
+	AccessHashes map[string]int64 `json:"access_hashes"`
+}
+
+var (
+	_ updates.StateStorage        = (*fileUpdateStorage)(nil)
+	_ updates.ChannelAccessHasher = (*fileUpdateStorage)(nil)
+)
+
+// newFileUpdateStorage loads the update state stored under name. A missing
+// entry yields empty state; a corrupt one is logged by the caller and discarded.
+func newFileUpdateStorage(store protocol.SessionStore, name string) (*fileUpdateStorage, error) {
+	s := &fileUpdateStorage{
+		store: store,
+		name:  name,
+		users: make(map[string]*userUpdateState),
+	}
+	b, err := store.Load(name)
+	if errors.Is(err, protocol.ErrSessionNotFound) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("read update state: %w", err)
+	}
+	if err := json.Unmarshal(b, &s.users); err != nil {
+		s.users = make(map[string]*userUpdateState)
+		return s, fmt.Errorf("parse update state: %w", err)
+	}
+	return s, nil
+}
+
+// user returns the state entry for userID, creating it if needed.
+// Callers must hold s.mu.
+func (s *fileUpdateStorage) user(userID int64) *userUpdateState {
+	key := strconv.FormatInt(userID, 10)
+	u, ok := s.users[key]
+	if !ok {
+		u = &userUpdateState{}
+		s.users[key] = u
+	}
+	if u.Channels == nil {
+		u.Channels = make(map[string]int)
+	}
+	if u.AccessHashes == nil {
+		u.AccessHashes = make(map[string]int64)
+	}
+	return u
+}
+
+// save writes the current state to the session store, superseding any
+// batched save. Callers must hold s.mu.
+func (s *fileUpdateStorage) save() error {
+	if s.pending != nil {
+		s.pending.Stop()
+		s.pending = nil
+	}
+	b, err := json.Marshal(s.users)
+	if err != nil {
+		return fmt.Errorf("marshal update state: %w", err)
+	}
+	if err := s.store.Save(s.name, b); err != nil {
+		return fmt.Errorf("write update state: %w", err)
+	}
+	return nil
+}
+
+// saveLater schedules a batched save, if none is pending. Callers must hold
+// s.mu.
+func (s *fileUpdateStorage) saveLater() {
+	if s.pending != nil {
+		return
+	}
+	s.pending = time.AfterFunc(updateStateSaveDelay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.save(); err != nil {
+			log.Printf("[update] %v\n", err)
+		}
+	})
+}
+
+// flush writes a pending batched save now.
+func (s *fileUpdateStorage) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pending == nil {
+		return nil
+	}
+	return s.save()
+}
+
+// update applies fn to an existing user state and schedules a batched save.
+func (s *fileUpdateStorage) update(userID int64, fn func(u *userUpdateState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userID)
+	if !u.HasState {
+		return fmt.Errorf("update state for user %d not found", userID)
+	}
+	fn(u)
+	s.saveLater()
+	return nil
+}
+
+// forget drops all state stored for userID, including channel access hashes.
+func (s *fileUpdateStorage) forget(userID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, strconv.FormatInt(userID, 10))
+	return s.save()
+}
+
+// GetState returns the stored common update state.
+func (s *fileUpdateStorage) GetState(_ context.Context, userID int64) (updates.State, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userID)
+	return u.State, u.HasState, nil
+}
+
+// SetState replaces the common update state and resets channel pts.
+func (s *fileUpdateStorage) SetState(_ context.Context, userID int64, state updates.State) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.user(userID)
+	u.State = state
+	u.HasState = true
+	u.Channels = make(map[string]int)
+	return s.save()
+}
+
+// SetPts stores the common pts.
+func (s *fileUpdateStorage) SetPts(_ context.Context, userID int64, pts int) error {
+	return s.update(userID, func(u *userUpdateState) { u.State.Pts = pts })
+}
+
+// SetQts stores the common qts.
+func (s *fileUpdateStorage) SetQts(_ context.Context, userID int64, qts int) error {
+	return s.update(userID, func(u *userUpdateState) { u.State.Qts = qts })
+}
+
+// SetDate stores the common date.
+func (s *fileUpdateStorage) SetDate(_ context.Context, userID int64, date int) error {
+	return s.update(userID, func(u *userUpdateState) { u.State.Date = date })
+}
+
+// SetSeq stores the common seq.
+func (s *fileUpdateStorage) SetSeq(_ context.Context, userID int64, seq int) error {
+	return s.update(userID, func(u *userUpdateState) { u.State.Seq = seq })
+}
+
+// SetDateSeq stores the common date and seq together.
+func (s *fileUpdateStorage) SetDateSeq(_ context.Context, userID int64, date, seq int) error {
+	return s.update(userID, func(u *userUpdateState) {
+		u.State.Date = date
+		u.State.Seq = seq
+	})
+}
+
+// GetChannelPts returns the stored pts of a channel.
+func (s *fileUpdateStorage) GetChannelPts(_ context.Context, userID, channelID int64) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pts, ok := s.user(userID).Channels[strconv.FormatInt(channelID, 10)]
+	return pts, ok, nil
+}
+
+// SetChannelPts stores the pts of a channel.
+func (s *fileUpdateStorage) SetChannelPts(_ context.Context, userID, channelID int64, pts int) error {
+	return s.update(userID, func(u *userUpdateState) {
+		u.Channels[strconv.FormatInt(channelID, 10)] = pts
+	})
+}
+
+// ForEachChannels calls f for every channel with a stored pts.
+func (s *fileUpdateStorage) ForEachChannels(ctx context.Context, userID int64, f func(ctx context.Context, channelID int64, pts int) error) error {
+	s.mu.Lock()
+	channels := make(map[int64]int, len(s.user(userID).Channels))
+	for k, pts := range s.user(userID).Channels {
+		id, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			continue
+		}
+		channels[id] = pts
+	}
+	s.mu.Unlock()
+
+	for id, pts := range channels {
+		if err := f(ctx, id, pts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetChannelAccessHash returns the stored access hash of a channel.
+func (s *fileUpdateStorage) GetChannelAccessHash(_ context.Context, userID, channelID int64) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash, ok := s.user(userID).AccessHashes[strconv.FormatInt(channelID, 10)]
+	return hash, ok, nil
+}
+
+// SetChannelAccessHash stores the access hash of a channel.
+func (s *fileUpdateStorage) SetChannelAccessHash(_ context.Context, userID, channelID, accessHash int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user(userID).AccessHashes[strconv.FormatInt(channelID, 10)] = accessHash
+	return s.save()
+}
+
+// channelAccessHash returns the stored access hash of a channel for any
+// account; only the signed-in one has state, as logging out forgets it.
+func (s *fileUpdateStorage) channelAccessHash(channelID int64) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strconv.FormatInt(channelID, 10)
+	for _, u := range s.users {
+		if hash, ok := u.AccessHashes[key]; ok {
+			return hash, true
+		}
+	}
+	return 0, false
+}
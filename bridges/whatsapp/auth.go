@@ -4,74 +4,256 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 
 	"github.com/aigustalabs/switchboard/bridges/protocol"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/types/events"
 )
 
-// handleQRLogin initiates QR-code pairing for a client with no stored session.
-// It emits auth.qr events for each QR code, and auth.success on completion.
-func handleQRLogin(client *whatsmeow.Client, writer *protocol.Writer) {
-	if client.IsConnected() {
-		client.Disconnect()
+// loginSession tracks the pairing attempt in progress, so a new auth.start
+// or an auth.cancel can stop it before another QR channel is opened.
+type loginSession struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// start stops any running attempt and begins a new one for req.
+func (l *loginSession) start(client *waClient, req protocol.AuthStart) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stopLocked()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	l.cancel = cancel
+	l.done = done
+	go func() {
+		defer close(done)
+		handleQRLogin(ctx, client, req)
+	}()
+}
+
+// stop cancels the running attempt, if any, and waits for it to exit.
+// It reports whether an attempt was running.
+func (l *loginSession) stop() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopLocked()
+}
+
+// stopLocked implements stop. Callers must hold l.mu.
+func (l *loginSession) stopLocked() bool {
+	if l.cancel == nil {
+		return false
+	}
+	l.cancel()
+	<-l.done
+	l.cancel = nil
+	l.done = nil
+	return true
+}
+
+// handleQRLogin runs one pairing attempt for a client with no stored session.
+// It emits auth.qr events for each QR code and auth.success on completion.
+// With method "phone" it instead requests a link code for req.Phone once the
+// login websocket is up and emits it as auth.pair_code. Failures are reported
+// as auth.failed, and running out of QR codes as auth.timeout. The attempt
+// ends early, disconnecting the socket, when ctx is cancelled.
+func handleQRLogin(ctx context.Context, client *waClient, req protocol.AuthStart) {
+	pairPhone := ""
+	if req.Method == "phone" {
+		pairPhone = digitsOnly(req.Phone)
+		if pairPhone == "" {
+			emitAuthFailed(client, "invalid_phone", "a phone number is required to pair by phone")
+			return
+		}
+	}
+
+	if client.wa().IsConnected() {
+		client.wa().Disconnect()
 	}
 
-	qrChan, err := client.GetQRChannel(context.Background())
+	qrChan, err := client.wa().GetQRChannel(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "get QR channel: %v\n", err)
+		emitAuthFailed(client, "connect", fmt.Sprintf("get QR channel: %v", err))
 		return
 	}
 
-	if err := client.Connect(); err != nil {
-		fmt.Fprintf(os.Stderr, "connect for QR login: %v\n", err)
+	if err := client.wa().Connect(); err != nil {
+		emitAuthFailed(client, "connect", fmt.Sprintf("connect for QR login: %v", err))
 		return
 	}
 
-	for item := range qrChan {
+	pairRequested := false
+	for {
+		var item whatsmeow.QRChannelItem
+		var ok bool
+		select {
+		case <-ctx.Done():
+			client.wa().Disconnect()
+			return
+		case item, ok = <-qrChan:
+			if !ok {
+				return
+			}
+		}
+
 		switch item.Event {
-		case "code":
-			if err := writer.SendTyped("auth.qr", "", protocol.AuthQR{Code: item.Code}); err != nil {
+		case whatsmeow.QRChannelEventCode:
+			if pairPhone != "" {
+				// The first QR code means the websocket is ready; QR codes
+				// themselves are not shown when pairing by phone number.
+				if !pairRequested {
+					pairRequested = true
+					requestPairCode(ctx, client, pairPhone)
+				}
+				continue
+			}
+			if err := client.writer.SendTyped("auth.qr", "", protocol.AuthQR{Code: item.Code}); err != nil {
 				fmt.Fprintf(os.Stderr, "send auth.qr: %v\n", err)
 			}
-		case "success":
-			jid := client.Store.ID
+		case whatsmeow.QRChannelSuccess.Event:
+			jid := client.wa().Store.ID
 			user := ""
 			phone := ""
 			if jid != nil {
 				user = jid.User
 				phone = jid.User // WhatsApp JID User field is the phone number
 			}
-			if err := writer.SendTyped("auth.success", "", protocol.AuthSuccess{
+			if err := client.writer.SendTyped("auth.success", "", protocol.AuthSuccess{
 				User:  user,
 				Phone: phone,
 			}); err != nil {
 				fmt.Fprintf(os.Stderr, "send auth.success: %v\n", err)
 			}
-		case "error":
-			fmt.Fprintf(os.Stderr, "QR channel error: %v\n", item.Error)
-		case "timeout":
-			fmt.Fprintln(os.Stderr, "QR code timed out")
+		case whatsmeow.QRChannelTimeout.Event:
+			if err := client.writer.SendTyped("auth.timeout", "", protocol.AuthFailed{
+				Reason:  "timeout",
+				Message: "the QR code expired before it was scanned",
+			}); err != nil {
+				fmt.Fprintf(os.Stderr, "send auth.timeout: %v\n", err)
+			}
+		case whatsmeow.QRChannelClientOutdated.Event:
+			emitAuthFailed(client, "client_outdated",
+				"WhatsApp rejected this client version; update Switchboard and try again")
+		case whatsmeow.QRChannelScannedWithoutMultidevice.Event:
+			emitAuthFailed(client, "multidevice_limit",
+				"the phone could not link another device; enable multi-device or unlink an existing device and try again")
+		case whatsmeow.QRChannelEventError:
+			emitAuthFailed(client, "pair_error", fmt.Sprintf("pairing failed: %v", item.Error))
 		default:
-			fmt.Fprintf(os.Stderr, "QR channel event: %s\n", item.Event)
+			emitAuthFailed(client, "unexpected_state", fmt.Sprintf("unexpected pairing event %q", item.Event))
+		}
+	}
+}
+
+// handleCancelLogin stops the pairing attempt in progress, if any, and tells
+// the UI that authentication is needed again.
+func handleCancelLogin(client *waClient) {
+	if !client.login.stop() {
+		return
+	}
+	if err := client.writer.SendTyped("status", "", protocol.StatusData{Status: "auth_needed"}); err != nil {
+		fmt.Fprintf(os.Stderr, "send status auth_needed: %v\n", err)
+	}
+}
+
+// handleLogout unlinks this device from the account and returns the bridge to
+// auth_needed. The device keys are deleted locally even when the server
+// cannot be reached; with req.Wipe the message store and media go too.
+func handleLogout(client *waClient, reqID string, req protocol.LogoutRequest) {
+	ctx := context.Background()
+	client.login.stop()
+
+	wa := client.wa()
+	if wa.Store.ID != nil {
+		if err := wa.Logout(ctx); err != nil {
+			fmt.Fprintf(os.Stderr, "logout: %v\n", err)
+			wa.Disconnect()
+			if wa.Store.ID != nil {
+				if err := wa.Store.Delete(ctx); err != nil {
+					sendError(client, reqID, "auth.logout: delete device: %v", err)
+					return
+				}
+			}
+		}
+	}
+	wa.Disconnect()
+	// The deleted device must not be reused for the next pairing.
+	client.replaceDevice(client.container.NewDevice())
+
+	if req.Wipe {
+		if err := client.store.wipe(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 		}
+		if err := os.RemoveAll(client.mediaDir); err != nil {
+			fmt.Fprintf(os.Stderr, "remove media dir: %v\n", err)
+		}
+		if err := os.MkdirAll(client.mediaDir, 0o700); err != nil {
+			fmt.Fprintf(os.Stderr, "create media dir: %v\n", err)
+		}
+	}
+
+	if err := client.writer.SendTyped("auth.logged_out", reqID, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "send auth.logged_out: %v\n", err)
+	}
+	if err := client.writer.SendTyped("status", "", protocol.StatusData{Status: "auth_needed"}); err != nil {
+		fmt.Fprintf(os.Stderr, "send status auth_needed: %v\n", err)
+	}
+}
+
+// emitAuthFailed emits auth.failed with a machine-readable reason.
+func emitAuthFailed(client *waClient, reason, message string) {
+	fmt.Fprintf(os.Stderr, "auth failed (%s): %s\n", reason, message)
+	if err := client.writer.SendTyped("auth.failed", "", protocol.AuthFailed{
+		Reason:  reason,
+		Message: message,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send auth.failed: %v\n", err)
 	}
 }
 
 // handleConnectedEvent handles a successful connection/reconnection event.
 // Called from the event handler when events.Connected is received.
-func handleConnectedEvent(client *whatsmeow.Client, writer *protocol.Writer, evt *events.Connected) {
-	jid := client.Store.ID
+func handleConnectedEvent(client *waClient, evt *events.Connected) {
+	jid := client.wa().Store.ID
 	user := ""
 	phone := ""
 	if jid != nil {
 		user = jid.User
 		phone = jid.User
 	}
-	if err := writer.SendTyped("auth.success", "", protocol.AuthSuccess{
+	if err := client.writer.SendTyped("auth.success", "", protocol.AuthSuccess{
 		User:  user,
 		Phone: phone,
 	}); err != nil {
 		fmt.Fprintf(os.Stderr, "send auth.success on reconnect: %v\n", err)
 	}
 }
+
+// requestPairCode asks WhatsApp for a phone-number link code and emits it.
+func requestPairCode(ctx context.Context, client *waClient, phone string) {
+	code, err := client.wa().PairPhone(ctx, phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
+	if err != nil {
+		emitAuthFailed(client, "pair_phone", fmt.Sprintf("pair phone: %v", err))
+		return
+	}
+	if err := client.writer.SendTyped("auth.pair_code", "", protocol.AuthPairCode{Code: code}); err != nil {
+		fmt.Fprintf(os.Stderr, "send auth.pair_code: %v\n", err)
+	}
+}
+
+// digitsOnly strips everything but digits from a phone number, as PairPhone
+// expects the international number without "+", spaces or dashes.
+func digitsOnly(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
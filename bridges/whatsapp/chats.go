@@ -8,162 +8,309 @@ import (
 	"path/filepath"
 
 	"github.com/aigustalabs/switchboard/bridges/protocol"
-	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/proto/waE2E"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
-	waProto "google.golang.org/protobuf/proto"
 )
 
-// handleChatsList retrieves known contacts/groups and emits a chats.list response.
-func handleChatsList(client *whatsmeow.Client, writer *protocol.Writer, reqID string) {
-	if !client.IsConnected() {
-		fmt.Fprintln(os.Stderr, "chats.list: not connected")
-		if err := writer.SendTyped("chats.list", reqID, protocol.ChatListResponse{
-			Chats: []protocol.Chat{},
-		}); err != nil {
-			fmt.Fprintf(os.Stderr, "send empty chats.list: %v\n", err)
+// handleChatsList builds the chat list from conversations the bridge knows
+// about (history sync and stored messages) plus every joined group, and emits
+// a chats.list response ordered pinned-first, then by most recent activity.
+func handleChatsList(client *waClient, reqID string) {
+	ctx := context.Background()
+
+	// Joined groups are listed even before any of their messages are seen.
+	if client.wa().IsConnected() {
+		groups, err := client.wa().GetJoinedGroups(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "get joined groups: %v\n", err)
+		}
+		for _, g := range groups {
+			if err := client.store.setChatName(g.JID.String(), g.Name); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
 		}
+	}
+
+	chats, err := client.store.listChats()
+	if err != nil {
+		sendError(client, reqID, "chats.list: %v", err)
 		return
 	}
 
 	// GetAllContacts returns a map[types.JID]types.ContactInfo.
-	contacts, err := client.Store.Contacts.GetAllContacts(context.Background())
+	contacts, err := client.wa().Store.Contacts.GetAllContacts(ctx)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "get contacts: %v\n", err)
 		contacts = map[types.JID]types.ContactInfo{}
 	}
 
-	chats := make([]protocol.Chat, 0, len(contacts))
-	for jid, info := range contacts {
-		name := info.FullName
-		if name == "" {
-			name = info.PushName
+	for i := range chats {
+		jid, err := types.ParseJID(chats[i].ID)
+		if err != nil {
+			continue
+		}
+		chats[i].IsGroup = jid.Server == types.GroupServer
+		if chats[i].Name != "" {
+			continue
+		}
+		if info, ok := contacts[jid]; ok {
+			chats[i].Name = info.FullName
+			if chats[i].Name == "" {
+				chats[i].Name = info.PushName
+			}
 		}
-		if name == "" {
-			name = jid.User
+		if chats[i].Name == "" {
+			chats[i].Name = jid.User
 		}
-		isGroup := jid.Server == types.GroupServer
-		chats = append(chats, protocol.Chat{
-			ID:      jid.String(),
-			Name:    name,
-			IsGroup: isGroup,
-		})
 	}
 
-	if err := writer.SendTyped("chats.list", reqID, protocol.ChatListResponse{
+	if err := client.writer.SendTyped("chats.list", reqID, protocol.ChatListResponse{
 		Chats: chats,
 	}); err != nil {
 		fmt.Fprintf(os.Stderr, "send chats.list: %v\n", err)
 	}
 }
 
-// handleChatMessages returns an empty message list.
-// whatsmeow does not provide server-side message history for new sessions.
-func handleChatMessages(client *whatsmeow.Client, writer *protocol.Writer, reqID string, req protocol.ChatMessagesRequest) {
-	if err := writer.SendTyped("chat.messages", reqID, protocol.ChatMessagesResponse{
-		Messages: []protocol.Message{},
-	}); err != nil {
+// handleChatMessages serves a page of chat history from the local store,
+// newest first. When the store runs out, the page still carries a cursor, as
+// the phone may hold older messages; paging past the end then requests them
+// from the phone, and they arrive later as a history sync and a
+// history.synced event.
+func handleChatMessages(client *waClient, reqID string, req protocol.ChatMessagesRequest) {
+	jid, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+
+	// Opening a chat is when the UI wants live presence for its peer.
+	if client.wa().IsConnected() {
+		go subscribePresence(client, jid)
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	messages, next, err := client.store.search(protocol.SearchRequest{
+		ChatID: req.ChatID,
+		Cursor: req.Cursor,
+	}, limit)
+	if err != nil {
+		sendError(client, reqID, "chat.messages: %v", err)
+		return
+	}
+
+	resp := protocol.ChatMessagesResponse{
+		Messages:   messages,
+		NextCursor: next,
+	}
+	if next == "" && client.wa().IsConnected() {
+		if req.Cursor != "" {
+			resp.HistoryPending = requestHistory(client, jid, limit)
+		}
+		if n := len(messages); n > 0 {
+			resp.NextCursor = storeCursor(messages[n-1])
+		}
+	}
+
+	if err := client.writer.SendTyped("chat.messages", reqID, resp); err != nil {
 		fmt.Fprintf(os.Stderr, "send chat.messages: %v\n", err)
 	}
 }
 
 // handleSendMessage sends a text message to the specified chat.
-func handleSendMessage(client *whatsmeow.Client, writer *protocol.Writer, reqID string, req protocol.SendMessageRequest) {
-	if !client.IsConnected() {
-		fmt.Fprintln(os.Stderr, "message.send: not connected")
+func handleSendMessage(client *waClient, reqID string, req protocol.SendMessageRequest) {
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "message.send: not connected")
 		return
 	}
 
 	jid, err := types.ParseJID(req.ChatID)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "parse JID %q: %v\n", req.ChatID, err)
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
 		return
 	}
 
-	msg := &waE2E.Message{
-		Conversation: waProto.String(req.Text),
-	}
-
-	resp, err := client.SendMessage(context.Background(), jid, msg)
+	ctx := context.Background()
+	msg, err := outgoingText(ctx, client, jid, req.Text, req.Format)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "send message to %s: %v\n", req.ChatID, err)
+		sendError(client, reqID, "message.send: %v", err)
 		return
 	}
+	if req.ReplyTo != "" {
+		if err := quoteMessage(client, jid, msg, req.ReplyTo); err != nil {
+			sendError(client, reqID, "message.send: reply to: %v", err)
+			return
+		}
+	}
 
-	// Emit the sent message back as message.new so the UI can display it.
-	out := protocol.Message{
-		ID:        resp.ID,
-		ChatID:    req.ChatID,
-		From:      "me",
-		FromMe:    true,
-		Text:      req.Text,
-		Timestamp: resp.Timestamp.Unix(),
+	if _, err := sendEcho(ctx, client, jid, msg, "", reqID); err != nil {
+		sendError(client, reqID, "send message to %s: %v", req.ChatID, err)
 	}
-	if err := writer.SendTyped("message.new", reqID, out); err != nil {
-		fmt.Fprintf(os.Stderr, "send message.new for sent msg: %v\n", err)
+}
+
+// messageText extracts the text of a message, falling back to a media caption.
+func messageText(msg *waE2E.Message) string {
+	switch {
+	case msg.GetConversation() != "":
+		return msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetText()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetCaption()
 	}
+	return ""
 }
 
 // handleEvent processes incoming whatsmeow events and emits protocol messages.
-func handleEvent(client *whatsmeow.Client, writer *protocol.Writer, mediaDir string, rawEvt interface{}) {
+func handleEvent(client *waClient, rawEvt interface{}) {
+	if handleConnectionEvent(client, rawEvt) {
+		return
+	}
+
 	switch evt := rawEvt.(type) {
-	case *events.Connected:
-		handleConnectedEvent(client, writer, evt)
+	case *events.Message:
+		handleIncomingMessage(client, evt)
+
+	case *events.HistorySync:
+		handleHistorySync(client, evt)
 
-	case *events.LoggedOut:
-		fmt.Fprintln(os.Stderr, "logged out")
-		if err := writer.SendTyped("status", "", protocol.StatusData{Status: "auth_needed"}); err != nil {
-			fmt.Fprintf(os.Stderr, "send status auth_needed: %v\n", err)
+	case *events.Pin:
+		var pinnedAt int64
+		if evt.Action.GetPinned() {
+			pinnedAt = evt.Timestamp.Unix()
 		}
+		if err := client.store.setPinned(evt.JID.String(), pinnedAt); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+
+	case *events.Mute:
+		handleMuteEvent(client, evt)
 
-	case *events.Disconnected:
-		fmt.Fprintln(os.Stderr, "disconnected")
-		if err := writer.SendTyped("status", "", protocol.StatusData{Status: "disconnected"}); err != nil {
-			fmt.Fprintf(os.Stderr, "send status disconnected: %v\n", err)
+	case *events.Archive:
+		if err := client.store.setArchived(evt.JID.String(), evt.Action.GetArchived()); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 		}
 
-	case *events.Message:
-		handleIncomingMessage(client, writer, mediaDir, evt)
+	case *events.Receipt:
+		handleReceipt(client, evt)
+
+	case *events.MarkChatAsRead:
+		handleMarkChatAsRead(client, evt)
+
+	case *events.ChatPresence:
+		handleChatPresence(client, evt)
+
+	case *events.Presence:
+		handlePresence(client, evt)
 	}
 }
 
 // handleIncomingMessage processes a received message event.
-func handleIncomingMessage(client *whatsmeow.Client, writer *protocol.Writer, mediaDir string, evt *events.Message) {
+func handleIncomingMessage(client *waClient, evt *events.Message) {
 	info := evt.Info
-	chatID := info.Chat.String()
-	senderID := info.Sender.String()
-	msgID := string(info.ID)
-	ts := info.Timestamp.Unix()
 
-	text := ""
-	imagePath := ""
+	// Messages sent from Switchboard were already echoed by handleSendMessage;
+	// ones sent from the phone or another linked device are reported below.
+	if info.IsFromMe && client.sent.isOwn(string(info.ID)) {
+		return
+	}
 
 	msg := evt.Message
 	if msg == nil {
 		return
 	}
+	if pm := msg.GetProtocolMessage(); pm != nil {
+		handleProtocolMessage(client, evt, pm)
+		return
+	}
+	if rm := msg.GetReactionMessage(); rm != nil {
+		handleReactionMessage(client, evt, rm)
+		return
+	}
 
-	// Extract text content.
-	if msg.GetConversation() != "" {
-		text = msg.GetConversation()
-	} else if msg.GetExtendedTextMessage() != nil {
-		text = msg.GetExtendedTextMessage().GetText()
+	out := buildMessage(client, evt, true)
+	if err := client.store.save(out, msg); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	applyMarkup(&out)
+	// A reaction can arrive before the message it reacts to.
+	if reactions, err := client.store.reactions(out.ChatID, out.ID); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	} else {
+		out.Reactions = reactions
+	}
+	// Replying from another device reads the chat, as on the phone.
+	var unreadErr error
+	if info.IsFromMe {
+		unreadErr = client.store.setUnread(out.ChatID, 0)
+	} else {
+		unreadErr = client.store.incrementUnread(out.ChatID)
+	}
+	if unreadErr != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", unreadErr)
 	}
 
-	// Download image if present.
-	if imgMsg := msg.GetImageMessage(); imgMsg != nil {
-		if text == "" {
-			text = imgMsg.GetCaption()
-		}
-		data, err := client.Download(context.Background(), imgMsg)
+	if err := client.writer.SendTyped("message.new", "", out); err != nil {
+		fmt.Fprintf(os.Stderr, "send message.new: %v\n", err)
+	}
+
+	// Only notify for messages from others, and as the rules and the
+	// chat's mute allow.
+	if info.IsFromMe || (out.Text == "" && out.ImagePath == "") {
+		return
+	}
+	muted, silent := notificationMode(client, out.ChatID)
+	// Resolve a display name for the sender.
+	senderName := info.PushName
+	if senderName == "" {
+		senderName = info.Sender.User
+	}
+	body := out.Text
+	if body == "" && out.ImagePath != "" {
+		body = "[image]"
+	}
+	notif := protocol.Notification{
+		Title:     senderName,
+		Body:      body,
+		Service:   "whatsapp",
+		ChatID:    out.ChatID,
+		Sender:    out.From,
+		Mentioned: mentionsMe(client, msg),
+		Silent:    silent,
+	}
+	if !client.rules.Apply(&notif, muted) {
+		return
+	}
+	if err := client.writer.SendTyped("notification", "", notif); err != nil {
+		fmt.Fprintf(os.Stderr, "send notification: %v\n", err)
+	}
+}
+
+// buildMessage converts a whatsmeow message event into a protocol.Message,
+// its text still in WhatsApp markup as kept by the store. Images are
+// downloaded into the media dir only when download is set.
+func buildMessage(client *waClient, evt *events.Message, download bool) protocol.Message {
+	info := evt.Info
+	msgID := string(info.ID)
+	senderID := info.Sender.ToNonAD().String()
+	if info.IsFromMe {
+		senderID = "me"
+	}
+
+	imagePath := ""
+	if imgMsg := evt.Message.GetImageMessage(); imgMsg != nil && download {
+		data, err := client.wa().Download(context.Background(), imgMsg)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "download image in msg %s: %v\n", msgID, err)
 		} else {
 			// Save with a hash-based filename.
 			hash := sha256.Sum256(data)
 			fname := fmt.Sprintf("%x.jpg", hash[:8])
-			fpath := filepath.Join(mediaDir, fname)
+			fpath := filepath.Join(client.mediaDir, fname)
 			if err := os.WriteFile(fpath, data, 0o600); err != nil {
 				fmt.Fprintf(os.Stderr, "write image %s: %v\n", fpath, err)
 			} else {
@@ -172,38 +319,13 @@ func handleIncomingMessage(client *whatsmeow.Client, writer *protocol.Writer, me
 		}
 	}
 
-	out := protocol.Message{
+	return protocol.Message{
 		ID:        msgID,
-		ChatID:    chatID,
+		ChatID:    info.Chat.String(),
 		From:      senderID,
 		FromMe:    info.IsFromMe,
-		Text:      text,
-		Timestamp: ts,
+		Text:      waText(context.Background(), client, evt.Message),
+		Timestamp: info.Timestamp.Unix(),
 		ImagePath: imagePath,
 	}
-
-	if err := writer.SendTyped("message.new", "", out); err != nil {
-		fmt.Fprintf(os.Stderr, "send message.new: %v\n", err)
-	}
-
-	// Only notify for messages from others.
-	if !info.IsFromMe && (text != "" || imagePath != "") {
-		// Resolve a display name for the sender.
-		senderName := info.PushName
-		if senderName == "" {
-			senderName = info.Sender.User
-		}
-		body := text
-		if body == "" && imagePath != "" {
-			body = "[image]"
-		}
-		notif := protocol.Notification{
-			Title:   senderName,
-			Body:    body,
-			Service: "whatsapp",
-		}
-		if err := writer.SendTyped("notification", "", notif); err != nil {
-			fmt.Fprintf(os.Stderr, "send notification: %v\n", err)
-		}
-	}
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Reconnect delays grow from reconnectMin to reconnectMax.
+const (
+	reconnectMin = time.Second
+	reconnectMax = 2 * time.Minute
+)
+
+// sendStatus emits a status envelope.
+func sendStatus(client *waClient, status protocol.StatusData) {
+	if err := client.writer.SendTyped("status", "", status); err != nil {
+		fmt.Fprintf(os.Stderr, "send status %s: %v\n", status.Status, err)
+	}
+}
+
+// connect opens the connection for a stored session, falling back to the
+// reconnect loop when the first attempt fails.
+func connect(client *waClient) {
+	sendStatus(client, protocol.StatusData{Status: "connecting"})
+	if err := client.wa().Connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "connect: %v\n", err)
+		startReconnect(client, err.Error())
+	}
+}
+
+// startReconnect reconnects with jittered exponential backoff, reporting
+// each attempt as a "reconnecting" status. whatsmeow's own auto-reconnect is
+// disabled in favour of this loop. Only one loop runs at a time; it ends
+// once a connection is up or the session is gone.
+func startReconnect(client *waClient, reason string) {
+	if !client.reconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer client.reconnecting.Store(false)
+		for {
+			attempt, d := client.reconnect.Next()
+			fmt.Fprintf(os.Stderr, "reconnect %d in %s: %s\n", attempt, d.Round(time.Millisecond), reason)
+			sendStatus(client, protocol.StatusData{
+				Status:      "reconnecting",
+				Reason:      reason,
+				Attempt:     attempt,
+				NextRetryAt: time.Now().Add(d).Unix(),
+			})
+			_ = client.reconnect.Wait(context.Background(), d)
+
+			if client.wa().Store.ID == nil || client.wa().IsConnected() {
+				return
+			}
+			err := client.wa().Connect()
+			if err == nil {
+				// The Connected event (or a failure event restarting
+				// this loop) reports the outcome of the handshake.
+				return
+			}
+			reason = err.Error()
+		}
+	}()
+}
+
+// handleConnectionEvent updates the connection state for whatsmeow's
+// connection lifecycle events. It reports whether evt was one of them.
+func handleConnectionEvent(client *waClient, rawEvt interface{}) bool {
+	switch evt := rawEvt.(type) {
+	case *events.Connected:
+		client.reconnect.Reset()
+		sendStatus(client, protocol.StatusData{Status: "connected"})
+		handleConnectedEvent(client, evt)
+
+	case *events.Disconnected:
+		fmt.Fprintln(os.Stderr, "disconnected")
+		startReconnect(client, "connection to WhatsApp lost")
+
+	case *events.KeepAliveTimeout:
+		// Without auto-reconnect whatsmeow leaves a dead socket open, so
+		// drop it once keepalives have failed for too long.
+		if time.Since(evt.LastSuccess) > whatsmeow.KeepAliveMaxFailTime {
+			client.wa().Disconnect()
+			startReconnect(client, "WhatsApp stopped answering keepalives")
+		}
+
+	case *events.ConnectFailure:
+		startReconnect(client, fmt.Sprintf("connect failure: %s", evt.Reason))
+
+	case *events.LoggedOut:
+		fmt.Fprintf(os.Stderr, "logged out: %s\n", evt.Reason)
+		sendStatus(client, protocol.StatusData{Status: "logged_out", Reason: evt.Reason.String()})
+		sendStatus(client, protocol.StatusData{Status: "auth_needed"})
+
+	case *events.TemporaryBan:
+		sendStatus(client, protocol.StatusData{
+			Status:      "banned",
+			Reason:      evt.String(),
+			NextRetryAt: time.Now().Add(evt.Expire).Unix(),
+		})
+
+	case *events.StreamReplaced:
+		sendStatus(client, protocol.StatusData{
+			Status: "disconnected",
+			Reason: "this session was opened on another computer",
+		})
+
+	case *events.ClientOutdated:
+		sendStatus(client, protocol.StatusData{
+			Status: "disconnected",
+			Reason: "WhatsApp rejected this client version; update Switchboard",
+		})
+
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/proto/waSyncAction"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waProto "google.golang.org/protobuf/proto"
+)
+
+// handleProtocolMessage emits message.edited / message.deleted for edit and
+// revoke protocol messages. Other protocol message types are ignored.
+func handleProtocolMessage(client *waClient, evt *events.Message, pm *waE2E.ProtocolMessage) {
+	if pm.Type == nil {
+		return
+	}
+	info := evt.Info
+	chatID := info.Chat.String()
+	targetID := pm.GetKey().GetID()
+
+	switch pm.GetType() {
+	case waE2E.ProtocolMessage_REVOKE:
+		if err := client.store.remove(chatID, []string{targetID}); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		if err := client.writer.SendTyped("message.deleted", "", protocol.MessageDeleted{
+			ChatID:     chatID,
+			MessageIDs: []string{targetID},
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "send message.deleted: %v\n", err)
+		}
+
+	case waE2E.ProtocolMessage_MESSAGE_EDIT:
+		from := info.Sender.String()
+		if info.IsFromMe {
+			from = "me"
+		}
+		out := protocol.Message{
+			ID:       targetID,
+			ChatID:   chatID,
+			From:     from,
+			FromMe:   info.IsFromMe,
+			Text:     waText(context.Background(), client, pm.GetEditedMessage()),
+			EditedAt: info.Timestamp.Unix(),
+		}
+		if err := client.store.edit(chatID, targetID, out.Text, out.EditedAt); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		applyMarkup(&out)
+		if err := client.writer.SendTyped("message.edited", "", out); err != nil {
+			fmt.Fprintf(os.Stderr, "send message.edited: %v\n", err)
+		}
+	}
+}
+
+// handleEditMessage replaces the text of one of our messages.
+func handleEditMessage(client *waClient, reqID string, req protocol.EditMessageRequest) {
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "message.edit: not connected")
+		return
+	}
+	jid, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+
+	ctx := context.Background()
+	msg, err := outgoingText(ctx, client, jid, req.Text, req.Format)
+	if err != nil {
+		sendError(client, reqID, "message.edit: %v", err)
+		return
+	}
+	edit := client.wa().BuildEdit(jid, req.MessageID, msg)
+	resp, err := client.wa().SendMessage(ctx, jid, edit)
+	if err != nil {
+		sendError(client, reqID, "edit message %s in %s: %v", req.MessageID, req.ChatID, err)
+		return
+	}
+
+	out := protocol.Message{
+		ID:       req.MessageID,
+		ChatID:   req.ChatID,
+		From:     "me",
+		FromMe:   true,
+		Text:     waText(ctx, client, msg),
+		EditedAt: resp.Timestamp.Unix(),
+	}
+	if err := client.store.edit(req.ChatID, req.MessageID, out.Text, out.EditedAt); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	applyMarkup(&out)
+	if err := client.writer.SendTyped("message.edited", reqID, out); err != nil {
+		fmt.Fprintf(os.Stderr, "send message.edited: %v\n", err)
+	}
+}
+
+// handleDeleteMessages revokes messages for everyone, or removes them only
+// from our devices via an app state patch.
+func handleDeleteMessages(client *waClient, reqID string, req protocol.DeleteMessageRequest) {
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "message.delete: not connected")
+		return
+	}
+	chat, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+	sender := types.EmptyJID
+	if req.Sender != "" {
+		if sender, err = types.ParseJID(req.Sender); err != nil {
+			sendError(client, reqID, "parse sender JID %q: %v", req.Sender, err)
+			return
+		}
+	}
+
+	ctx := context.Background()
+	for _, id := range req.MessageIDs {
+		if req.ForEveryone {
+			_, err = client.wa().SendMessage(ctx, chat, client.wa().BuildRevoke(chat, sender, id))
+		} else {
+			err = client.wa().SendAppState(ctx, buildDeleteForMe(chat, sender, id))
+		}
+		if err != nil {
+			sendError(client, reqID, "delete message %s in %s: %v", id, req.ChatID, err)
+			return
+		}
+	}
+
+	if err := client.store.remove(req.ChatID, req.MessageIDs); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if err := client.writer.SendTyped("message.deleted", reqID, protocol.MessageDeleted{
+		ChatID:     req.ChatID,
+		MessageIDs: req.MessageIDs,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send message.deleted: %v\n", err)
+	}
+}
+
+// buildDeleteForMe builds an app state patch deleting a message only from
+// our own devices. An empty sender means the message is our own.
+func buildDeleteForMe(chat, sender types.JID, id types.MessageID) appstate.PatchInfo {
+	fromMe := "1"
+	participant := "0"
+	if !sender.IsEmpty() {
+		fromMe = "0"
+		if chat.Server == types.GroupServer {
+			participant = sender.String()
+		}
+	}
+	return appstate.PatchInfo{
+		Type: appstate.WAPatchRegularHigh,
+		Mutations: []appstate.MutationInfo{{
+			Index:   []string{appstate.IndexDeleteMessageForMe, chat.String(), id, fromMe, participant},
+			Version: 3,
+			Value: &waSyncAction.SyncActionValue{
+				DeleteMessageForMeAction: &waSyncAction.DeleteMessageForMeAction{
+					DeleteMedia: waProto.Bool(true),
+				},
+			},
+		}},
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	waProto "google.golang.org/protobuf/proto"
+)
+
+// WhatsApp markup is *bold*, _italic_, ~strike~, `code`, ```monospace``` and
+// "> " quote lines. Mentions are "@<number>" in the text, with the mentioned
+// JIDs listed in the ContextInfo.
+
+// waMarkers maps WhatsApp's inline markers to span styles.
+var waMarkers = map[rune]string{
+	'*': protocol.StyleBold,
+	'_': protocol.StyleItalic,
+	'~': protocol.StyleStrike,
+}
+
+// renderWhatsApp renders text with formatting spans as WhatsApp markup.
+// Underline and spoilers have no WhatsApp equivalent and are dropped; links
+// become "text (url)". Other spans are narrowed to what WhatsApp can show,
+// see fitWASpans, and formatting inside code is left out, as WhatsApp shows
+// its markers literally there.
+func renderWhatsApp(text string, spans []protocol.Span) string {
+	runes := []rune(text)
+	spans = fitWASpans(runes, spans)
+
+	var b strings.Builder
+	var open []protocol.Span
+	verbatim := 0
+	next := 0
+	for pos := 0; pos <= len(runes); pos++ {
+		for len(open) > 0 && open[len(open)-1].End <= pos {
+			s := open[len(open)-1]
+			open = open[:len(open)-1]
+			switch s.Style {
+			case protocol.StyleCode, protocol.StylePre:
+				if verbatim--; verbatim == 0 {
+					b.WriteString(waMarkerFor(s.Style))
+				}
+			case protocol.StyleLink:
+				if s.URL != string(runes[s.Start:s.End]) {
+					b.WriteString(" (" + s.URL + ")")
+				}
+			default:
+				if verbatim == 0 {
+					b.WriteString(waMarkerFor(s.Style))
+				}
+			}
+		}
+		for next < len(spans) && spans[next].Start == pos {
+			s := spans[next]
+			next++
+			switch s.Style {
+			case protocol.StyleQuote:
+				b.WriteString("> ")
+			case protocol.StyleCode, protocol.StylePre:
+				if verbatim++; verbatim == 1 {
+					b.WriteString(waMarkerFor(s.Style))
+				}
+			default:
+				if verbatim == 0 {
+					b.WriteString(waMarkerFor(s.Style))
+				}
+			}
+			open = append(open, s)
+		}
+		if pos == len(runes) {
+			break
+		}
+		b.WriteRune(runes[pos])
+		if runes[pos] == '\n' && verbatim == 0 && pos+1 < len(runes) && inWAQuote(open) {
+			b.WriteString("> ")
+		}
+	}
+	return b.String()
+}
+
+// fitWASpans narrows spans of runes to what WhatsApp markup can show, the
+// way protocol.RenderMarkdown fits Markdown: spans overlapping without
+// nesting are split into pieces that nest, inline markers stay on one line,
+// off whitespace on the inside and off letters on the outside, and quotes
+// cover whole lines. Spans that cannot be narrowed are dropped.
+func fitWASpans(runes []rune, spans []protocol.Span) []protocol.Span {
+	var out []protocol.Span
+	for _, s := range spans {
+		if s.Start >= 0 && s.Start < s.End && s.End <= len(runes) &&
+			s.Style != protocol.StyleUnderline && s.Style != protocol.StyleSpoiler {
+			out = append(out, s)
+		}
+	}
+	// Markers of one style cannot nest or touch, so such spans are joined.
+	out = joinWASpans(out, func(a, b protocol.Span) bool {
+		return a.Style == b.Style && a.URL == b.URL && a.Start <= b.End && b.Start <= a.End
+	})
+	for crossed := true; crossed; {
+		out, crossed = splitWASpans(narrowWASpans(runes, out))
+	}
+	// A quote ends at a newline, which code would hide.
+	hidden := func(pos int) bool {
+		return slices.ContainsFunc(out, func(v protocol.Span) bool {
+			return isWAVerbatim(v.Style) && v.Start <= pos && pos < v.End
+		})
+	}
+	out = slices.DeleteFunc(out, func(s protocol.Span) bool {
+		return s.Style == protocol.StyleQuote && (hidden(s.Start-1) || hidden(s.End))
+	})
+	// Quote lines in a row read as one quote.
+	out = joinWASpans(out, func(a, b protocol.Span) bool {
+		return a.Style == protocol.StyleQuote && b.Style == protocol.StyleQuote && b.Start == a.End+1
+	})
+	sort.SliceStable(out, func(a, b int) bool {
+		sa, sb := out[a], out[b]
+		if sa.Start != sb.Start {
+			return sa.Start < sb.Start
+		}
+		if qa, qb := sa.Style == protocol.StyleQuote, sb.Style == protocol.StyleQuote; qa != qb {
+			return qa
+		}
+		if sa.End != sb.End {
+			return sa.End > sb.End
+		}
+		// Code of the same range goes inside, so other markers still show.
+		return !isWAVerbatim(sa.Style) && isWAVerbatim(sb.Style)
+	})
+	return out
+}
+
+// joinWASpans joins spans a and b into one covering both while join(a, b)
+// holds for any two of them.
+func joinWASpans(spans []protocol.Span, join func(a, b protocol.Span) bool) []protocol.Span {
+	for joined := true; joined; {
+		joined = false
+		for i := 0; i < len(spans) && !joined; i++ {
+			for j := range spans {
+				if i != j && join(spans[i], spans[j]) {
+					spans[i].Start = min(spans[i].Start, spans[j].Start)
+					spans[i].End = max(spans[i].End, spans[j].End)
+					spans = slices.Delete(spans, j, j+1)
+					joined = true
+					break
+				}
+			}
+		}
+	}
+	return spans
+}
+
+// narrowWASpans narrows each span to where its markup is recognised, see
+// fitWASpans. Inline spans over several lines are cut into one per line.
+func narrowWASpans(runes []rune, spans []protocol.Span) []protocol.Span {
+	n := len(runes)
+	var out []protocol.Span
+	for i := 0; i < len(spans); i++ {
+		s := spans[i]
+		switch s.Style {
+		case protocol.StyleBold, protocol.StyleItalic, protocol.StyleStrike:
+			if nl := slices.Index(runes[s.Start:s.End], '\n'); nl >= 0 {
+				rest := s
+				rest.Start += nl + 1
+				s.End = s.Start + nl
+				spans = append(spans, rest)
+			}
+			for s.Start < s.End && unicode.IsSpace(runes[s.Start]) {
+				s.Start++
+			}
+			for s.End > s.Start && unicode.IsSpace(runes[s.End-1]) {
+				s.End--
+			}
+			if s.Start > 0 && isWordRune(runes[s.Start-1]) || s.End < n && isWordRune(runes[s.End]) {
+				continue
+			}
+		case protocol.StyleCode:
+			// Single backticks do not span lines.
+			if slices.Contains(runes[s.Start:s.End], '\n') {
+				s.Style = protocol.StylePre
+			}
+		case protocol.StyleQuote:
+			for s.Start < s.End && s.Start > 0 && runes[s.Start-1] != '\n' {
+				s.Start++
+			}
+			for s.End > s.Start && (s.End < n && runes[s.End] != '\n' || runes[s.End-1] == '\n') {
+				s.End--
+			}
+		}
+		if s.Start < s.End {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// splitWASpans splits spans that overlap without nesting into pieces that
+// nest, and reports whether there were any. Of two crossing spans the later
+// one is split, unless it is a quote, link or code and the earlier one is
+// not: a link shows its URL after each piece.
+func splitWASpans(spans []protocol.Span) ([]protocol.Span, bool) {
+	whole := func(style string) bool {
+		return style == protocol.StyleQuote || style == protocol.StyleLink || isWAVerbatim(style)
+	}
+	crossed := false
+	for i := 0; i < len(spans); i++ {
+		for j := range spans {
+			a, b := spans[i], spans[j]
+			if !(a.Start < b.Start && b.Start < a.End && a.End < b.End) {
+				continue
+			}
+			crossed = true
+			if whole(b.Style) && !whole(a.Style) {
+				spans[i].End = b.Start
+				a.Start = b.Start
+				spans = append(spans, a)
+				continue
+			}
+			spans[j].End = a.End
+			b.Start = a.End
+			spans = append(spans, b)
+		}
+	}
+	return spans, crossed
+}
+
+// isWAVerbatim reports whether style shows its text without markup.
+func isWAVerbatim(style string) bool {
+	return style == protocol.StyleCode || style == protocol.StylePre
+}
+
+// waMarkerFor returns the WhatsApp marker of a style, "" if it has none.
+func waMarkerFor(style string) string {
+	switch style {
+	case protocol.StyleCode:
+		return "`"
+	case protocol.StylePre:
+		return "```"
+	}
+	for r, s := range waMarkers {
+		if s == style {
+			return string(r)
+		}
+	}
+	return ""
+}
+
+// inWAQuote reports whether a quote span is open.
+func inWAQuote(open []protocol.Span) bool {
+	for _, s := range open {
+		if s.Style == protocol.StyleQuote {
+			return true
+		}
+	}
+	return false
+}
+
+// waParser converts WhatsApp markup to plain text and spans.
+type waParser struct {
+	out   []rune
+	spans []protocol.Span
+}
+
+// parseWhatsApp returns the plain text and formatting spans of WhatsApp
+// markup. Markers follow WhatsApp's rules: they must not be next to spaces
+// on the inside or letters on the outside, and do not span lines.
+func parseWhatsApp(s string) (string, []protocol.Span) {
+	var p waParser
+	p.parse([]rune(s), true)
+	sort.SliceStable(p.spans, func(a, b int) bool {
+		if p.spans[a].Start != p.spans[b].Start {
+			return p.spans[a].Start < p.spans[b].Start
+		}
+		return p.spans[a].End > p.spans[b].End
+	})
+	return string(p.out), p.spans
+}
+
+// parse appends src to the output. Quote lines are only recognised at the
+// top level.
+func (p *waParser) parse(src []rune, top bool) {
+	quoteStart := -1
+	for i := 0; i < len(src); {
+		if top && (i == 0 || src[i-1] == '\n') {
+			if hasRunes(src, i, "> ") {
+				if quoteStart < 0 {
+					quoteStart = len(p.out)
+				}
+				i += 2
+				continue
+			}
+			if quoteStart >= 0 {
+				// The previous line ended the quote; leave out its newline.
+				p.addSpan(quoteStart, len(p.out)-1, protocol.StyleQuote)
+				quoteStart = -1
+			}
+		}
+
+		r := src[i]
+		switch {
+		case hasRunes(src, i, "```"):
+			if end := findRunes(src, i+3, "```", true); end > i+3 {
+				start := len(p.out)
+				p.out = append(p.out, src[i+3:end]...)
+				p.addSpan(start, len(p.out), protocol.StylePre)
+				i = end + 3
+				continue
+			}
+		case r == '`':
+			if end := findRunes(src, i+1, "`", false); end > i+1 {
+				start := len(p.out)
+				p.out = append(p.out, src[i+1:end]...)
+				p.addSpan(start, len(p.out), protocol.StyleCode)
+				i = end + 1
+				continue
+			}
+		case waMarkers[r] != "":
+			if end := waCloser(src, i); end > 0 {
+				start := len(p.out)
+				p.parse(src[i+1:end], false)
+				p.addSpan(start, len(p.out), waMarkers[r])
+				i = end + 1
+				continue
+			}
+		}
+		p.out = append(p.out, r)
+		i++
+	}
+	if quoteStart >= 0 {
+		end := len(p.out)
+		if end > quoteStart && p.out[end-1] == '\n' {
+			end--
+		}
+		p.addSpan(quoteStart, end, protocol.StyleQuote)
+	}
+}
+
+// addSpan records a non-empty span.
+func (p *waParser) addSpan(start, end int, style string) {
+	if end > start {
+		p.spans = append(p.spans, protocol.Span{Start: start, End: end, Style: style})
+	}
+}
+
+// waCloser returns the index of the marker closing the one at src[i] on the
+// same line, or -1.
+func waCloser(src []rune, i int) int {
+	m := src[i]
+	if i > 0 && isWordRune(src[i-1]) {
+		return -1
+	}
+	if i+1 >= len(src) || unicode.IsSpace(src[i+1]) {
+		return -1
+	}
+	for j := i + 2; j < len(src); j++ {
+		if src[j] == '\n' {
+			return -1
+		}
+		if src[j] == m && !unicode.IsSpace(src[j-1]) && (j+1 == len(src) || !isWordRune(src[j+1])) {
+			return j
+		}
+	}
+	return -1
+}
+
+// hasRunes reports whether src has sub at i.
+func hasRunes(src []rune, i int, sub string) bool {
+	s := []rune(sub)
+	return i+len(s) <= len(src) && string(src[i:i+len(s)]) == sub
+}
+
+// findRunes returns the index of sub in src at or after from, or -1. Unless
+// multiline, the search stops at the end of the line.
+func findRunes(src []rune, from int, sub string, multiline bool) int {
+	for j := from; j < len(src); j++ {
+		if !multiline && src[j] == '\n' {
+			return -1
+		}
+		if hasRunes(src, j, sub) {
+			return j
+		}
+	}
+	return -1
+}
+
+// isWordRune reports whether r is part of a word.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// mentionCandidate is someone who can be mentioned by name in a chat.
+type mentionCandidate struct {
+	name string
+	jid  types.JID
+}
+
+// mentionCandidates lists the people who can be mentioned in chat: the
+// participants of a group, or the peer of a direct chat.
+func mentionCandidates(ctx context.Context, client *waClient, chat types.JID) []mentionCandidate {
+	var jids []types.JID
+	if chat.Server == types.GroupServer {
+		info, err := client.wa().GetGroupInfo(chat)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "get group info %s: %v\n", chat, err)
+			return nil
+		}
+		for _, p := range info.Participants {
+			jids = append(jids, p.JID)
+		}
+	} else {
+		jids = append(jids, chat)
+	}
+
+	var out []mentionCandidate
+	for _, jid := range jids {
+		contact, err := client.wa().Store.Contacts.GetContact(ctx, jid)
+		if err != nil {
+			continue
+		}
+		for _, name := range []string{contact.FullName, contact.FirstName, contact.PushName, contact.BusinessName} {
+			if name != "" {
+				out = append(out, mentionCandidate{name: name, jid: jid})
+			}
+		}
+	}
+	// Longest names first, so "@Ann Lee" wins over "@Ann".
+	sort.SliceStable(out, func(a, b int) bool {
+		return len([]rune(out[a].name)) > len([]rune(out[b].name))
+	})
+	return out
+}
+
+// resolveMentions rewrites "@name" mentions of chat members in text to
+// WhatsApp's "@<number>" form and returns the mentioned JIDs. "@<number>"
+// is passed through as a mention of that phone number.
+func resolveMentions(ctx context.Context, client *waClient, chat types.JID, text string) (string, []string) {
+	if !strings.Contains(text, "@") {
+		return text, nil
+	}
+	candidates := mentionCandidates(ctx, client, chat)
+	runes := []rune(text)
+	var b strings.Builder
+	var mentioned []string
+	seen := make(map[string]bool)
+	mention := func(jid types.JID) {
+		b.WriteString("@" + jid.User)
+		if s := jid.ToNonAD().String(); !seen[s] {
+			seen[s] = true
+			mentioned = append(mentioned, s)
+		}
+	}
+
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' || (i > 0 && isWordRune(runes[i-1])) {
+			b.WriteRune(runes[i])
+			continue
+		}
+		rest := runes[i+1:]
+		if n := leadingDigits(rest); n > 0 && (n == len(rest) || !isWordRune(rest[n])) {
+			mention(types.NewJID(string(rest[:n]), types.DefaultUserServer))
+			i += n
+			continue
+		}
+		matched := false
+		for _, c := range candidates {
+			name := []rune(c.name)
+			if len(name) > len(rest) || !strings.EqualFold(string(rest[:len(name)]), c.name) {
+				continue
+			}
+			if len(name) < len(rest) && isWordRune(rest[len(name)]) {
+				continue
+			}
+			mention(c.jid)
+			i += len(name)
+			matched = true
+			break
+		}
+		if !matched {
+			b.WriteRune('@')
+		}
+	}
+	return b.String(), mentioned
+}
+
+// leadingDigits returns the number of ASCII digits at the start of r.
+func leadingDigits(r []rune) int {
+	n := 0
+	for n < len(r) && r[n] >= '0' && r[n] <= '9' {
+		n++
+	}
+	return n
+}
+
+// outgoingText builds the message for the text of a send or edit request,
+// with Markdown converted to WhatsApp markup and mentions resolved.
+func outgoingText(ctx context.Context, client *waClient, chat types.JID, text, format string) (*waE2E.Message, error) {
+	switch format {
+	case "":
+	case "markdown":
+		plain, spans := protocol.ParseMarkdown(text)
+		text = renderWhatsApp(plain, spans)
+	default:
+		return nil, fmt.Errorf("unsupported format %q", format)
+	}
+
+	body, mentioned := resolveMentions(ctx, client, chat, text)
+	if len(mentioned) == 0 {
+		return &waE2E.Message{Conversation: waProto.String(body)}, nil
+	}
+	return &waE2E.Message{
+		ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+			Text:        waProto.String(body),
+			ContextInfo: &waE2E.ContextInfo{MentionedJID: mentioned},
+		},
+	}, nil
+}
+
+// quoteMessage makes msg a reply to the stored message replyTo in chat,
+// turning a plain Conversation into an ExtendedTextMessage.
+func quoteMessage(client *waClient, chat types.JID, msg *waE2E.Message, replyTo string) error {
+	quoted, _, ok, err := client.store.get(chat.String(), replyTo)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("unknown message %s in %s", replyTo, chat)
+	}
+	participant := quoted.From
+	if quoted.FromMe && client.wa().Store.ID != nil {
+		participant = client.wa().Store.ID.ToNonAD().String()
+	}
+
+	if msg.ExtendedTextMessage == nil {
+		msg.ExtendedTextMessage = &waE2E.ExtendedTextMessage{Text: waProto.String(msg.GetConversation())}
+		msg.Conversation = nil
+	}
+	ext := msg.ExtendedTextMessage
+	if ext.ContextInfo == nil {
+		ext.ContextInfo = &waE2E.ContextInfo{}
+	}
+	ext.ContextInfo.StanzaID = waProto.String(replyTo)
+	ext.ContextInfo.Participant = waProto.String(participant)
+	ext.ContextInfo.QuotedMessage = &waE2E.Message{Conversation: waProto.String(quoted.Text)}
+	return nil
+}
+
+// messageContextInfo returns the ContextInfo of a text or captioned message.
+func messageContextInfo(msg *waE2E.Message) *waE2E.ContextInfo {
+	switch {
+	case msg.GetExtendedTextMessage() != nil:
+		return msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		return msg.GetImageMessage().GetContextInfo()
+	}
+	return nil
+}
+
+// displayMentions replaces "@<number>" mentions in text with "@" and the
+// mentioned person's contact name, where known.
+func displayMentions(ctx context.Context, client *waClient, text string, mentioned []string) string {
+	jids := make([]types.JID, 0, len(mentioned))
+	for _, s := range mentioned {
+		if jid, err := types.ParseJID(s); err == nil && jid.User != "" {
+			jids = append(jids, jid)
+		}
+	}
+	// Longer numbers first, so one is never replaced inside another.
+	sort.Slice(jids, func(a, b int) bool { return len(jids[a].User) > len(jids[b].User) })
+	for _, jid := range jids {
+		if name := contactName(ctx, client, jid); name != "" {
+			text = strings.ReplaceAll(text, "@"+jid.User, "@"+name)
+		}
+	}
+	return text
+}
+
+// contactName returns the name of jid from the contact store, "" if unknown.
+func contactName(ctx context.Context, client *waClient, jid types.JID) string {
+	contact, err := client.wa().Store.Contacts.GetContact(ctx, jid)
+	if err != nil {
+		return ""
+	}
+	for _, name := range []string{contact.FullName, contact.PushName, contact.BusinessName} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// waText returns the text of a received message with mentions shown as
+// names. Markup is kept; the store holds messages in this form.
+func waText(ctx context.Context, client *waClient, msg *waE2E.Message) string {
+	return displayMentions(ctx, client, messageText(msg), messageContextInfo(msg).GetMentionedJID())
+}
+
+// applyMarkup strips WhatsApp markup from m.Text and sets m.Markdown to the
+// formatted text, if it has any formatting.
+func applyMarkup(m *protocol.Message) {
+	plain, spans := parseWhatsApp(m.Text)
+	if len(spans) == 0 {
+		return
+	}
+	m.Text = plain
+	m.Markdown = protocol.RenderMarkdown(plain, spans)
+}
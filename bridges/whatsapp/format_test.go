@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+)
+
+func TestRenderWhatsApp(t *testing.T) {
+	span := func(start, end int, style string) protocol.Span {
+		return protocol.Span{Start: start, End: end, Style: style}
+	}
+	tests := []struct {
+		name  string
+		text  string
+		spans []protocol.Span
+		want  string
+	}{
+		{"nested", "abc defgh", []protocol.Span{span(0, 9, protocol.StyleBold), span(4, 9, protocol.StyleItalic)},
+			"*abc _defgh_*"},
+		{"crossing", "abc de fgh", []protocol.Span{span(0, 6, protocol.StyleBold), span(4, 10, protocol.StyleItalic)},
+			"*abc _de_* _fgh_"},
+		{"inside a word", "abc defgh", []protocol.Span{span(0, 5, protocol.StyleBold), span(4, 9, protocol.StyleItalic)},
+			"abc _defgh_"},
+		{"markers inside code", "a+b", []protocol.Span{span(0, 3, protocol.StyleCode), span(0, 1, protocol.StyleBold)},
+			"`a+b`"},
+		{"code of the same range", "a+b", []protocol.Span{span(0, 3, protocol.StyleCode), span(0, 3, protocol.StyleBold)},
+			"*`a+b`*"},
+		{"crossing a link", "go to here now", []protocol.Span{
+			{Start: 3, End: 10, Style: protocol.StyleLink, URL: "https://go.dev"}, span(6, 14, protocol.StyleBold)},
+			"go to *here* (https://go.dev) *now*"},
+		{"over lines", "ab\ncd", []protocol.Span{span(0, 5, protocol.StyleBold)}, "*ab*\n*cd*"},
+		{"whitespace", "a b c", []protocol.Span{span(1, 4, protocol.StyleStrike)}, "a ~b~ c"},
+		{"quote with crossing markers", "a b\nc d", []protocol.Span{
+			span(0, 7, protocol.StyleQuote), span(2, 5, protocol.StyleStrike), span(4, 7, protocol.StyleItalic)},
+			"> a ~b~\n> _~c~ d_"},
+		{"quote mid line", "ab\ncd", []protocol.Span{span(1, 5, protocol.StyleQuote)}, "ab\n> cd"},
+		{"code over lines", "a\nb", []protocol.Span{span(0, 3, protocol.StyleCode)}, "```a\nb```"},
+		{"dropped styles", "ab", []protocol.Span{span(0, 2, protocol.StyleUnderline), span(0, 1, protocol.StyleSpoiler)}, "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderWhatsApp(tt.text, tt.spans); got != tt.want {
+				t.Errorf("renderWhatsApp = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRenderWhatsAppRoundTrip checks that WhatsApp reads rendered markup
+// back as the text with the fitted spans, for random overlapping spans.
+func TestRenderWhatsAppRoundTrip(t *testing.T) {
+	styles := []string{protocol.StyleBold, protocol.StyleItalic, protocol.StyleStrike,
+		protocol.StyleCode, protocol.StylePre, protocol.StyleQuote}
+	alphabet := []rune("ab1 \n.é")
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 20000 {
+		runes := make([]rune, rng.IntN(12))
+		for i := range runes {
+			runes[i] = alphabet[rng.IntN(len(alphabet))]
+		}
+		var spans []protocol.Span
+		for range rng.IntN(4) {
+			if len(runes) == 0 {
+				break
+			}
+			start := rng.IntN(len(runes))
+			end := start + 1 + rng.IntN(len(runes)-start)
+			spans = append(spans, protocol.Span{Start: start, End: end, Style: styles[rng.IntN(len(styles))]})
+		}
+
+		text := string(runes)
+		markup := renderWhatsApp(text, spans)
+		gotText, gotSpans := parseWhatsApp(markup)
+		if gotText != text || !slices.Equal(styleCoverage(len(runes), gotSpans), styleCoverage(len(runes), shownWASpans(runes, spans))) {
+			t.Fatalf("%q with %v renders as %q, read back as %q with %v", text, spans, markup, gotText, gotSpans)
+		}
+	}
+}
+
+// shownWASpans returns the fitted spans of runes that WhatsApp shows:
+// those not inside code.
+func shownWASpans(runes []rune, spans []protocol.Span) []protocol.Span {
+	fitted := fitWASpans(runes, spans)
+	var out []protocol.Span
+	for i, s := range fitted {
+		if !slices.ContainsFunc(fitted[:i], func(v protocol.Span) bool {
+			return isWAVerbatim(v.Style) && v.Start <= s.Start && s.End <= v.End
+		}) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// styleCoverage returns the styles covering each of n runes.
+func styleCoverage(n int, spans []protocol.Span) []string {
+	out := make([]string, n)
+	for i := range n {
+		var styles []string
+		for _, s := range spans {
+			if s.Start <= i && i < s.End && !slices.Contains(styles, s.Style) {
+				styles = append(styles, s.Style)
+			}
+		}
+		slices.Sort(styles)
+		out[i] = strings.Join(styles, " ")
+	}
+	return out
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	waProto "google.golang.org/protobuf/proto"
+)
+
+// handleForward forwards stored messages to another WhatsApp chat, marked
+// as forwarded, or emits forward.copy for the host when the target is
+// another service.
+func handleForward(client *waClient, reqID string, req protocol.ForwardRequest) {
+	if req.ToService != "" && req.ToService != "whatsapp" {
+		handleForwardCopy(client, reqID, req)
+		return
+	}
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "message.forward: not connected")
+		return
+	}
+	from, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+	to, err := types.ParseJID(req.ToChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ToChatID, err)
+		return
+	}
+	originals, err := storedMessages(client, from, req.MessageIDs)
+	if err != nil {
+		sendError(client, reqID, "message.forward: %v", err)
+		return
+	}
+
+	ctx := context.Background()
+	resp := protocol.ForwardResponse{ChatID: req.ToChatID, MessageIDs: []string{}}
+	for _, m := range originals {
+		msg, err := forwardedMessage(ctx, client, from, m)
+		if err != nil {
+			sendError(client, reqID, "message.forward: %v", err)
+			return
+		}
+		out, err := sendEcho(ctx, client, to, msg, m.ImagePath, "")
+		if err != nil {
+			sendError(client, reqID, "forward message %s to %s: %v", m.ID, req.ToChatID, err)
+			return
+		}
+		resp.MessageIDs = append(resp.MessageIDs, out.ID)
+	}
+	if err := client.writer.SendTyped("message.forward", reqID, resp); err != nil {
+		fmt.Fprintf(os.Stderr, "send message.forward: %v\n", err)
+	}
+}
+
+// handleForwardCopy hands stored messages to the host as forward.copy, to
+// be re-sent by the bridge of req.ToService.
+func handleForwardCopy(client *waClient, reqID string, req protocol.ForwardRequest) {
+	chat, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+	originals, err := storedMessages(client, chat, req.MessageIDs)
+	if err != nil {
+		sendError(client, reqID, "message.forward: %v", err)
+		return
+	}
+
+	ctx := context.Background()
+	out := protocol.ForwardCopy{ToService: req.ToService}
+	for _, m := range originals {
+		// Sent without its attachment, the copy would lose it silently.
+		if m.media != "" && m.media != "link" && m.ImagePath == "" {
+			sendError(client, reqID, "message.forward: message %s: %s is not downloaded", m.ID, m.media)
+			return
+		}
+		applyMarkup(&m.Message)
+		out.Messages = append(out.Messages, protocol.CopyMessageRequest{
+			ChatID:      req.ToChatID,
+			Text:        m.Text,
+			Markdown:    m.Markdown,
+			ImagePath:   m.ImagePath,
+			Attribution: protocol.ForwardAttribution(senderName(ctx, client, m.Message), "WhatsApp"),
+		})
+	}
+	if err := client.writer.SendTyped("forward.copy", reqID, out); err != nil {
+		fmt.Fprintf(os.Stderr, "send forward.copy: %v\n", err)
+	}
+}
+
+// handleCopyMessage re-sends a message forwarded from another service, with
+// its attribution header and image.
+func handleCopyMessage(client *waClient, reqID string, req protocol.CopyMessageRequest) {
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "message.copy: not connected")
+		return
+	}
+	jid, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+
+	ctx := context.Background()
+	msg, err := outgoingMessage(ctx, client, renderWhatsApp(protocol.CopyText(req)), req.ImagePath, nil)
+	if err != nil {
+		sendError(client, reqID, "message.copy: %v", err)
+		return
+	}
+	if _, err := sendEcho(ctx, client, jid, msg, req.ImagePath, reqID); err != nil {
+		sendError(client, reqID, "copy message to %s: %v", req.ChatID, err)
+	}
+}
+
+// storedMessage is a stored message to forward, with the kind of media it
+// has, see messageMedia.
+type storedMessage struct {
+	protocol.Message
+	media string
+}
+
+// storedMessages loads messages of chat from the store, failing on any
+// unknown ID. WhatsApp cannot fetch old messages on demand, so only stored
+// ones can be forwarded.
+func storedMessages(client *waClient, chat types.JID, ids []string) ([]storedMessage, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no message ids")
+	}
+	out := make([]storedMessage, 0, len(ids))
+	for _, id := range ids {
+		m, media, ok, err := client.store.get(chat.String(), id)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown message %s in %s", id, chat)
+		}
+		out = append(out, storedMessage{Message: m, media: media})
+	}
+	return out, nil
+}
+
+// forwardedMessage builds the native forward of the stored message m of
+// chat. Media is forwarded as the original message, reusing its upload, so
+// it need not be downloaded; text is sent as stored, with any edits.
+func forwardedMessage(ctx context.Context, client *waClient, chat types.JID, m storedMessage) (*waE2E.Message, error) {
+	ci := &waE2E.ContextInfo{
+		IsForwarded:     waProto.Bool(true),
+		ForwardingScore: waProto.Uint32(1),
+	}
+	if m.media == "" || m.media == "link" {
+		return outgoingMessage(ctx, client, m.Text, "", ci)
+	}
+
+	orig, err := client.store.original(chat.String(), m.ID)
+	if err != nil {
+		return nil, err
+	}
+	if orig == nil {
+		return nil, fmt.Errorf("message %s: %s cannot be forwarded", m.ID, m.media)
+	}
+	msg := &waE2E.Message{}
+	switch {
+	case orig.GetImageMessage() != nil:
+		msg.ImageMessage = waProto.CloneOf(orig.GetImageMessage())
+		msg.ImageMessage.ContextInfo = ci
+	case orig.GetVideoMessage() != nil:
+		msg.VideoMessage = waProto.CloneOf(orig.GetVideoMessage())
+		msg.VideoMessage.ContextInfo = ci
+	case orig.GetAudioMessage() != nil:
+		msg.AudioMessage = waProto.CloneOf(orig.GetAudioMessage())
+		msg.AudioMessage.ContextInfo = ci
+	case orig.GetDocumentMessage() != nil:
+		msg.DocumentMessage = waProto.CloneOf(orig.GetDocumentMessage())
+		msg.DocumentMessage.ContextInfo = ci
+	case orig.GetStickerMessage() != nil:
+		msg.StickerMessage = waProto.CloneOf(orig.GetStickerMessage())
+		msg.StickerMessage.ContextInfo = ci
+	default:
+		return nil, fmt.Errorf("message %s: %s cannot be forwarded", m.ID, m.media)
+	}
+	return msg, nil
+}
+
+// senderName returns the display name of the sender of a stored message.
+func senderName(ctx context.Context, client *waClient, m protocol.Message) string {
+	if m.FromMe {
+		return client.wa().Store.PushName
+	}
+	jid, err := types.ParseJID(m.From)
+	if err != nil {
+		return m.From
+	}
+	if name := contactName(ctx, client, jid); name != "" {
+		return name
+	}
+	return jid.User
+}
+
+// outgoingMessage builds a message with text in WhatsApp markup, uploading
+// the image at imagePath when set, with text as its caption.
+func outgoingMessage(ctx context.Context, client *waClient, text, imagePath string, ci *waE2E.ContextInfo) (*waE2E.Message, error) {
+	if imagePath == "" {
+		if ci == nil {
+			return &waE2E.Message{Conversation: waProto.String(text)}, nil
+		}
+		return &waE2E.Message{ExtendedTextMessage: &waE2E.ExtendedTextMessage{
+			Text:        waProto.String(text),
+			ContextInfo: ci,
+		}}, nil
+	}
+
+	data, err := os.ReadFile(imagePath)
+	if err != nil {
+		return nil, fmt.Errorf("read image: %w", err)
+	}
+	up, err := client.wa().Upload(ctx, data, whatsmeow.MediaImage)
+	if err != nil {
+		return nil, fmt.Errorf("upload image: %w", err)
+	}
+	img := &waE2E.ImageMessage{
+		URL:           waProto.String(up.URL),
+		DirectPath:    waProto.String(up.DirectPath),
+		MediaKey:      up.MediaKey,
+		Mimetype:      waProto.String(http.DetectContentType(data)),
+		FileEncSHA256: up.FileEncSHA256,
+		FileSHA256:    up.FileSHA256,
+		FileLength:    waProto.Uint64(up.FileLength),
+		ContextInfo:   ci,
+	}
+	if text != "" {
+		img.Caption = waProto.String(text)
+	}
+	return &waE2E.Message{ImageMessage: img}, nil
+}
+
+// sendEcho sends msg to jid, stores it and emits it back as message.new so
+// the UI can display it.
+func sendEcho(ctx context.Context, client *waClient, jid types.JID, msg *waE2E.Message, imagePath, reqID string) (protocol.Message, error) {
+	resp, err := client.wa().SendMessage(ctx, jid, msg)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+	client.sent.mark(resp.ID)
+
+	out := protocol.Message{
+		ID:        resp.ID,
+		ChatID:    jid.String(),
+		From:      "me",
+		FromMe:    true,
+		Text:      waText(ctx, client, msg),
+		Timestamp: resp.Timestamp.Unix(),
+		ImagePath: imagePath,
+	}
+	if err := client.store.save(out, msg); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	applyMarkup(&out)
+	if err := client.writer.SendTyped("message.new", reqID, out); err != nil {
+		fmt.Fprintf(os.Stderr, "send message.new: %v\n", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// handleHistorySync stores the conversations delivered by a history sync
+// (the initial sync after pairing, or an on-demand batch) and emits
+// history.synced. History never produces message.new or notifications.
+func handleHistorySync(client *waClient, evt *events.HistorySync) {
+	var (
+		chatIDs []string
+		stored  int
+	)
+	for _, conv := range evt.Data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "history sync: parse chat JID %q: %v\n", conv.GetID(), err)
+			continue
+		}
+		client.history.done(chatJID.String())
+
+		// Each conversation is written in one transaction rather than one
+		// commit, and so one write-back of an encrypted store, per message.
+		tx, err := client.store.begin()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "history sync: %v\n", err)
+			continue
+		}
+		n := saveHistoryConversation(client, tx, chatJID, conv)
+		if err := tx.commit(); err != nil {
+			fmt.Fprintf(os.Stderr, "history sync: %v\n", err)
+			continue
+		}
+		if n > 0 {
+			chatIDs = append(chatIDs, chatJID.String())
+			stored += n
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "history sync (%s): stored %d messages in %d chats\n",
+		evt.Data.GetSyncType(), stored, len(chatIDs))
+	if len(chatIDs) == 0 {
+		return
+	}
+	if err := client.writer.SendTyped("history.synced", "", protocol.HistorySynced{
+		ChatIDs:  chatIDs,
+		Messages: stored,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send history.synced: %v\n", err)
+	}
+}
+
+// saveHistoryConversation stores a conversation of a history sync for
+// chat in store and returns the number of messages stored.
+func saveHistoryConversation(client *waClient, store *messageStore, chat types.JID, conv *waHistorySync.Conversation) int {
+	if err := store.saveChat(chatMeta{
+		ID:       chat.String(),
+		Name:     conv.GetName(),
+		Unread:   int(conv.GetUnreadCount()),
+		Pinned:   int64(conv.GetPinned()),
+		Archived: conv.GetArchived(),
+		// A mute end of -1 means muted indefinitely, as muteForever.
+		MutedUntil: int64(conv.GetMuteEndTime()),
+		Timestamp:  int64(conv.GetConversationTimestamp()),
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	n := 0
+	for _, hm := range conv.GetMessages() {
+		msgEvt, err := client.wa().ParseWebMessage(chat, hm.GetMessage())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "history sync: parse message in %s: %v\n", chat, err)
+			continue
+		}
+		msg := msgEvt.Message
+		if rm := msg.GetReactionMessage(); rm != nil {
+			sender := reactionSender(msgEvt.Info.IsFromMe, msgEvt.Info.Sender)
+			if err := store.setReaction(chat.String(), rm.GetKey().GetID(), sender, rm.GetText(), msgEvt.Info.Timestamp.UnixMilli()); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+			continue
+		}
+		if msg == nil || msg.GetProtocolMessage() != nil {
+			continue
+		}
+		out := buildMessage(client, msgEvt, false)
+		if out.Text == "" && messageMedia(msg) == "" {
+			continue
+		}
+		if err := store.save(out, msg); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+		saveHistoryReactions(store, chat, out.ID, hm.GetMessage().GetReactions())
+		n++
+	}
+	return n
+}
+
+// saveHistoryReactions stores in store the reactions a history sync
+// attaches to the message msgID of chat.
+func saveHistoryReactions(store *messageStore, chat types.JID, msgID string, reactions []*waWeb.Reaction) {
+	for _, r := range reactions {
+		key := r.GetKey()
+		sender := chat
+		if p := key.GetParticipant(); p != "" {
+			if jid, err := types.ParseJID(p); err == nil {
+				sender = jid
+			}
+		}
+		if err := store.setReaction(chat.String(), msgID, reactionSender(key.GetFromMe(), sender), r.GetText(), r.GetSenderTimestampMS()); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+}
+
+// historyRequestTimeout is how long an unanswered history request keeps
+// further ones for the same chat from being sent.
+const historyRequestTimeout = time.Minute
+
+// historyRequests tracks the on-demand history requests awaiting an answer,
+// so paging a chat does not ask the phone again for the same messages.
+type historyRequests struct {
+	mu      sync.Mutex
+	pending map[string]time.Time
+}
+
+// newHistoryRequests creates an empty historyRequests.
+func newHistoryRequests() *historyRequests {
+	return &historyRequests{pending: make(map[string]time.Time)}
+}
+
+// start records a request for chatID, reporting false when one is already
+// pending.
+func (h *historyRequests) start(chatID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if sent, ok := h.pending[chatID]; ok && time.Since(sent) < historyRequestTimeout {
+		return false
+	}
+	h.pending[chatID] = time.Now()
+	return true
+}
+
+// done forgets the pending request for chatID.
+func (h *historyRequests) done(chatID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.pending, chatID)
+}
+
+// requestHistory asks the phone for up to count messages older than the
+// oldest one stored for chat, unless a request for chat is pending. It
+// reports whether a request is pending; the answer arrives asynchronously
+// as an on-demand events.HistorySync.
+func requestHistory(client *waClient, chat types.JID, count int) bool {
+	if !client.history.start(chat.String()) {
+		return true
+	}
+	sent := false
+	defer func() {
+		if !sent {
+			client.history.done(chat.String())
+		}
+	}()
+
+	oldest, ok, err := client.store.oldest(chat.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return false
+	}
+	if !ok || client.wa().Store.ID == nil {
+		// Nothing to anchor the request on; the phone only serves history
+		// relative to a message we already know.
+		return false
+	}
+
+	info := &types.MessageInfo{
+		MessageSource: types.MessageSource{
+			Chat:     chat,
+			IsFromMe: oldest.FromMe,
+		},
+		ID:        oldest.ID,
+		Timestamp: time.Unix(oldest.Timestamp, 0),
+	}
+	req := client.wa().BuildHistorySyncRequest(info, count)
+	own := client.wa().Store.ID.ToNonAD()
+	if _, err := client.wa().SendMessage(context.Background(), own, req, whatsmeow.SendRequestExtra{Peer: true}); err != nil {
+		fmt.Fprintf(os.Stderr, "request history for %s: %v\n", chat, err)
+		return false
+	}
+	sent = true
+	return true
+}
@@ -8,15 +8,48 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/aigustalabs/switchboard/bridges/protocol"
 	_ "github.com/mattn/go-sqlite3"
 	"go.mau.fi/whatsmeow"
+	waStore "go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/store/sqlstore"
 	waLog "go.mau.fi/whatsmeow/util/log"
 )
 
+// waClient wraps a whatsmeow client together with shared bridge state.
+type waClient struct {
+	// waMu guards conn, which logging out replaces with a fresh client.
+	waMu sync.RWMutex
+	conn *whatsmeow.Client
+	// container holds whatsmeow's device store; a fresh device is taken
+	// from it after logging out.
+	container *sqlstore.Container
+	writer    *protocol.Writer
+	mediaDir  string
+	// configDir holds per-bridge settings such as the proxy.
+	configDir string
+	// sent tracks messages sent from Switchboard to dedupe their echoes.
+	sent *sentTracker
+	// typing expires inbound typing indicators that are never paused.
+	typing *protocol.TypingTracker
+	// store is the local message archive backing history and search.
+	store *messageStore
+	// rules are the local notification rules; upstream mutes only apply
+	// to notifications no rule matches.
+	rules *protocol.NotificationRules
+	// history tracks on-demand history requests awaiting the phone.
+	history *historyRequests
+	// login is the QR or phone pairing attempt in progress.
+	login loginSession
+	// reconnect paces reconnects; connection.retry_now cuts its wait short.
+	reconnect    *protocol.Backoff
+	reconnecting atomic.Bool
+}
+
 func main() {
 	// All logging goes to stderr — stdout is IPC.
 	log.SetOutput(os.Stderr)
@@ -24,7 +57,6 @@ func main() {
 
 	// Ensure config directories exist.
 	configDir := filepath.Join(os.Getenv("HOME"), ".config", "switchboard")
-	dbPath := filepath.Join(configDir, "whatsapp.db")
 	mediaDir := filepath.Join(configDir, "media", "whatsapp")
 
 	if err := os.MkdirAll(configDir, 0o700); err != nil {
@@ -40,54 +72,130 @@ func main() {
 	writer := protocol.NewWriter()
 	reader := protocol.NewReader()
 
+	// Session store: whatsmeow's keys and the message store are encrypted at
+	// rest when a session passphrase is configured.
+	sessions, err := protocol.OpenSessionStore(configDir, reader, writer)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "session store: %v\n", err)
+		os.Exit(1)
+	}
+
 	// Open SQLite store.
 	// Use Noop logger so whatsmeow internal messages never pollute stdout (IPC channel).
-	container, err := sqlstore.New(context.Background(), "sqlite3",
-		fmt.Sprintf("file:%s?_foreign_keys=on", dbPath), waLog.Noop)
+	waDB, err := openSessionDB(sessions, configDir, "whatsapp.db", "_foreign_keys=on")
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "open store: %v\n", err)
 		os.Exit(1)
 	}
+	defer waDB.Close()
+	container := sqlstore.NewWithDB(waDB.DB, "sqlite3", waLog.Noop)
+	if err := container.Upgrade(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "upgrade store: %v\n", err)
+		os.Exit(1)
+	}
 
 	device, err := container.GetFirstDevice(context.Background())
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "get device: %v\n", err)
 		os.Exit(1)
 	}
-	client := whatsmeow.NewClient(device, waLog.Noop)
+	store, err := openMessageStore(sessions, configDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	defer store.Close()
 
-	// Register event handler.
-	client.AddEventHandler(func(evt interface{}) {
-		handleEvent(client, writer, mediaDir, evt)
-	})
+	client := &waClient{
+		container: container,
+		writer:    writer,
+		mediaDir:  mediaDir,
+		configDir: configDir,
+		sent:      newSentTracker(),
+		typing:    protocol.NewTypingTracker(writer),
+		store:     store,
+		rules:     protocol.NewNotificationRules(configDir),
+		history:   newHistoryRequests(),
+		reconnect: protocol.NewBackoff(reconnectMin, reconnectMax),
+	}
+	if _, err := client.rules.Reload(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	client.conn = newWhatsmeowClient(client, device)
 
-	// Start stdin command loop in background.
-	go runCommandLoop(reader, writer, client, mediaDir)
+	// Start stdin command loop in background. Its end, when the host
+	// closes stdin, shuts the bridge down like a signal.
+	stdinDone := make(chan struct{})
+	go func() {
+		defer close(stdinDone)
+		runCommandLoop(reader, client)
+	}()
 
 	// Connect to WhatsApp.
-	if client.Store.ID == nil {
+	if client.wa().Store.ID == nil {
 		// No session — need to authenticate.
 		if err := writer.SendTyped("status", "", protocol.StatusData{Status: "auth_needed"}); err != nil {
 			fmt.Fprintf(os.Stderr, "send status: %v\n", err)
 		}
 	} else {
-		if err := client.Connect(); err != nil {
-			fmt.Fprintf(os.Stderr, "connect: %v\n", err)
-			os.Exit(1)
-		}
+		connect(client)
 	}
 
-	// Wait for termination.
+	// Wait for termination. Returning runs the deferred closes, which write
+	// encrypted databases back.
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
+	select {
+	case <-sigs:
+	case <-stdinDone:
+	}
 
 	fmt.Fprintln(os.Stderr, "shutting down")
-	client.Disconnect()
+	client.wa().Disconnect()
+}
+
+// wa returns the current whatsmeow client.
+func (c *waClient) wa() *whatsmeow.Client {
+	c.waMu.RLock()
+	defer c.waMu.RUnlock()
+	return c.conn
+}
+
+// replaceDevice swaps in a fresh whatsmeow client for device, as the old
+// one's device store must not be reused after logging out.
+func (c *waClient) replaceDevice(device *waStore.Device) {
+	wa := newWhatsmeowClient(c, device)
+	c.waMu.Lock()
+	defer c.waMu.Unlock()
+	c.conn = wa
+}
+
+// newWhatsmeowClient creates a whatsmeow client for device, routed through
+// the configured proxy and delivering its events to handleEvent.
+func newWhatsmeowClient(client *waClient, device *waStore.Device) *whatsmeow.Client {
+	wa := whatsmeow.NewClient(device, waLog.Noop)
+	// Reconnects are driven by startReconnect instead.
+	wa.EnableAutoReconnect = false
+
+	// Route through the configured proxy, if any, before connecting.
+	proxyURL, err := protocol.LoadProxy(client.configDir, "whatsapp")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if proxyURL != "" {
+		if err := applyProxy(wa, proxyURL); err != nil {
+			fmt.Fprintf(os.Stderr, "%v (connecting directly)\n", err)
+		}
+	}
+
+	wa.AddEventHandler(func(evt interface{}) {
+		handleEvent(client, evt)
+	})
+	return wa
 }
 
 // runCommandLoop reads JSON-line commands from stdin and dispatches them.
-func runCommandLoop(reader *protocol.Reader, writer *protocol.Writer, client *whatsmeow.Client, mediaDir string) {
+func runCommandLoop(reader *protocol.Reader, client *waClient) {
 	for {
 		env, err := reader.Read()
 		if err != nil {
@@ -101,10 +209,48 @@ func runCommandLoop(reader *protocol.Reader, writer *protocol.Writer, client *wh
 
 		switch env.Type {
 		case "auth.start":
-			go handleQRLogin(client, writer)
+			var req protocol.AuthStart
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse auth.start: %v\n", err)
+				continue
+			}
+			go client.login.start(client, req)
+
+		case "auth.cancel":
+			go handleCancelLogin(client)
+
+		case "auth.logout":
+			var req protocol.LogoutRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				sendError(client, env.ID, "parse auth.logout: %v", err)
+				continue
+			}
+			go handleLogout(client, env.ID, req)
+
+		case "proxy.set":
+			var req protocol.ProxyRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				sendError(client, env.ID, "parse proxy.set: %v", err)
+				continue
+			}
+			go handleSetProxy(client, env.ID, req)
+
+		case "proxy.get":
+			go handleGetProxy(client, env.ID)
+
+		case "notifications.rules":
+			var req protocol.NotificationRulesRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				sendError(client, env.ID, "parse notifications.rules: %v", err)
+				continue
+			}
+			go handleNotificationRules(client, env.ID, req)
+
+		case "connection.retry_now":
+			client.reconnect.RetryNow()
 
 		case "chats.list":
-			go handleChatsList(client, writer, env.ID)
+			go handleChatsList(client, env.ID)
 
 		case "chat.messages":
 			var req protocol.ChatMessagesRequest
@@ -112,7 +258,7 @@ func runCommandLoop(reader *protocol.Reader, writer *protocol.Writer, client *wh
 				fmt.Fprintf(os.Stderr, "parse chat.messages: %v\n", err)
 				continue
 			}
-			go handleChatMessages(client, writer, env.ID, req)
+			go handleChatMessages(client, env.ID, req)
 
 		case "message.send":
 			var req protocol.SendMessageRequest
@@ -120,10 +266,95 @@ func runCommandLoop(reader *protocol.Reader, writer *protocol.Writer, client *wh
 				fmt.Fprintf(os.Stderr, "parse message.send: %v\n", err)
 				continue
 			}
-			go handleSendMessage(client, writer, env.ID, req)
+			go handleSendMessage(client, env.ID, req)
+
+		case "chat.mute", "chat.unmute":
+			var req protocol.MuteRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse %s: %v\n", env.Type, err)
+				continue
+			}
+			go handleMute(client, env.ID, env.Type, req, env.Type == "chat.mute")
+
+		case "message.forward":
+			var req protocol.ForwardRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse message.forward: %v\n", err)
+				continue
+			}
+			go handleForward(client, env.ID, req)
+
+		case "message.copy":
+			var req protocol.CopyMessageRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse message.copy: %v\n", err)
+				continue
+			}
+			go handleCopyMessage(client, env.ID, req)
+
+		case "messages.search":
+			var req protocol.SearchRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse messages.search: %v\n", err)
+				continue
+			}
+			go handleSearch(client, env.ID, req)
+
+		case "message.edit":
+			var req protocol.EditMessageRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse message.edit: %v\n", err)
+				continue
+			}
+			go handleEditMessage(client, env.ID, req)
+
+		case "message.delete":
+			var req protocol.DeleteMessageRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse message.delete: %v\n", err)
+				continue
+			}
+			go handleDeleteMessages(client, env.ID, req)
+
+		case "chat.mark_read":
+			var req protocol.MarkReadRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse chat.mark_read: %v\n", err)
+				continue
+			}
+			go handleMarkRead(client, env.ID, req)
+
+		case "message.react", "message.unreact":
+			var req protocol.ReactRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse %s: %v\n", env.Type, err)
+				continue
+			}
+			if env.Type == "message.unreact" {
+				req.Emoji = ""
+			}
+			go handleReact(client, env.ID, req)
+
+		case "chat.typing":
+			var req protocol.TypingRequest
+			if err := protocol.ParseData(env, &req); err != nil {
+				fmt.Fprintf(os.Stderr, "parse chat.typing: %v\n", err)
+				continue
+			}
+			go handleSetTyping(client, env.ID, req)
 
 		default:
 			fmt.Fprintf(os.Stderr, "unknown command type: %s\n", env.Type)
 		}
 	}
 }
+
+// sendError logs a failed command to stderr and reports it to the host as an
+// error envelope tied to the request ID.
+func sendError(client *waClient, reqID string, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintln(os.Stderr, msg)
+	if err := client.writer.SendTyped("error", reqID, map[string]string{"message": msg}); err != nil {
+		fmt.Fprintf(os.Stderr, "send error: %v\n", err)
+	}
+}
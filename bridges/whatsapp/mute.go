@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// handleMute mutes or unmutes a chat through app state sync, so other
+// devices follow, and answers with the chat's new mute state.
+func handleMute(client *waClient, reqID, cmd string, req protocol.MuteRequest, mute bool) {
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "%s: not connected", cmd)
+		return
+	}
+	jid, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+
+	var end *int64
+	until := int64(0)
+	if mute {
+		until = muteForever
+		if req.Until > 0 {
+			ms := req.Until * 1000
+			end, until = &ms, req.Until
+		}
+	}
+	if err := client.wa().SendAppState(context.Background(), appstate.BuildMuteAbs(jid, mute, end)); err != nil {
+		sendError(client, reqID, "%s %s: %v", cmd, req.ChatID, err)
+		return
+	}
+	if err := client.store.setMutedUntil(req.ChatID, until); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if err := client.writer.SendTyped(cmd, reqID, muteState(req.ChatID, until)); err != nil {
+		fmt.Fprintf(os.Stderr, "send %s: %v\n", cmd, err)
+	}
+}
+
+// handleMuteEvent records a chat muted or unmuted on another device and
+// emits chat.mute_changed.
+func handleMuteEvent(client *waClient, evt *events.Mute) {
+	until := int64(0)
+	if evt.Action.GetMuted() {
+		until = muteForever
+		// The end is in milliseconds; -1 or none means indefinitely.
+		if end := evt.Action.GetMuteEndTimestamp(); end > 0 {
+			until = end / 1000
+		}
+	}
+	chatID := evt.JID.String()
+	if err := client.store.setMutedUntil(chatID, until); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if evt.FromFullSync {
+		return
+	}
+	if err := client.writer.SendTyped("chat.mute_changed", "", muteState(chatID, until)); err != nil {
+		fmt.Fprintf(os.Stderr, "send chat.mute_changed: %v\n", err)
+	}
+}
+
+// mentionsMe reports whether msg mentions the logged-in user or replies to
+// one of their messages.
+func mentionsMe(client *waClient, msg *waE2E.Message) bool {
+	ci := messageContextInfo(msg)
+	if ci == nil || client.wa().Store.ID == nil {
+		return false
+	}
+	me := map[string]bool{client.wa().Store.ID.User: true}
+	if lid := client.wa().Store.LID; !lid.IsEmpty() {
+		me[lid.User] = true
+	}
+	if p, err := types.ParseJID(ci.GetParticipant()); err == nil && me[p.User] {
+		return true
+	}
+	for _, s := range ci.GetMentionedJID() {
+		if jid, err := types.ParseJID(s); err == nil && me[jid.User] {
+			return true
+		}
+	}
+	return false
+}
+
+// notificationMode reports whether chatID is muted, which holds back its
+// notifications unless a rule or a mention lets them through, and whether
+// they are silent: in muted and archived chats.
+func notificationMode(client *waClient, chatID string) (muted, silent bool) {
+	muted, archived, err := client.store.notifyState(chatID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	return muted, muted || archived
+}
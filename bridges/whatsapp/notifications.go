@@ -0,0 +1,21 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+)
+
+// handleNotificationRules reloads the notification rules or, for a dry run,
+// reports what they would do to a sample notification.
+func handleNotificationRules(client *waClient, reqID string, req protocol.NotificationRulesRequest) {
+	resp, err := client.rules.Handle(req)
+	if err != nil {
+		sendError(client, reqID, "notifications.rules: %v", err)
+		return
+	}
+	if err := client.writer.SendTyped("notifications.rules", reqID, resp); err != nil {
+		fmt.Fprintf(os.Stderr, "send notifications.rules: %v\n", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow"
+)
+
+// applyProxy routes the websocket and media transfers through rawURL
+// (socks5:// or http://). An empty URL connects directly.
+func applyProxy(wa *whatsmeow.Client, rawURL string) error {
+	if err := wa.SetProxyAddress(rawURL); err != nil {
+		return fmt.Errorf("proxy %s: %w", protocol.RedactProxy(rawURL), err)
+	}
+	return nil
+}
+
+// handleSetProxy applies and persists a new proxy setting. whatsmeow only
+// picks up a proxy when connecting, so a live connection is re-established.
+func handleSetProxy(client *waClient, reqID string, req protocol.ProxyRequest) {
+	if err := applyProxy(client.wa(), req.URL); err != nil {
+		sendError(client, reqID, "proxy.set: %v", err)
+		return
+	}
+	if err := protocol.SaveProxy(client.configDir, "whatsapp", req.URL); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	if client.wa().IsConnected() {
+		client.wa().Disconnect()
+		if err := client.wa().Connect(); err != nil {
+			startReconnect(client, err.Error())
+		}
+	}
+
+	if err := client.writer.SendTyped("proxy.set", reqID, protocol.ProxyResponse{
+		URL: protocol.RedactProxy(req.URL),
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send proxy.set: %v\n", err)
+	}
+}
+
+// handleGetProxy reports the active proxy setting.
+func handleGetProxy(client *waClient, reqID string) {
+	rawURL, err := protocol.LoadProxy(client.configDir, "whatsapp")
+	if err != nil {
+		sendError(client, reqID, "proxy.get: %v", err)
+		return
+	}
+	if err := client.writer.SendTyped("proxy.get", reqID, protocol.ProxyResponse{
+		URL: protocol.RedactProxy(rawURL),
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send proxy.get: %v\n", err)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// WhatsApp delivers each reaction as a separate message replacing the
+// sender's previous one, so the message store keeps the latest emoji per
+// sender and messages report the totals. Our own reactions use the sender
+// "me".
+
+// setReaction stores sender's reaction (empty emoji removes it) at timestamp
+// (unix milliseconds) and returns the message's aggregated reactions.
+func setReaction(client *waClient, chatID, msgID, sender, emoji string, timestamp int64) ([]protocol.Reaction, error) {
+	if err := client.store.setReaction(chatID, msgID, sender, emoji, timestamp); err != nil {
+		return nil, err
+	}
+	reactions, err := client.store.reactions(chatID, msgID)
+	if reactions == nil {
+		reactions = []protocol.Reaction{}
+	}
+	return reactions, err
+}
+
+// reactionSender returns the sender of a reaction as stored: "me" for our
+// own, otherwise the sender's JID without device.
+func reactionSender(fromMe bool, sender types.JID) string {
+	if fromMe {
+		return "me"
+	}
+	return sender.ToNonAD().String()
+}
+
+// aggregateReactions groups sender → emoji into per-emoji totals, ordered by
+// count then emoji so the output is stable.
+func aggregateReactions(senders map[string]string) []protocol.Reaction {
+	byEmoji := make(map[string]*protocol.Reaction)
+	for sender, emoji := range senders {
+		agg, ok := byEmoji[emoji]
+		if !ok {
+			agg = &protocol.Reaction{Emoji: emoji}
+			byEmoji[emoji] = agg
+		}
+		agg.Count++
+		if sender == "me" {
+			agg.FromMe = true
+		}
+		agg.Senders = append(agg.Senders, sender)
+	}
+
+	out := make([]protocol.Reaction, 0, len(byEmoji))
+	for _, agg := range byEmoji {
+		sort.Strings(agg.Senders)
+		out = append(out, *agg)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Emoji < out[j].Emoji
+	})
+	return out
+}
+
+// handleReactionMessage records an incoming reaction and emits the message's
+// updated reaction set.
+func handleReactionMessage(client *waClient, evt *events.Message, rm *waE2E.ReactionMessage) {
+	chatID := evt.Info.Chat.String()
+	msgID := rm.GetKey().GetID()
+	sender := reactionSender(evt.Info.IsFromMe, evt.Info.Sender)
+
+	reactions, err := setReaction(client, chatID, msgID, sender, rm.GetText(), evt.Info.Timestamp.UnixMilli())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	if err := client.writer.SendTyped("message.reactions_changed", "", protocol.ReactionsChanged{
+		ChatID:    chatID,
+		MessageID: msgID,
+		Reactions: reactions,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send message.reactions_changed: %v\n", err)
+	}
+}
+
+// handleReact sends (message.react) or removes (message.unreact, empty emoji)
+// our reaction on a message.
+func handleReact(client *waClient, reqID string, req protocol.ReactRequest) {
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "message.react: not connected")
+		return
+	}
+	chat, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+	// WhatsApp addresses the message by its author, so it must be known.
+	target, _, ok, err := client.store.get(chat.String(), req.MessageID)
+	if err != nil {
+		sendError(client, reqID, "message.react: %v", err)
+		return
+	}
+	if !ok {
+		sendError(client, reqID, "message.react: unknown message %s in %s", req.MessageID, req.ChatID)
+		return
+	}
+	sender := types.EmptyJID
+	if target.FromMe {
+		if client.wa().Store.ID != nil {
+			sender = client.wa().Store.ID.ToNonAD()
+		}
+	} else if sender, err = types.ParseJID(target.From); err != nil {
+		sendError(client, reqID, "parse sender JID %q: %v", target.From, err)
+		return
+	}
+
+	reaction := client.wa().BuildReaction(chat, sender, req.MessageID, req.Emoji)
+	if _, err := client.wa().SendMessage(context.Background(), chat, reaction); err != nil {
+		sendError(client, reqID, "react to %s in %s: %v", req.MessageID, req.ChatID, err)
+		return
+	}
+
+	reactions, err := setReaction(client, req.ChatID, req.MessageID, "me", req.Emoji, time.Now().UnixMilli())
+	if err != nil {
+		sendError(client, reqID, "message.react: %v", err)
+		return
+	}
+	if err := client.writer.SendTyped("message.reactions_changed", reqID, protocol.ReactionsChanged{
+		ChatID:    req.ChatID,
+		MessageID: req.MessageID,
+		Reactions: reactions,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send message.reactions_changed: %v\n", err)
+	}
+}
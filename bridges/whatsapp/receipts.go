@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// handleReceipt emits receipt events for our sent messages, and
+// chat.unread_changed when a chat was read on one of our other devices.
+func handleReceipt(client *waClient, evt *events.Receipt) {
+	chatID := evt.Chat.String()
+
+	var status string
+	switch evt.Type {
+	case types.ReceiptTypeDelivered:
+		status = "delivered"
+	case types.ReceiptTypeRead:
+		status = "read"
+	case types.ReceiptTypePlayed:
+		status = "played"
+	case types.ReceiptTypeReadSelf:
+		emitUnreadChanged(client, chatID, 0)
+		return
+	default:
+		return
+	}
+	if evt.IsFromMe {
+		// Delivery to our own linked devices is not interesting to the UI.
+		return
+	}
+
+	if err := client.writer.SendTyped("receipt", "", protocol.Receipt{
+		ChatID:     chatID,
+		MessageIDs: evt.MessageIDs,
+		Status:     status,
+		From:       evt.Sender.String(),
+		Timestamp:  evt.Timestamp.Unix(),
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send receipt: %v\n", err)
+	}
+}
+
+// handleMarkChatAsRead reflects a mark-as-read app state change from another device.
+func handleMarkChatAsRead(client *waClient, evt *events.MarkChatAsRead) {
+	if !evt.Action.GetRead() {
+		return
+	}
+	emitUnreadChanged(client, evt.JID.String(), 0)
+}
+
+// emitUnreadChanged records and emits chat.unread_changed for chatID.
+func emitUnreadChanged(client *waClient, chatID string, unread int) {
+	if err := client.store.setUnread(chatID, unread); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	if err := client.writer.SendTyped("chat.unread_changed", "", protocol.UnreadChanged{
+		ChatID:      chatID,
+		UnreadCount: unread,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send chat.unread_changed: %v\n", err)
+	}
+}
+
+// handleMarkRead sends read receipts for the given messages.
+func handleMarkRead(client *waClient, reqID string, req protocol.MarkReadRequest) {
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "chat.mark_read: not connected")
+		return
+	}
+	chat, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+	if len(req.MessageIDs) == 0 {
+		sendError(client, reqID, "chat.mark_read: message_ids is required for WhatsApp")
+		return
+	}
+	sender := types.EmptyJID
+	if req.Sender != "" {
+		if sender, err = types.ParseJID(req.Sender); err != nil {
+			sendError(client, reqID, "parse sender JID %q: %v", req.Sender, err)
+			return
+		}
+	}
+
+	if err := client.wa().MarkRead(req.MessageIDs, time.Now(), chat, sender); err != nil {
+		sendError(client, reqID, "mark read in %s: %v", req.ChatID, err)
+		return
+	}
+	if err := client.store.setUnread(req.ChatID, 0); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+
+	if err := client.writer.SendTyped("chat.marked_read", reqID, map[string]string{
+		"chat_id": req.ChatID,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send chat.marked_read: %v\n", err)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+)
+
+// handleSearch searches the local message store and emits messages.search.
+// WhatsApp has no server-side search, so only messages the bridge has seen
+// (live or via history sync) can be found.
+func handleSearch(client *waClient, reqID string, req protocol.SearchRequest) {
+	limit := req.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 50
+	}
+
+	messages, next, err := client.store.search(req, limit)
+	if err != nil {
+		sendError(client, reqID, "messages.search: %v", err)
+		return
+	}
+
+	if err := client.writer.SendTyped("messages.search", reqID, protocol.SearchResponse{
+		Messages:   messages,
+		NextCursor: next,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "send messages.search: %v\n", err)
+	}
+}
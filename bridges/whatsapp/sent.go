@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// sentTTL bounds how long a sent message ID is remembered for deduplication.
+const sentTTL = 10 * time.Minute
+
+// sentTracker remembers IDs of messages sent from Switchboard, so that if
+// WhatsApp echoes them back as events.Message they are not reported twice.
+// Messages sent from the phone or other linked devices are not tracked and
+// flow through as message.new with from_me set.
+type sentTracker struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// newSentTracker creates an empty sentTracker.
+func newSentTracker() *sentTracker {
+	return &sentTracker{ids: make(map[string]time.Time)}
+}
+
+// mark records id as sent from Switchboard.
+func (t *sentTracker) mark(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, at := range t.ids {
+		if now.Sub(at) > sentTTL {
+			delete(t.ids, k)
+		}
+	}
+	t.ids[id] = now
+}
+
+// isOwn reports whether id was sent from Switchboard.
+func (t *sentTracker) isOwn(id string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.ids[id]
+	return ok
+}
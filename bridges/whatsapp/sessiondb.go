@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sessionDBFlushDelay is how long an encrypted database waits after a
+// commit before it is written back, so bursts of commits are saved together.
+const sessionDBFlushDelay = 200 * time.Millisecond
+
+// sessionDB is an SQLite database opened through the session store. With a
+// plain store it is just the file in the config dir. With an encrypted store
+// the database lives in memory, is loaded from and written back to an
+// encrypted entry shortly after every commit, and no plaintext copy ever
+// reaches the disk. Losing commits would lose Signal ratchet and prekey
+// state, so they are not left to a periodic flush.
+type sessionDB struct {
+	*sql.DB
+
+	store protocol.SessionStore
+	name  string
+
+	mu    sync.Mutex
+	last  [sha256.Size]byte
+	dirty chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// openSessionDB opens the database name in dir with the given DSN options.
+func openSessionDB(store protocol.SessionStore, dir, name, options string) (*sessionDB, error) {
+	path := filepath.Join(dir, name)
+	if _, ok := store.(*protocol.EncryptedSessionStore); !ok {
+		db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?%s", path, options))
+		if err != nil {
+			return nil, fmt.Errorf("open %s: %w", name, err)
+		}
+		return &sessionDB{DB: db}, nil
+	}
+
+	db, err := sql.Open("sqlite3", "file::memory:?"+options)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", name, err)
+	}
+	// An in-memory database exists only as long as its connection, so the
+	// pool is pinned to a single connection that is never recycled.
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+	s := &sessionDB{
+		DB:    db,
+		store: store,
+		name:  name,
+		dirty: make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	if err := s.load(path); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.watchCommits(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go s.flushLoop()
+	return s, nil
+}
+
+// load fills the in-memory database from the encrypted entry, or from a
+// plaintext database file left from before encryption was enabled, which is
+// then deleted.
+func (s *sessionDB) load(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		if err := s.restore("file:"+path, nil); err != nil {
+			return fmt.Errorf("migrate %s: %w", s.name, err)
+		}
+		if err := s.flush(); err != nil {
+			return err
+		}
+		for _, p := range []string{path, path + "-wal", path + "-shm", path + "-journal"} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("remove plaintext %s: %w", filepath.Base(p), err)
+			}
+		}
+		return nil
+	}
+
+	b, err := s.store.Load(s.name)
+	if errors.Is(err, protocol.ErrSessionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.restore(":memory:", b); err != nil {
+		return fmt.Errorf("load %s: %w", s.name, err)
+	}
+	s.last = sha256.Sum256(b)
+	return nil
+}
+
+// restore copies the database at dsn into the in-memory database with the
+// SQLite backup API. When image is set, it is deserialized into dsn first.
+// Deserialized images cannot grow, hence the copy instead of using it as is.
+func (s *sessionDB) restore(dsn string, image []byte) error {
+	ctx := context.Background()
+	src, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	dstConn, err := s.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return srcConn.Raw(func(rawSrc any) error {
+		sc := rawSrc.(*sqlite3.SQLiteConn)
+		if image != nil {
+			// Images of WAL-mode databases keep the WAL file-format bytes in
+			// the header, which SQLite refuses to open from memory; mark
+			// them as rollback-journal format.
+			if len(image) >= 20 {
+				image[18], image[19] = 1, 1
+			}
+			if err := sc.Deserialize(image, "main"); err != nil {
+				return err
+			}
+		}
+		return dstConn.Raw(func(rawDst any) error {
+			backup, err := rawDst.(*sqlite3.SQLiteConn).Backup("main", sc, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Close()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// flush writes the in-memory database to the encrypted entry if it changed.
+func (s *sessionDB) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ctx := context.Background()
+	conn, err := s.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("flush %s: %w", s.name, err)
+	}
+	defer conn.Close()
+	var image []byte
+	if err := conn.Raw(func(raw any) error {
+		image, err = raw.(*sqlite3.SQLiteConn).Serialize("main")
+		return err
+	}); err != nil {
+		return fmt.Errorf("serialize %s: %w", s.name, err)
+	}
+
+	sum := sha256.Sum256(image)
+	if sum == s.last {
+		return nil
+	}
+	if err := s.store.Save(s.name, image); err != nil {
+		return err
+	}
+	s.last = sum
+	return nil
+}
+
+// watchCommits marks the database dirty on every commit. The hook is set on
+// the pool's single connection, which lives as long as the database.
+func (s *sessionDB) watchCommits() error {
+	conn, err := s.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("open %s: %w", s.name, err)
+	}
+	defer conn.Close()
+	return conn.Raw(func(raw any) error {
+		raw.(*sqlite3.SQLiteConn).RegisterCommitHook(func() int {
+			select {
+			case s.dirty <- struct{}{}:
+			default:
+			}
+			return 0
+		})
+		return nil
+	})
+}
+
+// flushLoop writes the database back after commits until Close.
+func (s *sessionDB) flushLoop() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.dirty:
+			select {
+			case <-time.After(sessionDBFlushDelay):
+			case <-s.stop:
+				return
+			}
+			if err := s.flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close writes an encrypted database back one last time and closes it.
+func (s *sessionDB) Close() error {
+	if s.stop == nil {
+		return s.DB.Close()
+	}
+	close(s.stop)
+	<-s.done
+	flushErr := s.flush()
+	if err := s.DB.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
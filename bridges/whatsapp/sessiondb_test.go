@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+)
+
+func testEncryptedStore(t *testing.T, dir string) *protocol.EncryptedSessionStore {
+	t.Helper()
+	store, err := protocol.NewEncryptedSessionStore(dir, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// countRows returns the number of rows in table of db.
+func countRows(t *testing.T, db *sessionDB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSessionDBEncryptedRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	store := testEncryptedStore(t, dir)
+
+	db, err := openSessionDB(store, dir, "test.db", "_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE kv (k TEXT PRIMARY KEY, v TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		if _, err := db.Exec(`INSERT INTO kv VALUES (?, ?)`, fmt.Sprint(i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "test.db")); !os.IsNotExist(err) {
+		t.Errorf("plaintext database on disk: %v", err)
+	}
+	sealed, err := os.ReadFile(filepath.Join(dir, "test.db.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("SQLite format")) {
+		t.Error("encrypted entry holds a plaintext database")
+	}
+
+	db, err = openSessionDB(store, dir, "test.db", "_foreign_keys=on")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := countRows(t, db, "kv"); n != 3 {
+		t.Errorf("reopened database has %d rows, want 3", n)
+	}
+	// The restored database must still take writes.
+	if _, err := db.Exec(`INSERT INTO kv VALUES ('3', 'value')`); err != nil {
+		t.Errorf("insert after restore: %v", err)
+	}
+}
+
+func TestSessionDBFlushesAfterCommit(t *testing.T) {
+	dir := t.TempDir()
+	store := testEncryptedStore(t, dir)
+
+	db, err := openSessionDB(store, dir, "test.db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE kv (k TEXT PRIMARY KEY, v TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without Close, the commit alone must reach the store.
+	deadline := time.Now().Add(10 * sessionDBFlushDelay)
+	for {
+		if _, err := store.Load("test.db"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("commit was not written back")
+		}
+		time.Sleep(sessionDBFlushDelay / 4)
+	}
+
+	copyDB, err := openSessionDB(store, dir, "test.db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copyDB.Close()
+	if n := countRows(t, copyDB, "kv"); n != 0 {
+		t.Errorf("written back database has %d rows, want 0", n)
+	}
+}
+
+func TestSessionDBFlushSkipsUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	store := testEncryptedStore(t, dir)
+	db, err := openSessionDB(store, dir, "test.db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE kv (k TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.flush(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "test.db.enc")
+	before, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.flush(); err != nil {
+		t.Fatal(err)
+	}
+	// Each write uses a fresh nonce, so an unchanged file was not rewritten.
+	if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+		t.Error("unchanged database was written back")
+	}
+}
+
+func TestSessionDBMigratesPlaintext(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	plain, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Exec(`CREATE TABLE kv (k TEXT PRIMARY KEY, v TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Exec(`INSERT INTO kv VALUES ('a', '1'), ('b', '2')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store := testEncryptedStore(t, dir)
+	db, err := openSessionDB(store, dir, "test.db", "_journal_mode=WAL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := countRows(t, db, "kv"); n != 2 {
+		t.Errorf("migrated database has %d rows, want 2", n)
+	}
+	for _, p := range []string{path, path + "-wal", path + "-shm"} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left after migration: %v", filepath.Base(p), err)
+		}
+	}
+	if _, err := store.Load("test.db"); err != nil {
+		t.Errorf("encrypted entry missing after migration: %v", err)
+	}
+}
+
+func TestSessionDBPlain(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openSessionDB(protocol.FileSessionStore{Dir: dir}, dir, "test.db", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE kv (k TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.db")); err != nil {
+		t.Errorf("plain database not on disk: %v", err)
+	}
+}
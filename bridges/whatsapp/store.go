@@ -0,0 +1,540 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	waProto "google.golang.org/protobuf/proto"
+)
+
+// messageStore is the bridge's local WhatsApp message archive. WhatsApp has
+// no server-side history or search, so everything the bridge sees is kept
+// here, in a SQLite database next to whatsmeow's own whatsapp.db. It also
+// indexes downloaded media by message, so it is opened through the session
+// store and encrypted at rest along with the device keys.
+type messageStore struct {
+	db *sessionDB
+	// tx, when set, is the transaction the store writes to, see begin.
+	tx *sql.Tx
+}
+
+const messageSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	chat_id    TEXT    NOT NULL,
+	id         TEXT    NOT NULL,
+	sender     TEXT    NOT NULL,
+	from_me    INTEGER NOT NULL,
+	text       TEXT    NOT NULL DEFAULT '',
+	media      TEXT    NOT NULL DEFAULT '',
+	image_path TEXT    NOT NULL DEFAULT '',
+	timestamp  INTEGER NOT NULL,
+	edited_at  INTEGER NOT NULL DEFAULT 0,
+	original   BLOB,
+	PRIMARY KEY (chat_id, id)
+);
+CREATE INDEX IF NOT EXISTS messages_chat_time ON messages (chat_id, timestamp DESC, id DESC);
+CREATE INDEX IF NOT EXISTS messages_time ON messages (timestamp DESC, id DESC);
+CREATE TABLE IF NOT EXISTS chats (
+	chat_id     TEXT    PRIMARY KEY,
+	name        TEXT    NOT NULL DEFAULT '',
+	unread      INTEGER NOT NULL DEFAULT 0,
+	pinned      INTEGER NOT NULL DEFAULT 0,
+	archived    INTEGER NOT NULL DEFAULT 0,
+	muted_until INTEGER NOT NULL DEFAULT 0,
+	timestamp   INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS reactions (
+	chat_id    TEXT    NOT NULL,
+	message_id TEXT    NOT NULL,
+	sender     TEXT    NOT NULL,
+	emoji      TEXT    NOT NULL,
+	timestamp  INTEGER NOT NULL,
+	PRIMARY KEY (chat_id, message_id, sender)
+);
+`
+
+// muteForever is the muted_until of a chat muted indefinitely. Otherwise it
+// is the unix time the mute ends, or 0 when the chat is not muted.
+const muteForever = -1
+
+// openMessageStore opens (creating if needed) the message store in dir.
+func openMessageStore(sessions protocol.SessionStore, dir string) (*messageStore, error) {
+	db, err := openSessionDB(sessions, dir, "whatsapp-messages.db", "_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("open message store: %w", err)
+	}
+	if _, err := db.Exec(messageSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init message store: %w", err)
+	}
+	return &messageStore{db: db}, nil
+}
+
+// Close closes the underlying database.
+func (s *messageStore) Close() error {
+	return s.db.Close()
+}
+
+// begin starts a transaction and returns a store that writes to it until
+// commit or rollback. Only writes may go through the returned store, and
+// nothing else may use the store meanwhile: an encrypted database has one
+// connection, which the transaction holds.
+func (s *messageStore) begin() (*messageStore, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin message store transaction: %w", err)
+	}
+	return &messageStore{db: s.db, tx: tx}, nil
+}
+
+// commit commits the transaction of a store returned by begin.
+func (s *messageStore) commit() error {
+	if err := s.tx.Commit(); err != nil {
+		return fmt.Errorf("commit message store transaction: %w", err)
+	}
+	return nil
+}
+
+// exec runs a write, within the store's transaction if it has one.
+func (s *messageStore) exec(query string, args ...any) (sql.Result, error) {
+	if s.tx != nil {
+		return s.tx.Exec(query, args...)
+	}
+	return s.db.Exec(query, args...)
+}
+
+// wipe deletes every stored message and chat.
+func (s *messageStore) wipe() error {
+	if _, err := s.exec(`DELETE FROM messages; DELETE FROM chats; DELETE FROM reactions;`); err != nil {
+		return fmt.Errorf("wipe message store: %w", err)
+	}
+	return nil
+}
+
+// save inserts or refreshes a message, received or sent as msg. An existing
+// edit timestamp is kept unless the new copy is more recent. msg itself is
+// kept too, so its media can be forwarded without downloading it.
+func (s *messageStore) save(m protocol.Message, msg *waE2E.Message) error {
+	original, err := waProto.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("save message %s: %w", m.ID, err)
+	}
+	_, err = s.exec(`
+		INSERT INTO messages (chat_id, id, sender, from_me, text, media, image_path, timestamp, edited_at, original)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id, id) DO UPDATE SET
+			sender = excluded.sender,
+			from_me = excluded.from_me,
+			text = CASE WHEN excluded.edited_at >= messages.edited_at THEN excluded.text ELSE messages.text END,
+			media = excluded.media,
+			image_path = CASE WHEN excluded.image_path != '' THEN excluded.image_path ELSE messages.image_path END,
+			timestamp = excluded.timestamp,
+			edited_at = MAX(messages.edited_at, excluded.edited_at),
+			original = excluded.original`,
+		m.ChatID, m.ID, m.From, m.FromMe, m.Text, messageMedia(msg), m.ImagePath, m.Timestamp, m.EditedAt, original)
+	if err != nil {
+		return fmt.Errorf("save message %s: %w", m.ID, err)
+	}
+	if _, err := s.exec(`INSERT INTO chats (chat_id) VALUES (?) ON CONFLICT (chat_id) DO NOTHING`, m.ChatID); err != nil {
+		return fmt.Errorf("save chat %s: %w", m.ChatID, err)
+	}
+	return nil
+}
+
+// chatMeta is the per-chat state the store tracks alongside messages.
+type chatMeta struct {
+	ID     string
+	Name   string
+	Unread int
+	// Pinned is when the chat was pinned (unix seconds), 0 if it is not.
+	Pinned   int64
+	Archived bool
+	// MutedUntil is the chat's muted_until, see muteForever.
+	MutedUntil int64
+	Timestamp  int64
+}
+
+// saveChat inserts or replaces a chat's metadata, as delivered by a history
+// sync. An empty name does not overwrite a known one.
+func (s *messageStore) saveChat(c chatMeta) error {
+	_, err := s.exec(`
+		INSERT INTO chats (chat_id, name, unread, pinned, archived, muted_until, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET
+			name = CASE WHEN excluded.name != '' THEN excluded.name ELSE chats.name END,
+			unread = excluded.unread,
+			pinned = excluded.pinned,
+			archived = excluded.archived,
+			muted_until = excluded.muted_until,
+			timestamp = MAX(chats.timestamp, excluded.timestamp)`,
+		c.ID, c.Name, c.Unread, c.Pinned, c.Archived, c.MutedUntil, c.Timestamp)
+	if err != nil {
+		return fmt.Errorf("save chat %s: %w", c.ID, err)
+	}
+	return nil
+}
+
+// setChatField updates a single column of a chat, creating the row if needed.
+func (s *messageStore) setChatField(chatID, column string, value any) error {
+	_, err := s.exec(`
+		INSERT INTO chats (chat_id, `+column+`) VALUES (?, ?)
+		ON CONFLICT (chat_id) DO UPDATE SET `+column+` = excluded.`+column,
+		chatID, value)
+	if err != nil {
+		return fmt.Errorf("update chat %s %s: %w", chatID, column, err)
+	}
+	return nil
+}
+
+// setChatName records a chat's display name (group subject or contact name).
+func (s *messageStore) setChatName(chatID, name string) error {
+	return s.setChatField(chatID, "name", name)
+}
+
+// setUnread sets a chat's unread count.
+func (s *messageStore) setUnread(chatID string, unread int) error {
+	return s.setChatField(chatID, "unread", unread)
+}
+
+// setPinned records when a chat was pinned (unix seconds), 0 to unpin it.
+func (s *messageStore) setPinned(chatID string, pinnedAt int64) error {
+	return s.setChatField(chatID, "pinned", pinnedAt)
+}
+
+// setArchived sets a chat's archived flag.
+func (s *messageStore) setArchived(chatID string, archived bool) error {
+	return s.setChatField(chatID, "archived", archived)
+}
+
+// setMutedUntil sets a chat's muted_until, see muteForever.
+func (s *messageStore) setMutedUntil(chatID string, until int64) error {
+	return s.setChatField(chatID, "muted_until", until)
+}
+
+// notifyState reports whether a chat is muted now and whether it is archived.
+// Unknown chats are neither.
+func (s *messageStore) notifyState(chatID string) (muted, archived bool, err error) {
+	var until int64
+	err = s.db.QueryRow(`SELECT muted_until, archived FROM chats WHERE chat_id = ?`, chatID).Scan(&until, &archived)
+	if err == sql.ErrNoRows {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, fmt.Errorf("read chat %s: %w", chatID, err)
+	}
+	return muteState(chatID, until).Muted, archived, nil
+}
+
+// muteState converts a stored muted_until to the protocol form. Mutes that
+// have ended read as not muted.
+func muteState(chatID string, until int64) protocol.MuteState {
+	state := protocol.MuteState{ChatID: chatID}
+	switch {
+	case until == muteForever:
+		state.Muted = true
+	case until > time.Now().Unix():
+		state.Muted = true
+		state.Until = until
+	}
+	return state
+}
+
+// incrementUnread bumps a chat's unread count by one.
+func (s *messageStore) incrementUnread(chatID string) error {
+	_, err := s.exec(`
+		INSERT INTO chats (chat_id, unread) VALUES (?, 1)
+		ON CONFLICT (chat_id) DO UPDATE SET unread = chats.unread + 1`, chatID)
+	if err != nil {
+		return fmt.Errorf("increment unread %s: %w", chatID, err)
+	}
+	return nil
+}
+
+// listChats returns every known chat with its latest message: pinned chats
+// first, most recently pinned on top as on the phone, then by most recent
+// activity.
+func (s *messageStore) listChats() ([]protocol.Chat, error) {
+	rows, err := s.db.Query(`
+		SELECT c.chat_id, c.name, c.unread, c.pinned, c.archived, c.muted_until,
+			COALESCE(m.text, ''), MAX(c.timestamp, COALESCE(m.timestamp, 0)) AS last_time
+		FROM chats c
+		LEFT JOIN messages m ON m.rowid = (
+			SELECT rowid FROM messages WHERE chat_id = c.chat_id
+			ORDER BY timestamp DESC, id DESC LIMIT 1)
+		ORDER BY c.pinned DESC, last_time DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("list chats: %w", err)
+	}
+	defer rows.Close()
+
+	out := []protocol.Chat{}
+	for rows.Next() {
+		var c protocol.Chat
+		var pinnedAt, mutedUntil int64
+		if err := rows.Scan(&c.ID, &c.Name, &c.UnreadCount, &pinnedAt, &c.Archived, &mutedUntil, &c.LastMessage, &c.LastTime); err != nil {
+			return nil, fmt.Errorf("scan chat: %w", err)
+		}
+		c.Pinned = pinnedAt != 0
+		mute := muteState(c.ID, mutedUntil)
+		c.Muted, c.MutedUntil = mute.Muted, mute.Until
+		c.LastMessage, _ = parseWhatsApp(c.LastMessage)
+		out = append(out, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("list chats: %w", err)
+	}
+	return out, nil
+}
+
+// edit replaces the text of a stored message.
+func (s *messageStore) edit(chatID, id, text string, editedAt int64) error {
+	_, err := s.exec(`UPDATE messages SET text = ?, edited_at = ? WHERE chat_id = ? AND id = ?`,
+		text, editedAt, chatID, id)
+	if err != nil {
+		return fmt.Errorf("edit message %s: %w", id, err)
+	}
+	return nil
+}
+
+// remove deletes stored messages.
+func (s *messageStore) remove(chatID string, ids []string) error {
+	for _, id := range ids {
+		if _, err := s.exec(`DELETE FROM messages WHERE chat_id = ? AND id = ?`, chatID, id); err != nil {
+			return fmt.Errorf("delete message %s: %w", id, err)
+		}
+		if _, err := s.exec(`DELETE FROM reactions WHERE chat_id = ? AND message_id = ?`, chatID, id); err != nil {
+			return fmt.Errorf("delete reactions of %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// oldest returns the oldest stored message of a chat.
+func (s *messageStore) oldest(chatID string) (protocol.Message, bool, error) {
+	var m protocol.Message
+	err := s.db.QueryRow(`
+		SELECT chat_id, id, sender, from_me, timestamp FROM messages
+		WHERE chat_id = ? ORDER BY timestamp ASC, id ASC LIMIT 1`, chatID).
+		Scan(&m.ChatID, &m.ID, &m.From, &m.FromMe, &m.Timestamp)
+	if err == sql.ErrNoRows {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, fmt.Errorf("oldest message in %s: %w", chatID, err)
+	}
+	return m, true, nil
+}
+
+// get returns a stored message, its text still in WhatsApp markup, and its
+// media kind as classified by messageMedia.
+func (s *messageStore) get(chatID, id string) (protocol.Message, string, bool, error) {
+	m := protocol.Message{ChatID: chatID, ID: id}
+	var media string
+	err := s.db.QueryRow(`
+		SELECT sender, from_me, text, media, image_path, timestamp, edited_at FROM messages
+		WHERE chat_id = ? AND id = ?`, chatID, id).
+		Scan(&m.From, &m.FromMe, &m.Text, &media, &m.ImagePath, &m.Timestamp, &m.EditedAt)
+	if err == sql.ErrNoRows {
+		return m, "", false, nil
+	}
+	if err != nil {
+		return m, "", false, fmt.Errorf("get message %s: %w", id, err)
+	}
+	return m, media, true, nil
+}
+
+// original returns the message proto a stored message was received or sent
+// as, or nil if it is unknown.
+func (s *messageStore) original(chatID, id string) (*waE2E.Message, error) {
+	var b []byte
+	err := s.db.QueryRow(`SELECT original FROM messages WHERE chat_id = ? AND id = ?`, chatID, id).Scan(&b)
+	if err == sql.ErrNoRows || err == nil && b == nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get message %s: %w", id, err)
+	}
+	var msg waE2E.Message
+	if err := waProto.Unmarshal(b, &msg); err != nil {
+		return nil, fmt.Errorf("decode message %s: %w", id, err)
+	}
+	return &msg, nil
+}
+
+// search returns stored messages matching req, newest first, plus the cursor
+// of the next page. The cursor is "timestamp/id" of the last message returned.
+func (s *messageStore) search(req protocol.SearchRequest, limit int) ([]protocol.Message, string, error) {
+	var (
+		where []string
+		args  []any
+	)
+	if q := strings.TrimSpace(req.Query); q != "" {
+		where = append(where, `text LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(q)+"%")
+	}
+	if req.ChatID != "" {
+		where = append(where, `chat_id = ?`)
+		args = append(args, req.ChatID)
+	}
+	if req.From == "me" {
+		where = append(where, `from_me = 1`)
+	} else if req.From != "" {
+		where = append(where, `sender = ?`)
+		args = append(args, req.From)
+	}
+	if req.After > 0 {
+		where = append(where, `timestamp >= ?`)
+		args = append(args, req.After)
+	}
+	if req.Before > 0 {
+		where = append(where, `timestamp <= ?`)
+		args = append(args, req.Before)
+	}
+	if req.Media != "" {
+		where = append(where, `media = ?`)
+		args = append(args, req.Media)
+	}
+	if req.Cursor != "" {
+		ts, id, err := parseStoreCursor(req.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		where = append(where, `(timestamp < ? OR (timestamp = ? AND id < ?))`)
+		args = append(args, ts, ts, id)
+	}
+
+	query := `SELECT chat_id, id, sender, from_me, text, image_path, timestamp, edited_at FROM messages`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY timestamp DESC, id DESC LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("search messages: %w", err)
+	}
+	defer rows.Close()
+
+	out := []protocol.Message{}
+	for rows.Next() {
+		var m protocol.Message
+		if err := rows.Scan(&m.ChatID, &m.ID, &m.From, &m.FromMe, &m.Text, &m.ImagePath, &m.Timestamp, &m.EditedAt); err != nil {
+			return nil, "", fmt.Errorf("scan message: %w", err)
+		}
+		applyMarkup(&m)
+		out = append(out, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("search messages: %w", err)
+	}
+	rows.Close()
+	for i := range out {
+		if out[i].Reactions, err = s.reactions(out[i].ChatID, out[i].ID); err != nil {
+			return nil, "", err
+		}
+	}
+
+	next := ""
+	if len(out) == limit {
+		next = storeCursor(out[len(out)-1])
+	}
+	return out, next, nil
+}
+
+// storeCursor returns the cursor of the page after m.
+func storeCursor(m protocol.Message) string {
+	return strconv.FormatInt(m.Timestamp, 10) + "/" + m.ID
+}
+
+// setReaction records sender's reaction to a message, at timestamp (unix
+// milliseconds). An empty emoji removes it. A reaction older than the one
+// stored, as replayed by a history sync, is ignored.
+func (s *messageStore) setReaction(chatID, msgID, sender, emoji string, timestamp int64) error {
+	_, err := s.exec(`
+		INSERT INTO reactions (chat_id, message_id, sender, emoji, timestamp)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id, message_id, sender) DO UPDATE SET
+			emoji = excluded.emoji,
+			timestamp = excluded.timestamp
+		WHERE excluded.timestamp >= reactions.timestamp`,
+		chatID, msgID, sender, emoji, timestamp)
+	if err != nil {
+		return fmt.Errorf("save reaction to %s: %w", msgID, err)
+	}
+	return nil
+}
+
+// reactions returns the aggregated reactions on a message, nil when none.
+func (s *messageStore) reactions(chatID, msgID string) ([]protocol.Reaction, error) {
+	rows, err := s.db.Query(`
+		SELECT sender, emoji FROM reactions
+		WHERE chat_id = ? AND message_id = ? AND emoji != ''`, chatID, msgID)
+	if err != nil {
+		return nil, fmt.Errorf("reactions of %s: %w", msgID, err)
+	}
+	defer rows.Close()
+
+	senders := make(map[string]string)
+	for rows.Next() {
+		var sender, emoji string
+		if err := rows.Scan(&sender, &emoji); err != nil {
+			return nil, fmt.Errorf("scan reaction: %w", err)
+		}
+		senders[sender] = emoji
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reactions of %s: %w", msgID, err)
+	}
+	if len(senders) == 0 {
+		return nil, nil
+	}
+	return aggregateReactions(senders), nil
+}
+
+// parseStoreCursor decodes a "timestamp/id" cursor.
+func parseStoreCursor(cursor string) (int64, string, error) {
+	parts := strings.SplitN(cursor, "/", 2)
+	if len(parts) != 2 {
+		return 0, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return ts, parts[1], nil
+}
+
+// escapeLike escapes LIKE wildcards so the query matches literally.
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
+
+// messageMedia classifies a message's attachment using the protocol's media
+// filter names. Returns "" for plain text.
+func messageMedia(msg *waE2E.Message) string {
+	switch {
+	case msg.GetImageMessage() != nil:
+		return "photo"
+	case msg.GetVideoMessage() != nil:
+		return "video"
+	case msg.GetAudioMessage() != nil:
+		if msg.GetAudioMessage().GetPTT() {
+			return "voice"
+		}
+		return "audio"
+	case msg.GetDocumentMessage() != nil:
+		return "document"
+	case msg.GetStickerMessage() != nil:
+		return "sticker"
+	case msg.GetExtendedTextMessage().GetMatchedText() != "":
+		return "link"
+	}
+	return ""
+}
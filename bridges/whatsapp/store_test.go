@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	waProto "google.golang.org/protobuf/proto"
+)
+
+func TestMessageStoreTransaction(t *testing.T) {
+	dir := t.TempDir()
+	store, err := openMessageStore(testEncryptedStore(t, dir), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	tx, err := store.begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	video := &waE2E.Message{VideoMessage: &waE2E.VideoMessage{Caption: waProto.String("clip")}}
+	m := protocol.Message{ID: "1", ChatID: "chat", From: "a", Text: "clip", Timestamp: 1}
+	if err := tx.saveChat(chatMeta{ID: "chat", Name: "Chat"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.save(m, video); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.setReaction("chat", "1", "a", "👍", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, media, ok, err := store.get("chat", "1")
+	if err != nil || !ok || got.Text != "clip" || media != "video" {
+		t.Fatalf("get = %+v, %q, %v, %v; want the saved video", got, media, ok, err)
+	}
+	orig, err := store.original("chat", "1")
+	if err != nil || !waProto.Equal(orig, video) {
+		t.Errorf("original = %v, %v; want %v", orig, err, video)
+	}
+	if reactions, err := store.reactions("chat", "1"); err != nil || len(reactions) != 1 {
+		t.Errorf("reactions = %v, %v; want one", reactions, err)
+	}
+	if orig, err := store.original("chat", "2"); err != nil || orig != nil {
+		t.Errorf("original of an unknown message = %v, %v; want nil", orig, err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aigustalabs/switchboard/bridges/protocol"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// typingTTL bounds a "composing" state that is never followed by "paused".
+const typingTTL = 15 * time.Second
+
+// handleChatPresence emits typing events from composing/paused chat states.
+func handleChatPresence(client *waClient, evt *events.ChatPresence) {
+	chatID := evt.Chat.String()
+	from := evt.Sender.String()
+
+	var err error
+	if evt.State == types.ChatPresenceComposing {
+		action := "typing"
+		if evt.Media == types.ChatPresenceMediaAudio {
+			action = "recording"
+		}
+		err = client.typing.Start(chatID, from, action, typingTTL)
+	} else {
+		err = client.typing.Stop(chatID, from)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "send typing: %v\n", err)
+	}
+}
+
+// handlePresence emits a presence event for a subscribed contact.
+func handlePresence(client *waClient, evt *events.Presence) {
+	p := protocol.Presence{
+		UserID: evt.From.String(),
+		Online: !evt.Unavailable,
+	}
+	if !evt.LastSeen.IsZero() {
+		p.LastSeen = evt.LastSeen.Unix()
+	}
+	if err := client.writer.SendTyped("presence", "", p); err != nil {
+		fmt.Fprintf(os.Stderr, "send presence: %v\n", err)
+	}
+}
+
+// subscribePresence asks WhatsApp for presence updates of a direct chat peer.
+// WhatsApp only delivers presence to clients that are themselves available,
+// so we announce availability first. Group chats are skipped.
+func subscribePresence(client *waClient, jid types.JID) {
+	if jid.Server != types.DefaultUserServer {
+		return
+	}
+	if err := client.wa().SendPresence(types.PresenceAvailable); err != nil {
+		fmt.Fprintf(os.Stderr, "send presence available: %v\n", err)
+		return
+	}
+	if err := client.wa().SubscribePresence(jid); err != nil {
+		fmt.Fprintf(os.Stderr, "subscribe presence %s: %v\n", jid, err)
+	}
+}
+
+// handleSetTyping shows or clears our typing indicator in a chat.
+func handleSetTyping(client *waClient, reqID string, req protocol.TypingRequest) {
+	if !client.wa().IsConnected() {
+		sendError(client, reqID, "chat.typing: not connected")
+		return
+	}
+	jid, err := types.ParseJID(req.ChatID)
+	if err != nil {
+		sendError(client, reqID, "parse JID %q: %v", req.ChatID, err)
+		return
+	}
+
+	state := types.ChatPresencePaused
+	if req.Typing {
+		state = types.ChatPresenceComposing
+	}
+	if err := client.wa().SendChatPresence(jid, state, types.ChatPresenceMediaText); err != nil {
+		sendError(client, reqID, "send chat presence to %s: %v", req.ChatID, err)
+	}
+}
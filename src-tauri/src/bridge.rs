@@ -31,14 +31,30 @@ struct BridgeProcess {
     status: BridgeStatus,
 }
 
+/// A cross-service forward waiting for the target bridge to answer its
+/// `message.copy` commands. The answers arrive on the target's event channel,
+/// so they are collected here into one result for the source's listeners.
+struct ForwardRelay {
+    source: String,
+    chat_id: String,
+    remaining: usize,
+    message_ids: Vec<String>,
+    /// Why the messages after the first `remaining` were not copied, if any
+    /// were left out.
+    error: Option<String>,
+}
+
 pub struct BridgeManager {
     bridges: HashMap<String, BridgeProcess>,
+    /// Forwards in flight, keyed by target service and request ID.
+    relays: HashMap<(String, String), ForwardRelay>,
 }
 
 impl BridgeManager {
     pub fn new() -> Self {
         BridgeManager {
             bridges: HashMap::new(),
+            relays: HashMap::new(),
         }
     }
 
@@ -115,7 +131,8 @@ impl BridgeManager {
                                 if let Some(msg_type) = payload.get("type").and_then(|t| t.as_str()) {
                                     let new_status = match msg_type {
                                         "auth.success" => Some(BridgeStatus::Connected),
-                                        "auth.qr" | "auth.code_needed" | "auth.phone_needed" => {
+                                        "auth.qr" | "auth.pair_code" | "auth.code_needed"
+                                        | "auth.phone_needed" | "auth.failed" | "auth.timeout" => {
                                             Some(BridgeStatus::AuthNeeded)
                                         }
                                         "status" => {
@@ -125,9 +142,12 @@ impl BridgeManager {
                                                 .and_then(|d| d.get("status"))
                                                 .and_then(|s| s.as_str())
                                                 .and_then(|s| match s {
-                                                    "auth_needed" => Some(BridgeStatus::AuthNeeded),
+                                                    "auth_needed" | "logged_out" | "locked" => {
+                                                        Some(BridgeStatus::AuthNeeded)
+                                                    }
                                                     "connected" => Some(BridgeStatus::Connected),
-                                                    "disconnected" => Some(BridgeStatus::Disconnected),
+                                                    "connecting" | "reconnecting" | "disconnected"
+                                                    | "banned" => Some(BridgeStatus::Disconnected),
                                                     _ => None,
                                                 })
                                         }
@@ -139,6 +159,16 @@ impl BridgeManager {
                                             bp.status = status;
                                         }
                                     }
+
+                                    // Cross-service forwards are relayed here
+                                    // rather than shown to the frontend.
+                                    if msg_type == "forward.copy" {
+                                        Self::relay_forward_copy(&manager, &service, &app, &event_name, &payload)
+                                            .await;
+                                        continue;
+                                    }
+                                    Self::track_forward_reply(&manager, &service, &app, msg_type, &payload)
+                                        .await;
                                 }
 
                                 if let Err(e) = app.emit(&event_name, payload) {
@@ -177,9 +207,28 @@ impl BridgeManager {
             }
 
             // Process exited — update status and remove the dead entry.
+            // Forwards it was copying will never be answered: fail them.
             {
                 let mut mgr = manager.lock().await;
                 mgr.bridges.remove(&service);
+                let orphaned: Vec<(String, String)> = mgr
+                    .relays
+                    .keys()
+                    .filter(|(target, _)| *target == service)
+                    .cloned()
+                    .collect();
+                for key in orphaned {
+                    if let Some(relay) = mgr.relays.remove(&key) {
+                        let _ = app.emit(
+                            &format!("bridge-event-{}", relay.source),
+                            serde_json::json!({
+                                "type": "error",
+                                "id": key.1,
+                                "data": { "message": format!("bridge '{}' exited", service) },
+                            }),
+                        );
+                    }
+                }
             }
 
             // Emit a disconnected event so the frontend can react.
@@ -193,6 +242,152 @@ impl BridgeManager {
         }
     }
 
+    /// Relay a `forward.copy` from `service` to the target bridge as one
+    /// `message.copy` command per message, keeping the original request ID.
+    /// The source's listeners get a `message.forward` result once the target
+    /// has answered them all (see `track_forward_reply`), or an `error` event
+    /// if none could be sent.
+    async fn relay_forward_copy(
+        manager: &Arc<Mutex<BridgeManager>>,
+        service: &str,
+        app: &AppHandle,
+        event_name: &str,
+        payload: &Value,
+    ) {
+        let id = payload.get("id").cloned().unwrap_or(Value::Null);
+        let data = payload.get("data");
+        let target = data
+            .and_then(|d| d.get("to_service"))
+            .and_then(|s| s.as_str())
+            .unwrap_or_default();
+        let messages = data
+            .and_then(|d| d.get("messages"))
+            .and_then(|m| m.as_array())
+            .cloned()
+            .unwrap_or_default();
+
+        let chat_id = messages
+            .first()
+            .and_then(|m| m.get("chat_id"))
+            .and_then(|c| c.as_str())
+            .unwrap_or_default()
+            .to_string();
+
+        let key = match id.as_str() {
+            Some(req_id) if !messages.is_empty() => Some((target.to_string(), req_id.to_string())),
+            _ => None,
+        };
+
+        // The relay is recorded first and the lock held until every copy is
+        // sent, so the target's answers always find it.
+        let mut mgr = manager.lock().await;
+        if let Some(key) = &key {
+            mgr.relays.insert(
+                key.clone(),
+                ForwardRelay {
+                    source: service.to_string(),
+                    chat_id: chat_id.clone(),
+                    remaining: messages.len(),
+                    message_ids: Vec::new(),
+                    error: None,
+                },
+            );
+        }
+        for (sent, message) in messages.iter().enumerate() {
+            let command = serde_json::json!({ "type": "message.copy", "id": id, "data": message });
+            if let Err(e) = mgr.send_to_bridge(target, &command.to_string()).await {
+                eprintln!("[bridge:{}] forward.copy to '{}': {}", service, target, e);
+                // Copies already sent are still answered; the result lists
+                // them along with the error.
+                if sent > 0 {
+                    if let Some(relay) = key.as_ref().and_then(|key| mgr.relays.get_mut(key)) {
+                        relay.remaining = sent;
+                        relay.error = Some(e);
+                        return;
+                    }
+                }
+                if let Some(key) = &key {
+                    mgr.relays.remove(key);
+                }
+                let _ = app.emit(
+                    event_name,
+                    serde_json::json!({ "type": "error", "id": id, "data": { "message": e } }),
+                );
+                return;
+            }
+        }
+
+        if key.is_none() {
+            let _ = app.emit(
+                event_name,
+                serde_json::json!({
+                    "type": "message.forward",
+                    "id": id,
+                    "data": { "chat_id": chat_id, "message_ids": [] },
+                }),
+            );
+        }
+    }
+
+    /// Count an answer of bridge `service` to a relayed `message.copy`.
+    /// Once every message sent is copied, the forward's source gets a
+    /// `message.forward` result on its own event channel, with an `error`
+    /// if some messages could not be sent; on the first `error` answer it
+    /// gets that instead. Other events pass through untouched.
+    async fn track_forward_reply(
+        manager: &Arc<Mutex<BridgeManager>>,
+        service: &str,
+        app: &AppHandle,
+        msg_type: &str,
+        payload: &Value,
+    ) {
+        // Telegram answers with message.sent, WhatsApp with the message.new
+        // echo of the copy.
+        let message_id = match msg_type {
+            "message.sent" => payload.pointer("/data/message_id"),
+            "message.new" => payload.pointer("/data/id"),
+            "error" => None,
+            _ => return,
+        };
+        let id = match payload.get("id").and_then(|i| i.as_str()) {
+            Some(id) if !id.is_empty() => id,
+            _ => return,
+        };
+        let key = (service.to_string(), id.to_string());
+
+        let mut mgr = manager.lock().await;
+        let result = match mgr.relays.get_mut(&key) {
+            None => return,
+            Some(_) if msg_type == "error" => serde_json::json!({
+                "type": "error",
+                "id": id,
+                "data": payload.get("data").cloned().unwrap_or(Value::Null),
+            }),
+            Some(relay) => {
+                if let Some(m) = message_id.and_then(|m| m.as_str()) {
+                    relay.message_ids.push(m.to_string());
+                }
+                relay.remaining -= 1;
+                if relay.remaining > 0 {
+                    return;
+                }
+                let mut data = serde_json::json!({
+                    "chat_id": relay.chat_id,
+                    "message_ids": relay.message_ids,
+                });
+                if let Some(e) = &relay.error {
+                    data["error"] = Value::from(e.as_str());
+                }
+                serde_json::json!({ "type": "message.forward", "id": id, "data": data })
+            }
+        };
+        if let Some(relay) = mgr.relays.remove(&key) {
+            if let Err(e) = app.emit(&format!("bridge-event-{}", relay.source), result) {
+                eprintln!("[bridge:{}] Failed to emit event: {}", relay.source, e);
+            }
+        }
+    }
+
     /// Write a raw message (newline-terminated) to the bridge's stdin.
     pub async fn send_to_bridge(&mut self, service: &str, message: &str) -> Result<(), String> {
         let bp = self